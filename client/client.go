@@ -1,6 +1,7 @@
 package client
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/baetyl/baetyl-go/v2/mqtt"
@@ -9,10 +10,76 @@ import (
 )
 
 type Client interface {
+	// SendOrDrop sends the message to target, if no error is returned, the callback of message
+	// is invoked exactly once when the target has confirmed the delivery or it has given up
 	SendOrDrop(pkt *config.TargetMsg) error
+	// SendPubAck acknowledges the source packet which has been delivered to all targets
 	SendPubAck(pkt mqtt.Packet) error
 	Start(obs mqtt.Observer) error
 	ResetClient(cfg *mqtt.ClientConfig)
 	SetReconnectCallback(callback mqtt.ReconnectCallback)
 	io.Closer
 }
+
+// Nacker is implemented by the source clients which handle the packet failed to be delivered at once,
+// instead of waiting for the redelivery, e.g. the rabbit-mq delivery is requeued
+type Nacker interface {
+	// SendNack reports the source packet which failed to be delivered to any target, it is never acknowledged
+	SendNack(id mqtt.ID) error
+}
+
+// Subscriber is implemented by the source clients which change the subscriptions on the live connection,
+// instead of reconnecting, the changed subscriptions are also used once reconnected
+type Subscriber interface {
+	// Subscribe subscribes the topics, the qos of a topic already subscribed is replaced
+	Subscribe(subs []mqtt.QOSTopic) error
+	// Unsubscribe unsubscribes the topics
+	Unsubscribe(topics []string) error
+}
+
+// Queued is implemented by the clients which buffer messages in queue before sending them
+type Queued interface {
+	// QueueLen returns the number of messages waiting in the queue
+	QueueLen() int
+	// InFlight returns the number of messages being sent by the workers
+	InFlight() int
+}
+
+// metaHeaders returns the headers in the meta of message, which may be decoded from the persistent queue
+func metaHeaders(meta map[string]any) map[string]string {
+	switch v := meta[config.MetaHeaders].(type) {
+	case map[string]string:
+		return v
+	case map[string]any:
+		headers := make(map[string]string, len(v))
+		for k, val := range v {
+			headers[k] = fmt.Sprint(val)
+		}
+		return headers
+	}
+	return nil
+}
+
+// mergeSubscriptions returns the subscriptions with the new ones, which replace the ones of the same topics
+func mergeSubscriptions(subs, added []mqtt.QOSTopic) []mqtt.QOSTopic {
+	topics := make([]string, 0, len(added))
+	for _, s := range added {
+		topics = append(topics, s.Topic)
+	}
+	return append(removeSubscriptions(subs, topics), added...)
+}
+
+// removeSubscriptions returns the subscriptions without the topics
+func removeSubscriptions(subs []mqtt.QOSTopic, topics []string) []mqtt.QOSTopic {
+	removed := make(map[string]bool, len(topics))
+	for _, topic := range topics {
+		removed[topic] = true
+	}
+	res := make([]mqtt.QOSTopic, 0, len(subs))
+	for _, s := range subs {
+		if !removed[s.Topic] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -0,0 +1,355 @@
+package client
+
+import (
+	goerrors "errors"
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/utils"
+	"github.com/jpillora/backoff"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+const popErrorInterval = 5 * time.Second
+
+// The default number of workers sending messages concurrently, and the size of the queue of each worker sending in order
+const (
+	defaultSenderWorkers = 16
+	senderQueueSize      = 16
+)
+
+// DeliveryConfig delivery config shared by target clients
+type DeliveryConfig struct {
+	Queue  QueueConfig  `yaml:"queue" json:"queue"`
+	Retry  RetryConfig  `yaml:"retry" json:"retry"`
+	Sender SenderConfig `yaml:"sender" json:"sender"`
+	Batch  BatchConfig  `yaml:"batch" json:"batch"`
+}
+
+// The formats of http batch
+const (
+	batchFormatJSON   = "json"
+	batchFormatNDJSON = "ndjson"
+)
+
+// BatchConfig the messages sent to the same destination are sent at once as a batch, which is sent once it is full
+// or the linger time since its first message is exceeded. A batch is retried and completed as a whole
+type BatchConfig struct {
+	// MaxCount the max number of messages in a batch, the messages are sent one by one if it is not greater than 1
+	MaxCount int `yaml:"maxCount" json:"maxCount"`
+	// MaxSize the max bytes of the payloads in a batch
+	MaxSize utils.Size `yaml:"maxSize" json:"maxSize" default:"1048576"`
+	// Linger the max time to wait for more messages since the first message of batch
+	Linger time.Duration `yaml:"linger" json:"linger" default:"1s"`
+	// Format the format of the body of http batch, which is json (an array of payloads) or ndjson, only used by http client
+	Format string `yaml:"format" json:"format" default:"json"`
+}
+
+// SenderConfig the workers sending the messages popped from queue
+type SenderConfig struct {
+	// Workers the max number of messages sent concurrently, which is 16 by default, or 1 for the persistent queue
+	// and the clients sending in order. The messages are sent in order by a single worker
+	Workers int `yaml:"workers" json:"workers"`
+	// OrderKey the key of messages sent in order by the same worker, which is "topic", or the field of json payload
+	// prefixed with "payload.", e.g. "payload.device.id". The messages are sent by any idle worker if it is not set
+	OrderKey string `yaml:"orderKey" json:"orderKey"`
+}
+
+// RetryConfig retry policy of failed deliveries
+type RetryConfig struct {
+	// MaxAttempts the max attempts of a delivery, -1 means retrying until delivered,
+	// if not set, it is 1 for memory queue and unlimited for persistent queue
+	MaxAttempts int           `yaml:"maxAttempts" json:"maxAttempts"`
+	Min         time.Duration `yaml:"min" json:"min" default:"1s"`
+	Max         time.Duration `yaml:"max" json:"max" default:"1m"`
+	Factor      float64       `yaml:"factor" json:"factor" default:"2"`
+	Jitter      bool          `yaml:"jitter" json:"jitter" default:"true"`
+	// StatusCodes the http status codes which can be retried, only used by http client
+	StatusCodes []int `yaml:"statusCodes" json:"statusCodes" default:"[408,429,500,502,503,504]"`
+}
+
+// SendFunc sends a message to target
+type SendFunc func(msg *config.TargetMsg) error
+
+// BatchSendFunc sends the messages of a batch to target at once
+type BatchSendFunc func(msgs []*config.TargetMsg) error
+
+// BatchKeyFunc returns the destination of message, only the messages with the same destination are sent in a batch
+type BatchKeyFunc func(msg *config.TargetMsg) string
+
+// DeliveryError the error of a delivery which has given up
+type DeliveryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("failed to deliver after %d attempts: %s", e.Attempts, e.Err.Error())
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+type permanentError struct {
+	error
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.error
+}
+
+// Permanent marks the error as permanent, so that the delivery is not retried
+func Permanent(err error) error {
+	return &permanentError{err}
+}
+
+// IsPermanent returns true if the error should not be retried
+func IsPermanent(err error) bool {
+	var pe *permanentError
+	return goerrors.As(err, &pe)
+}
+
+// dispatcher pops messages from the queue of target client and sends them by a fixed number of workers,
+// messages of persistent queue are sent in order by default and redelivered until they succeed
+type dispatcher struct {
+	queue       Queue
+	send        SendFunc
+	retry       RetryConfig
+	maxAttempts int
+	workers     []chan *Message // the workers share a channel unless the messages are sent in order by key
+	keyed       bool            // the messages with the same order key are sent in order by the same worker
+	field       string          // the field of json payload as order key, the topic is used if it is empty
+	batch       BatchConfig
+	sendBatch   BatchSendFunc // nil if the client does not support batch
+	batchKey    BatchKeyFunc
+	inFlight    int32
+	tomb        utils.Tomb
+	logger      *log.Logger
+}
+
+// newDispatcher creates the dispatcher, the messages are sent one by one by default if the client is not concurrent
+func newDispatcher(cfg DeliveryConfig, send SendFunc, concurrent bool, logger *log.Logger) (*dispatcher, error) {
+	workers := cfg.Sender.Workers
+	if workers < 0 {
+		return nil, errors.Errorf("workers (%d) of sender must not be negative", workers)
+	}
+	var keyed bool
+	var field string
+	if key := cfg.Sender.OrderKey; key != "" {
+		field, keyed = config.ParseOrderKey(key)
+		if !keyed {
+			return nil, errors.Errorf("order key (%s) of sender must be topic or the field of payload like payload.id", key)
+		}
+	}
+	if cfg.Batch.MaxCount > 1 && (cfg.Batch.MaxSize <= 0 || cfg.Batch.Linger <= 0) {
+		return nil, errors.New("maxSize and linger of batch must be positive")
+	}
+	queue, err := NewQueue(cfg.Queue)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	maxAttempts := cfg.Retry.MaxAttempts
+	if maxAttempts == 0 && !queue.Persistent() {
+		maxAttempts = 1
+	}
+	if workers == 0 {
+		workers = 1
+		if concurrent && !queue.Persistent() {
+			workers = defaultSenderWorkers
+		}
+	}
+	d := &dispatcher{
+		queue:       queue,
+		send:        send,
+		retry:       cfg.Retry,
+		maxAttempts: maxAttempts,
+		workers:     make([]chan *Message, workers),
+		keyed:       keyed && workers > 1,
+		field:       field,
+		batch:       cfg.Batch,
+		logger:      logger,
+	}
+	shared := make(chan *Message)
+	for i := range d.workers {
+		d.workers[i] = shared
+		if d.keyed {
+			d.workers[i] = make(chan *Message, senderQueueSize)
+		}
+	}
+	return d, nil
+}
+
+func (d *dispatcher) push(msg *config.TargetMsg) error {
+	return d.queue.Push(msg)
+}
+
+// batching enables the batches of the client, which are sent by the function
+func (d *dispatcher) batching(send BatchSendFunc, key BatchKeyFunc) {
+	d.sendBatch = send
+	d.batchKey = key
+}
+
+func (d *dispatcher) start() error {
+	if d.batch.MaxCount > 1 && d.sendBatch == nil {
+		return errors.New("batch is not supported by the client")
+	}
+	fs := []func() error{d.dispatching}
+	for _, ch := range d.workers {
+		ch := ch
+		fs = append(fs, func() error {
+			return d.sending(ch)
+		})
+	}
+	return d.tomb.Go(fs...)
+}
+
+// InFlight returns the number of messages being sent, including the ones waiting for retry
+func (d *dispatcher) InFlight() int {
+	return int(atomic.LoadInt32(&d.inFlight))
+}
+
+func (d *dispatcher) dispatching() error {
+	for {
+		msg, err := d.queue.Pop()
+		if err != nil {
+			if !d.tomb.Alive() {
+				return nil
+			}
+			d.logger.Error("failed to pop message from queue", log.Error(err))
+			select {
+			case <-d.tomb.Dying():
+				return nil
+			case <-time.After(popErrorInterval):
+				continue
+			}
+		}
+		// the message popped is dropped if the dispatcher is closed, the one of persistent queue is replayed after restart
+		select {
+		case <-d.tomb.Dying():
+			return nil
+		case d.worker(msg) <- msg:
+		}
+	}
+}
+
+// worker returns the worker of message, the messages with the same order key are sent by the same worker
+func (d *dispatcher) worker(msg *Message) chan *Message {
+	if !d.keyed {
+		return d.workers[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(config.OrderKey(msg.Topic, msg.Data, d.field)))
+	return d.workers[h.Sum32()%uint32(len(d.workers))]
+}
+
+// sending sends the messages of worker, which are collected into batches if the batch is enabled,
+// the message which does not fit into the current batch starts the next one
+func (d *dispatcher) sending(ch chan *Message) error {
+	var next *Message
+	for {
+		msg := next
+		next = nil
+		if msg == nil {
+			select {
+			case <-d.tomb.Dying():
+				return nil
+			case msg = <-ch:
+			}
+		}
+		batch := []*Message{msg}
+		if d.batch.MaxCount > 1 && msg.Response == nil {
+			batch, next = d.collect(ch, batch)
+		}
+		atomic.AddInt32(&d.inFlight, int32(len(batch)))
+		d.deliver(batch)
+		atomic.AddInt32(&d.inFlight, -int32(len(batch)))
+	}
+}
+
+// collect collects the messages of worker into the batch until it is full or the linger time is exceeded, it returns
+// the message which can not be added, e.g. the one to another destination, or the one waiting for its response
+func (d *dispatcher) collect(ch chan *Message, batch []*Message) ([]*Message, *Message) {
+	key := d.batchKey(batch[0].TargetMsg)
+	size := len(batch[0].Data)
+	timer := time.NewTimer(d.batch.Linger)
+	defer timer.Stop()
+	for len(batch) < d.batch.MaxCount {
+		select {
+		case <-d.tomb.Dying():
+			return batch, nil
+		case <-timer.C:
+			return batch, nil
+		case msg := <-ch:
+			if msg.Response != nil || d.batchKey(msg.TargetMsg) != key || size+len(msg.Data) > int(d.batch.MaxSize) {
+				return batch, msg
+			}
+			batch = append(batch, msg)
+			size += len(msg.Data)
+		}
+	}
+	return batch, nil
+}
+
+// deliver sends the messages and retries them with backoff until they succeed, the error is permanent,
+// the attempts are exhausted or the dispatcher is closed, then the callbacks of messages are invoked.
+// The messages more than one are sent as a batch
+func (d *dispatcher) deliver(batch []*Message) {
+	bf := &backoff.Backoff{
+		Min:    d.retry.Min,
+		Max:    d.retry.Max,
+		Factor: d.retry.Factor,
+		Jitter: d.retry.Jitter,
+	}
+	msgs := make([]*config.TargetMsg, len(batch))
+	for i, msg := range batch {
+		msgs[i] = msg.TargetMsg
+	}
+	topic := batch[0].Topic
+	var err error
+	var attempts int
+	for {
+		attempts++
+		if len(msgs) == 1 {
+			err = d.send(msgs[0])
+		} else {
+			err = d.sendBatch(msgs)
+		}
+		if err == nil || IsPermanent(err) || (d.maxAttempts > 0 && attempts >= d.maxAttempts) {
+			break
+		}
+		next := bf.Duration()
+		d.logger.Warn("failed to send message, retry later", log.Any("topic", topic), log.Any("count", len(msgs)), log.Any("attempts", attempts), log.Any("next", next), log.Error(err))
+		select {
+		case <-d.tomb.Dying():
+			// the message of persistent queue will be replayed after restart
+			return
+		case <-time.After(next):
+		}
+	}
+	if err != nil {
+		d.logger.Error("failed to send message", log.Any("topic", topic), log.Any("count", len(msgs)), log.Any("attempts", attempts), log.Error(err))
+		err = &DeliveryError{Attempts: attempts, Err: err}
+	}
+	for _, msg := range batch {
+		// the queue may have been closed, the message will be replayed after restart
+		if aerr := d.queue.Ack(msg); aerr != nil && d.tomb.Alive() {
+			d.logger.Error("failed to ack message of queue", log.Error(aerr))
+		}
+		msg.Complete(err)
+	}
+}
+
+func (d *dispatcher) close() error {
+	d.tomb.Kill(nil)
+	err := d.queue.Close()
+	if err != nil {
+		d.logger.Error("failed to close queue", log.Error(err))
+	}
+	return errors.Trace(d.tomb.Wait())
+}
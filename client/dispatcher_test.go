@@ -0,0 +1,202 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestDispatcherWorkers(t *testing.T) {
+	logger := log.With(log.Any("client", "test"))
+
+	// the messages are sent by a bounded number of workers
+	var sending, maxSending int32
+	release := make(chan struct{})
+	d, err := newDispatcher(DeliveryConfig{Sender: SenderConfig{Workers: 2}}, func(msg *config.TargetMsg) error {
+		n := atomic.AddInt32(&sending, 1)
+		defer atomic.AddInt32(&sending, -1)
+		for {
+			m := atomic.LoadInt32(&maxSending)
+			if n <= m || atomic.CompareAndSwapInt32(&maxSending, m, n) {
+				break
+			}
+		}
+		<-release
+		return nil
+	}, true, logger)
+	assert.NoError(t, err)
+	assert.NoError(t, d.start())
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		assert.NoError(t, d.push(&config.TargetMsg{Topic: "a", Callback: func(err error) {
+			assert.NoError(t, err)
+			wg.Done()
+		}}))
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, d.InFlight())
+	// a message is popped and waits for an idle worker
+	assert.Equal(t, 7, d.queue.Len())
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxSending))
+	assert.Equal(t, 0, d.InFlight())
+	assert.NoError(t, d.close())
+
+	// the messages with the same order key are sent in order, the others are not blocked
+	var mu sync.Mutex
+	var sent []string
+	d, err = newDispatcher(DeliveryConfig{Sender: SenderConfig{Workers: 4, OrderKey: "payload.device.id"}}, func(msg *config.TargetMsg) error {
+		if strings.Contains(string(msg.Data), "slow") {
+			time.Sleep(300 * time.Millisecond)
+		}
+		mu.Lock()
+		sent = append(sent, msg.Topic)
+		mu.Unlock()
+		return nil
+	}, true, logger)
+	assert.NoError(t, err)
+	assert.NoError(t, d.start())
+	wg.Add(3)
+	callback := func(error) { wg.Done() }
+	assert.NoError(t, d.push(&config.TargetMsg{Topic: "1", Data: []byte(`{"device":{"id":"d1"},"slow":true}`), Callback: callback}))
+	assert.NoError(t, d.push(&config.TargetMsg{Topic: "2", Data: []byte(`{"device":{"id":"d1"}}`), Callback: callback}))
+	// the messages of different keys may share a worker, so the key is picked for another worker
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("d%d", i)
+		msg := &Message{TargetMsg: &config.TargetMsg{Data: []byte(fmt.Sprintf(`{"device":{"id":"%s"}}`, key))}}
+		if d.worker(msg) != d.worker(&Message{TargetMsg: &config.TargetMsg{Data: []byte(`{"device":{"id":"d1"}}`)}}) {
+			break
+		}
+	}
+	assert.NoError(t, d.push(&config.TargetMsg{Topic: "3", Data: []byte(fmt.Sprintf(`{"device":{"id":"%s"}}`, key)), Callback: callback}))
+	wg.Wait()
+	assert.Equal(t, []string{"3", "1", "2"}, sent)
+	assert.NoError(t, d.close())
+
+	// the messages of persistent queue, or the clients not concurrent, are sent one by one by default
+	d, err = newDispatcher(DeliveryConfig{Queue: QueueConfig{Path: path.Join(t.TempDir(), "queue.db"), MaxCount: 10, MaxSize: 1024}}, nil, true, logger)
+	assert.NoError(t, err)
+	assert.Len(t, d.workers, 1)
+	assert.NoError(t, d.close())
+	d, err = newDispatcher(DeliveryConfig{}, nil, false, logger)
+	assert.NoError(t, err)
+	assert.Len(t, d.workers, 1)
+	assert.NoError(t, d.close())
+	d, err = newDispatcher(DeliveryConfig{}, nil, true, logger)
+	assert.NoError(t, err)
+	assert.Len(t, d.workers, defaultSenderWorkers)
+	assert.NoError(t, d.close())
+
+	_, err = newDispatcher(DeliveryConfig{Sender: SenderConfig{OrderKey: "id"}}, nil, true, logger)
+	assert.EqualError(t, err, "order key (id) of sender must be topic or the field of payload like payload.id")
+	_, err = newDispatcher(DeliveryConfig{Sender: SenderConfig{Workers: -1}}, nil, true, logger)
+	assert.EqualError(t, err, "workers (-1) of sender must not be negative")
+}
+
+func TestDispatcherBatch(t *testing.T) {
+	logger := log.With(log.Any("client", "test"))
+
+	var mu sync.Mutex
+	var batches []string
+	var wg sync.WaitGroup
+	callback := func(err error) {
+		assert.NoError(t, err)
+		wg.Done()
+	}
+	newBatchDispatcher := func(cfg BatchConfig) *dispatcher {
+		d, err := newDispatcher(DeliveryConfig{Sender: SenderConfig{Workers: 1}, Batch: cfg}, func(msg *config.TargetMsg) error {
+			mu.Lock()
+			batches = append(batches, string(msg.Data))
+			mu.Unlock()
+			return nil
+		}, true, logger)
+		assert.NoError(t, err)
+		d.batching(func(msgs []*config.TargetMsg) error {
+			var data []string
+			for _, msg := range msgs {
+				data = append(data, string(msg.Data))
+			}
+			mu.Lock()
+			batches = append(batches, strings.Join(data, ","))
+			mu.Unlock()
+			return nil
+		}, func(msg *config.TargetMsg) string { return msg.Topic })
+		assert.NoError(t, d.start())
+		return d
+	}
+	push := func(d *dispatcher, topic, data string) {
+		wg.Add(1)
+		assert.NoError(t, d.push(&config.TargetMsg{Topic: topic, Data: []byte(data), Callback: callback}))
+	}
+
+	// the batch is sent once it is full, or the linger time is exceeded
+	d := newBatchDispatcher(BatchConfig{MaxCount: 3, MaxSize: 1024, Linger: 200 * time.Millisecond})
+	for i := 1; i <= 4; i++ {
+		push(d, "a", fmt.Sprint(i))
+	}
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []string{"1,2,3"}, batches)
+	mu.Unlock()
+	wg.Wait()
+	assert.Equal(t, []string{"1,2,3", "4"}, batches)
+
+	// the message to another destination, waiting for its response, or exceeding the max size starts the next batch
+	batches = nil
+	push(d, "a", "1")
+	push(d, "b", "2")
+	push(d, "b", "3")
+	wg.Add(1)
+	assert.NoError(t, d.push(&config.TargetMsg{Topic: "b", Data: []byte("8"), Response: &config.TargetResponse{}, Callback: callback}))
+	wg.Wait()
+	assert.Equal(t, []string{"1", "2,3", "8"}, batches)
+	assert.NoError(t, d.close())
+	batches = nil
+	d = newBatchDispatcher(BatchConfig{MaxCount: 3, MaxSize: 8, Linger: 100 * time.Millisecond})
+	push(d, "a", "1234")
+	push(d, "a", "5678")
+	push(d, "a", "9")
+	wg.Wait()
+	assert.Equal(t, []string{"1234,5678", "9"}, batches)
+	assert.NoError(t, d.close())
+
+	// the batch is retried and completed as a whole
+	var attempts int32
+	d, err := newDispatcher(DeliveryConfig{Sender: SenderConfig{Workers: 1}, Retry: RetryConfig{MaxAttempts: 2}, Batch: BatchConfig{MaxCount: 2, MaxSize: 1024, Linger: time.Second}}, nil, true, logger)
+	assert.NoError(t, err)
+	d.batching(func(msgs []*config.TargetMsg) error {
+		atomic.AddInt32(&attempts, 1)
+		return Permanent(errors.New("rejected"))
+	}, func(*config.TargetMsg) string { return "" })
+	assert.NoError(t, d.start())
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, d.push(&config.TargetMsg{Topic: "a", Callback: func(err error) {
+			assert.EqualError(t, err, "failed to deliver after 1 attempts: rejected")
+			wg.Done()
+		}}))
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+	assert.NoError(t, d.close())
+
+	d, err = newDispatcher(DeliveryConfig{Batch: BatchConfig{MaxCount: 2, MaxSize: 1024, Linger: time.Second}}, nil, false, logger)
+	assert.NoError(t, err)
+	assert.EqualError(t, d.start(), "batch is not supported by the client")
+	assert.NoError(t, d.close())
+	_, err = newDispatcher(DeliveryConfig{Batch: BatchConfig{MaxCount: 2}}, nil, true, logger)
+	assert.EqualError(t, err, "maxSize and linger of batch must be positive")
+}
@@ -3,11 +3,17 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	http2 "net/http"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/256dpi/gomqtt/packet"
 	gcontext "github.com/baetyl/baetyl-go/v2/context"
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/http"
@@ -19,17 +25,36 @@ import (
 )
 
 type HTTPClientCfg struct {
-	Address           string `yaml:"address" json:"address"`
+	Address string `yaml:"address" json:"address"`
+	// Poll the request polled when the client is the source of rules
+	Poll              *HTTPPollCfg `yaml:"poll" json:"poll"`
 	utils.Certificate `yaml:",inline" json:",inline"`
+	DeliveryConfig    `yaml:",inline" json:",inline"`
+}
+
+// HTTPPollCfg the request sent on every interval, whose response body is emitted with the path as topic
+type HTTPPollCfg struct {
+	Path     string            `yaml:"path" json:"path"`
+	Method   string            `yaml:"method" json:"method" default:"GET"`
+	Header   map[string]string `yaml:"header" json:"header"`
+	Body     string            `yaml:"body" json:"body"`
+	Interval time.Duration     `yaml:"interval" json:"interval" default:"1m"`
+	// OnChange emits the response only if its body is changed, the etag of last response is sent
+	// as If-None-Match, and the body is compared by hash
+	OnChange bool `yaml:"onChange" json:"onChange"`
 }
 
 type HTTPClient struct {
-	cli     *http.Client
-	address string
-	tasks   chan *config.TargetMsg
-	cancel  context.CancelFunc
-	ctx     context.Context
-	logger  *log.Logger
+	cli        *http.Client
+	address    string
+	retryCodes map[int]bool
+	poll       *HTTPPollCfg
+	format     string // the format of batch body
+	dispatcher *dispatcher
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+	logger     *log.Logger
 }
 
 func NewHTTPClient(gctx gcontext.Context, cfg *HTTPClientCfg) (Client, error) {
@@ -55,55 +80,223 @@ func NewHTTPClient(gctx gcontext.Context, cfg *HTTPClientCfg) (Client, error) {
 		}
 		options.TLSConfig = tlsCfg
 	}
-	cli := http.NewClient(options)
-	ctx, cancel := context.WithCancel(context.Background())
-	return &HTTPClient{
-		cli:     cli,
-		address: cfg.Address,
-		cancel:  cancel,
-		ctx:     ctx,
-		tasks:   make(chan *config.TargetMsg, config.TaskLength),
-		logger:  log.With(log.Any("client", "http")),
-	}, nil
+	if cfg.Poll != nil && cfg.Poll.Interval <= 0 {
+		return nil, errors.Errorf("interval (%s) of poll must be positive", cfg.Poll.Interval)
+	}
+	if f := cfg.Batch.Format; f != "" && f != batchFormatJSON && f != batchFormatNDJSON {
+		return nil, errors.Errorf("format (%s) of batch must be json or ndjson", cfg.Batch.Format)
+	}
+	h := &HTTPClient{
+		cli:        http.NewClient(options),
+		address:    cfg.Address,
+		retryCodes: map[int]bool{},
+		poll:       cfg.Poll,
+		format:     cfg.Batch.Format,
+		logger:     log.With(log.Any("client", "http")),
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	for _, code := range cfg.Retry.StatusCodes {
+		h.retryCodes[code] = true
+	}
+	var err error
+	h.dispatcher, err = newDispatcher(cfg.DeliveryConfig, h.HTTPSend, true, h.logger)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	h.dispatcher.batching(h.HTTPSendBatch, httpBatchKey)
+	return h, nil
 }
 
 func (h *HTTPClient) SendOrDrop(pkt *config.TargetMsg) error {
-	select {
-	case <-h.ctx.Done():
-		return errors.New("ctx done")
-	case h.tasks <- pkt:
-		return nil
-	}
+	return h.dispatcher.push(pkt)
+}
+
+func (h *HTTPClient) QueueLen() int {
+	return h.dispatcher.queue.Len()
+}
+
+func (h *HTTPClient) InFlight() int {
+	return h.dispatcher.InFlight()
 }
 
 func (h *HTTPClient) SendPubAck(_ mqtt.Packet) error {
 	return nil
 }
 
-func (h *HTTPClient) Start(_ mqtt.Observer) error {
-	go func() {
-		for {
-			select {
-			case <-h.ctx.Done():
-				return
-			case task := <-h.tasks:
-				go h.HTTPSend(task)
+func (h *HTTPClient) Start(obs mqtt.Observer) error {
+	if h.poll != nil && obs != nil {
+		h.done = make(chan struct{})
+		go h.polling(obs)
+	}
+	return h.dispatcher.start()
+}
+
+// polling sends the request of poll at once and on every interval until the client is closed,
+// the body of successful response is emitted to the observer
+func (h *HTTPClient) polling(obs mqtt.Observer) {
+	defer close(h.done)
+	ticker := time.NewTicker(h.poll.Interval)
+	defer ticker.Stop()
+	var etag string
+	var hash [sha256.Size]byte
+	for {
+		body, tag, err := h.pollOnce(etag)
+		if err != nil {
+			h.logger.Error("failed to poll http", log.Any("path", h.poll.Path), log.Error(err))
+			obs.OnError(err)
+		} else if body != nil {
+			sum := sha256.Sum256(body)
+			if !h.poll.OnChange || sum != hash {
+				pkt := packet.NewPublish()
+				pkt.Message.Topic = h.poll.Path
+				pkt.Message.Payload = body
+				if err = obs.OnPublish(pkt); err != nil {
+					h.logger.Error("failed to handle http msg", log.Error(err))
+				}
 			}
+			etag, hash = tag, sum
 		}
-	}()
-	return nil
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
-func (h *HTTPClient) HTTPSend(task *config.TargetMsg) {
-	header := map[string]string{"Content-Type": "application/json"}
-	res, err := h.cli.SendUrl(strings.ToUpper(task.TargetInfo.Method), fmt.Sprintf("%s%s", h.address, task.Topic), bytes.NewReader(task.Data), header)
+// pollOnce sends the request of poll, no body is returned if the response is not modified since the etag,
+// which saves the transfer of body if the server supports etag
+func (h *HTTPClient) pollOnce(etag string) ([]byte, string, error) {
+	header := map[string]string{}
+	for k, v := range h.poll.Header {
+		header[k] = v
+	}
+	if h.poll.OnChange && etag != "" {
+		header["If-None-Match"] = etag
+	}
+	res, err := h.cli.SendUrl(strings.ToUpper(h.poll.Method), fmt.Sprintf("%s%s", h.address, h.poll.Path), strings.NewReader(h.poll.Body), header)
 	if err != nil {
-		h.logger.Error("failed to send http", log.Error(err))
+		return nil, "", errors.Trace(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http2.StatusNotModified {
+		return nil, "", nil
 	}
 	if res.StatusCode < http2.StatusOK || res.StatusCode > http2.StatusAlreadyReported {
-		h.logger.Error("failed to get 200 code", log.Any("status", res.Status))
+		return nil, "", errors.Errorf("failed to get 200 code, status: %s", res.Status)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+	return body, res.Header.Get("ETag"), nil
+}
+
+func (h *HTTPClient) HTTPSend(task *config.TargetMsg) error {
+	err := h.request(task, bytes.NewReader(task.Data), "application/json", task.Response)
+	if err != nil {
+		return err
 	}
 	h.logger.Debug("HTTP Send msg", log.Any("topic", task.Topic))
+	return nil
+}
+
+// HTTPSendBatch sends the messages in one request, whose body is the json array of payloads, or the payloads
+// in lines if the format is ndjson. The payload which is not json is sent as a json string
+func (h *HTTPClient) HTTPSendBatch(tasks []*config.TargetMsg) error {
+	var buf bytes.Buffer
+	contentType := "application/json"
+	if h.format == batchFormatNDJSON {
+		contentType = "application/x-ndjson"
+	} else {
+		buf.WriteByte('[')
+	}
+	for i, task := range tasks {
+		if i > 0 && h.format != batchFormatNDJSON {
+			buf.WriteByte(',')
+		}
+		if err := writeJSON(&buf, task.Data); err != nil {
+			return Permanent(errors.Trace(err))
+		}
+		if h.format == batchFormatNDJSON {
+			buf.WriteByte('\n')
+		}
+	}
+	if h.format != batchFormatNDJSON {
+		buf.WriteByte(']')
+	}
+	// the messages of batch have the same method, path and headers
+	if err := h.request(tasks[0], bytes.NewReader(buf.Bytes()), contentType, nil); err != nil {
+		return err
+	}
+	h.logger.Debug("HTTP Send batch", log.Any("topic", tasks[0].Topic), log.Any("count", len(tasks)))
+	return nil
+}
+
+// request sends the request of message with the body, the response is saved if it is required
+func (h *HTTPClient) request(task *config.TargetMsg, body io.Reader, contentType string, response *config.TargetResponse) error {
+	header := map[string]string{"Content-Type": contentType}
+	for k, v := range metaHeaders(task.Meta) {
+		header[k] = v
+	}
+	res, err := h.cli.SendUrl(strings.ToUpper(task.TargetInfo.Method), fmt.Sprintf("%s%s", h.address, task.Topic), body, header)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer res.Body.Close()
+	if response != nil {
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		*response = config.TargetResponse{
+			StatusCode:  res.StatusCode,
+			ContentType: res.Header.Get("Content-Type"),
+			Header:      make(map[string]string, len(res.Header)),
+			Body:        body,
+		}
+		for k := range res.Header {
+			response.Header[k] = res.Header.Get(k)
+		}
+	}
+	if res.StatusCode < http2.StatusOK || res.StatusCode > http2.StatusAlreadyReported {
+		err = errors.Errorf("failed to get 200 code, status: %s", res.Status)
+		if !h.retryCodes[res.StatusCode] {
+			return Permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// writeJSON writes the payload as compact json, the payload which is not json is written as a json string
+func writeJSON(buf *bytes.Buffer, data []byte) error {
+	if !json.Valid(data) {
+		data, _ = json.Marshal(string(data))
+	}
+	return json.Compact(buf, data)
+}
+
+// httpBatchKey returns the request of message, only the messages with the same method, path and headers
+// are sent in a batch
+func httpBatchKey(task *config.TargetMsg) string {
+	headers := metaHeaders(task.Meta)
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(strings.ToUpper(task.TargetInfo.Method))
+	b.WriteString(" ")
+	b.WriteString(task.Topic)
+	for _, k := range keys {
+		b.WriteString("\n")
+		b.WriteString(k)
+		b.WriteString(": ")
+		b.WriteString(headers[k])
+	}
+	return b.String()
 }
 
 func (h *HTTPClient) ResetClient(_ *mqtt.ClientConfig) {}
@@ -113,5 +306,8 @@ func (h *HTTPClient) SetReconnectCallback(_ mqtt.ReconnectCallback) {}
 // Close closes client
 func (h *HTTPClient) Close() error {
 	h.cancel()
-	return nil
+	if h.done != nil {
+		<-h.done
+	}
+	return h.dispatcher.close()
 }
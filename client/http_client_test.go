@@ -0,0 +1,130 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/baetyl/baetyl-go/v2/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestHTTPClientPoll(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	// the body is changed on the 3rd request, the etag is supported from the 4th request
+	var requests int32
+	go fasthttp.Serve(listener, func(ctx *fasthttp.RequestCtx) {
+		n := atomic.AddInt32(&requests, 1)
+		assert.Equal(t, "PUT", string(ctx.Method()))
+		assert.Equal(t, "/api/weather", string(ctx.Path()))
+		assert.Equal(t, "token", string(ctx.Request.Header.Peek("X-Token")))
+		assert.Equal(t, `{"station":1}`, string(ctx.Request.Body()))
+		switch {
+		case n < 3:
+			ctx.SetBodyString(`{"temp":1}`)
+		case n == 3:
+			ctx.SetBodyString(`{"temp":2}`)
+		case n == 4:
+			ctx.Response.Header.Set("ETag", `"v3"`)
+			ctx.SetBodyString(`{"temp":3}`)
+		default:
+			assert.Equal(t, `"v3"`, string(ctx.Request.Header.Peek("If-None-Match")))
+			ctx.SetStatusCode(fasthttp.StatusNotModified)
+		}
+	})
+
+	var cfg HTTPClientCfg
+	err = utils.UnmarshalYAML([]byte(fmt.Sprintf(`
+address: http://%s
+poll:
+  path: /api/weather
+  method: put
+  header:
+    X-Token: token
+  body: '{"station":1}'
+  interval: 50ms
+  onChange: true
+`, listener.Addr().String())), &cfg)
+	assert.NoError(t, err)
+	cli, err := NewHTTPClient(nil, &cfg)
+	assert.NoError(t, err)
+
+	pkts := make(chan *packet.Publish, 10)
+	obs := mqtt.NewObserverWrapper(func(pkt *packet.Publish) error {
+		pkts <- pkt
+		return nil
+	}, nil, nil)
+	assert.NoError(t, cli.Start(obs))
+	// the responses not changed are not emitted
+	for _, body := range []string{`{"temp":1}`, `{"temp":2}`, `{"temp":3}`} {
+		select {
+		case pkt := <-pkts:
+			assert.Equal(t, "/api/weather", pkt.Message.Topic)
+			assert.Equal(t, body, string(pkt.Message.Payload))
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "receive poll timeout")
+		}
+	}
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&requests) > 6
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, cli.Close())
+	assert.Len(t, pkts, 0)
+}
+
+func TestHTTPClientBatch(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	bodies := make(chan string, 10)
+	go fasthttp.Serve(listener, func(ctx *fasthttp.RequestCtx) {
+		bodies <- fmt.Sprintf("%s %s %s\n%s", ctx.Method(), ctx.Path(), ctx.Request.Header.ContentType(), ctx.Request.Body())
+	})
+
+	for format, expected := range map[string]string{
+		"json":   "POST /api/data application/json\n[{\"id\":1},\"text\"]",
+		"ndjson": "POST /api/data application/x-ndjson\n{\"id\":1}\n\"text\"\n",
+	} {
+		var cfg HTTPClientCfg
+		err = utils.UnmarshalYAML([]byte(fmt.Sprintf(`
+address: http://%s
+sender:
+  workers: 1
+batch:
+  maxCount: 2
+  linger: 1s
+  format: %s
+`, listener.Addr().String(), format)), &cfg)
+		assert.NoError(t, err)
+		cli, err := NewHTTPClient(nil, &cfg)
+		assert.NoError(t, err)
+		assert.NoError(t, cli.Start(nil))
+		for _, data := range []string{"{\n\"id\": 1\n}", "text"} {
+			msg := &config.TargetMsg{Topic: "/api/data", Data: []byte(data)}
+			msg.TargetInfo.Method = "post"
+			assert.NoError(t, cli.SendOrDrop(msg))
+		}
+		select {
+		case body := <-bodies:
+			assert.Equal(t, expected, body)
+		case <-time.After(time.Second):
+			assert.Fail(t, "batch not sent")
+		}
+		assert.NoError(t, cli.Close())
+	}
+
+	var cfg HTTPClientCfg
+	err = utils.UnmarshalYAML([]byte("batch:\n  format: xml"), &cfg)
+	assert.NoError(t, err)
+	_, err = NewHTTPClient(nil, &cfg)
+	assert.EqualError(t, err, "format (xml) of batch must be json or ndjson")
+}
@@ -3,8 +3,11 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/256dpi/gomqtt/packet"
 	gcontext "github.com/baetyl/baetyl-go/v2/context"
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/log"
@@ -18,21 +21,52 @@ import (
 )
 
 type KafkaClientCfg struct {
-	Address           []string `yaml:"address" json:"address"`
-	SASLType          string   `yaml:"saslType" json:"saslType" default:""`
-	Username          string   `yaml:"username" json:"username"`
-	Password          string   `yaml:"password" json:"password"`
+	Address  []string `yaml:"address" json:"address"`
+	SASLType string   `yaml:"saslType" json:"saslType" default:""`
+	Username string   `yaml:"username" json:"username"`
+	Password string   `yaml:"password" json:"password"`
+	// GroupID consumer group of the reader, only used when kafka is the source of rules
+	GroupID string `yaml:"groupId" json:"groupId"`
+	// StartOffset where a new consumer group starts to read, earliest or latest
+	StartOffset       string          `yaml:"startOffset" json:"startOffset" default:"latest"`
+	Subscriptions     []mqtt.QOSTopic `yaml:"subscriptions" json:"subscriptions" default:"[]"`
 	utils.Certificate `yaml:",inline" json:",inline"`
+	DeliveryConfig    `yaml:",inline" json:",inline"`
+}
+
+type kafkaPartition struct {
+	topic     string
+	partition int
+}
+
+// kafkaReader reads the messages of consumer group, which is implemented by kafka.Reader
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type kafkaOffset struct {
+	msg  kafka.Message
+	done bool
 }
 
 type KafkaClient struct {
-	cli     *kafka.Dialer
-	writer  *kafka.Writer
-	address []string
-	tasks   chan *config.TargetMsg
-	ctx     context.Context
-	cancel  context.CancelFunc
-	logger  *log.Logger
+	cli        *kafka.Dialer
+	writer     *kafka.Writer
+	reader     kafkaReader
+	address    []string
+	qos        map[string]mqtt.QOS // key: kafka topic
+	ids        *mqtt.Counter
+	pending    map[mqtt.ID]*kafkaOffset
+	offsets    map[kafkaPartition][]*kafkaOffset // fetched offsets not committed yet, in order
+	committed  map[kafkaPartition]int64
+	mu         sync.Mutex
+	commitMu   sync.Mutex
+	dispatcher *dispatcher
+	ctx        context.Context
+	cancel     context.CancelFunc
+	logger     *log.Logger
 }
 
 func NewKafkaClient(_ gcontext.Context, cfg *KafkaClientCfg) (Client, error) {
@@ -78,52 +112,222 @@ func NewKafkaClient(_ gcontext.Context, cfg *KafkaClientCfg) (Client, error) {
 		Balancer: &kafka.Hash{},
 	})
 	ctxCancel, cancel := context.WithCancel(context.Background())
-	return &KafkaClient{
-		cli:     cli,
-		writer:  w,
-		address: cfg.Address,
-		tasks:   make(chan *config.TargetMsg, config.TaskLength),
-		ctx:     ctxCancel,
-		cancel:  cancel,
-		logger:  log.With(log.Any("client", "http")),
-	}, nil
+	k := &KafkaClient{
+		cli:       cli,
+		writer:    w,
+		address:   cfg.Address,
+		qos:       map[string]mqtt.QOS{},
+		ids:       mqtt.NewCounter(),
+		pending:   map[mqtt.ID]*kafkaOffset{},
+		offsets:   map[kafkaPartition][]*kafkaOffset{},
+		committed: map[kafkaPartition]int64{},
+		ctx:       ctxCancel,
+		cancel:    cancel,
+		logger:    log.With(log.Any("client", "kafka")),
+	}
+	if len(cfg.Subscriptions) != 0 {
+		k.reader, err = k.newReader(cfg)
+		if err != nil {
+			cancel()
+			return nil, errors.Trace(err)
+		}
+	}
+	k.dispatcher, err = newDispatcher(cfg.DeliveryConfig, k.KafkaSend, true, k.logger)
+	if err != nil {
+		k.Close()
+		return nil, errors.Trace(err)
+	}
+	// the messages of batch may be written to different topics
+	k.dispatcher.batching(k.KafkaSendBatch, func(*config.TargetMsg) string { return "" })
+	return k, nil
+}
+
+func (k *KafkaClient) newReader(cfg *KafkaClientCfg) (kafkaReader, error) {
+	if cfg.GroupID == "" {
+		return nil, errors.New("groupId is required when kafka is used as source")
+	}
+	var topics []string
+	for _, sub := range cfg.Subscriptions {
+		if _, ok := k.qos[sub.Topic]; !ok {
+			topics = append(topics, sub.Topic)
+			k.qos[sub.Topic] = 0
+		}
+		if q := mqtt.QOS(sub.QOS); q > k.qos[sub.Topic] {
+			k.qos[sub.Topic] = q
+		}
+	}
+	startOffset := kafka.LastOffset
+	switch cfg.StartOffset {
+	case "earliest":
+		startOffset = kafka.FirstOffset
+	case "latest":
+	default:
+		return nil, errors.Errorf("kafka start offset (%s) is not supported", cfg.StartOffset)
+	}
+	return kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     cfg.Address,
+		GroupID:     cfg.GroupID,
+		GroupTopics: topics,
+		Dialer:      k.cli,
+		StartOffset: startOffset,
+	}), nil
 }
 
 func (k *KafkaClient) SendOrDrop(pkt *config.TargetMsg) error {
-	select {
-	case <-k.ctx.Done():
-		return errors.New("ctx done")
-	case k.tasks <- pkt:
+	return k.dispatcher.push(pkt)
+}
+
+func (k *KafkaClient) QueueLen() int {
+	return k.dispatcher.queue.Len()
+}
+
+func (k *KafkaClient) InFlight() int {
+	return k.dispatcher.InFlight()
+}
+
+// SendPubAck commits the kafka message which has been delivered by the rule
+func (k *KafkaClient) SendPubAck(pkt mqtt.Packet) error {
+	ack, ok := pkt.(*packet.Puback)
+	if !ok {
 		return nil
 	}
+	off := k.release(ack.ID)
+	if off == nil {
+		return nil
+	}
+	return errors.Trace(k.commit(off))
+}
+
+// SendNack skips the kafka message failed to be delivered by the rule, it is committed like the acknowledged one,
+// since the offset of consumer group can not move back, and the following messages of partition must not be blocked
+func (k *KafkaClient) SendNack(id mqtt.ID) error {
+	off := k.release(id)
+	if off == nil {
+		return nil
+	}
+	k.logger.Warn("kafka msg is not delivered by the rule, skip it", log.Any("topic", off.msg.Topic), log.Any("partition", off.msg.Partition), log.Any("offset", off.msg.Offset))
+	return errors.Trace(k.commit(off))
+}
+
+// release removes the offset of message waiting for the ack of rule
+func (k *KafkaClient) release(id mqtt.ID) *kafkaOffset {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	off := k.pending[id]
+	delete(k.pending, id)
+	return off
 }
 
-func (k *KafkaClient) SendPubAck(_ mqtt.Packet) error {
+// commit marks the offset as handled and commits the last one of the handled offsets in a row,
+// since acks may arrive out of order and committing an offset implies all previous ones are handled
+func (k *KafkaClient) commit(off *kafkaOffset) error {
+	p := kafkaPartition{topic: off.msg.Topic, partition: off.msg.Partition}
+	k.mu.Lock()
+	off.done = true
+	var last *kafkaOffset
+	offs := k.offsets[p]
+	for len(offs) > 0 && offs[0].done {
+		last = offs[0]
+		offs = offs[1:]
+	}
+	k.offsets[p] = offs
+	k.mu.Unlock()
+	if last == nil {
+		return nil
+	}
+
+	k.commitMu.Lock()
+	defer k.commitMu.Unlock()
+	if committed, ok := k.committed[p]; ok && committed >= last.msg.Offset {
+		return nil
+	}
+	err := k.reader.CommitMessages(k.ctx, last.msg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	k.committed[p] = last.msg.Offset
 	return nil
 }
 
-func (k *KafkaClient) Start(_ mqtt.Observer) error {
-	go func() {
-		for {
-			select {
-			case <-k.ctx.Done():
+func (k *KafkaClient) Start(obs mqtt.Observer) error {
+	if k.reader != nil && obs != nil {
+		go k.consuming(obs)
+	}
+	return k.dispatcher.start()
+}
+
+// consuming reads messages of the consumer group and hands them to the observer,
+// a message with qos 1 is committed only after the rule has acknowledged it, and
+// the offset of a partition never moves past a message not acknowledged yet
+func (k *KafkaClient) consuming(obs mqtt.Observer) {
+	for {
+		msg, err := k.reader.FetchMessage(k.ctx)
+		if err != nil {
+			if k.ctx.Err() != nil {
 				return
-			case task := <-k.tasks:
-				go k.KafkaSend(task)
 			}
+			k.logger.Error("failed to fetch kafka msg", log.Error(err))
+			obs.OnError(err)
+			continue
 		}
-	}()
-	return nil
+		pkt := packet.NewPublish()
+		pkt.Message.Topic = msg.Topic
+		pkt.Message.Payload = msg.Value
+		pkt.Message.QOS = k.qos[msg.Topic]
+		// only the position is kept for committing
+		off := &kafkaOffset{msg: kafka.Message{Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset}}
+		p := kafkaPartition{topic: msg.Topic, partition: msg.Partition}
+		k.mu.Lock()
+		k.offsets[p] = append(k.offsets[p], off)
+		if pkt.Message.QOS > 0 {
+			pkt.ID = k.ids.NextID()
+			k.pending[pkt.ID] = off
+		}
+		k.mu.Unlock()
+		err = obs.OnPublish(pkt)
+		if err != nil {
+			k.logger.Error("failed to handle kafka msg", log.Error(err))
+		}
+		if pkt.Message.QOS == 0 {
+			err = k.commit(off)
+			if err != nil && k.ctx.Err() == nil {
+				k.logger.Error("failed to commit kafka msg", log.Error(err))
+			}
+		}
+	}
+}
+
+func (k *KafkaClient) KafkaSend(task *config.TargetMsg) error {
+	err := k.writer.WriteMessages(k.ctx, kafkaMessage(task))
+	return errors.Trace(err)
+}
+
+// KafkaSendBatch writes the messages in one call, which are written to kafka in as few requests as possible
+func (k *KafkaClient) KafkaSendBatch(tasks []*config.TargetMsg) error {
+	msgs := make([]kafka.Message, len(tasks))
+	for i, task := range tasks {
+		msgs[i] = kafkaMessage(task)
+	}
+	err := k.writer.WriteMessages(k.ctx, msgs...)
+	return errors.Trace(err)
 }
 
-func (k *KafkaClient) KafkaSend(task *config.TargetMsg) {
-	err := k.writer.WriteMessages(k.ctx, kafka.Message{
-		Topic: task.TargetInfo.Topic,
+// kafkaMessage returns the kafka message of task, whose topic is the one rendered by the placeholders of target
+func kafkaMessage(task *config.TargetMsg) kafka.Message {
+	msg := kafka.Message{
+		Topic: task.Topic,
 		Value: task.Data,
-	})
-	if err != nil {
-		k.logger.Error("failed to write kafka msg", log.Error(err))
 	}
+	headers := metaHeaders(task.Meta)
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: k, Value: []byte(headers[k])})
+	}
+	return msg
 }
 
 func (k *KafkaClient) ResetClient(_ *mqtt.ClientConfig) {}
@@ -133,5 +337,15 @@ func (k *KafkaClient) SetReconnectCallback(_ mqtt.ReconnectCallback) {}
 // Close closes client
 func (k *KafkaClient) Close() error {
 	k.cancel()
+	if k.dispatcher != nil {
+		if err := k.dispatcher.close(); err != nil {
+			k.logger.Error("failed to close kafka dispatcher", log.Error(err))
+		}
+	}
+	if k.reader != nil {
+		if err := k.reader.Close(); err != nil {
+			k.logger.Error("failed to close kafka reader", log.Error(err))
+		}
+	}
 	return k.writer.Close()
 }
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+type mockKafkaReader struct {
+	msgs      chan kafka.Message
+	mu        sync.Mutex
+	committed []int64
+}
+
+func (r *mockKafkaReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	case msg := <-r.msgs:
+		return msg, nil
+	}
+}
+
+func (r *mockKafkaReader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, msg := range msgs {
+		r.committed = append(r.committed, msg.Offset)
+	}
+	return nil
+}
+
+func (r *mockKafkaReader) Close() error {
+	return nil
+}
+
+func (r *mockKafkaReader) assertCommitted(t *testing.T, expected ...int64) {
+	time.Sleep(50 * time.Millisecond)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	assert.Equal(t, expected, r.committed)
+}
+
+func TestKafkaClientCommit(t *testing.T) {
+	reader := &mockKafkaReader{msgs: make(chan kafka.Message, 10)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	k := &KafkaClient{
+		reader:    reader,
+		qos:       map[string]mqtt.QOS{"qos0": 0, "qos1": 1},
+		ids:       mqtt.NewCounter(),
+		pending:   map[mqtt.ID]*kafkaOffset{},
+		offsets:   map[kafkaPartition][]*kafkaOffset{},
+		committed: map[kafkaPartition]int64{},
+		ctx:       ctx,
+		cancel:    cancel,
+		logger:    log.With(log.Any("client", "kafka")),
+	}
+	pkts := make(chan *packet.Publish, 10)
+	go k.consuming(mqtt.NewObserverWrapper(func(pkt *packet.Publish) error {
+		pkts <- pkt
+		return nil
+	}, nil, nil))
+	receive := func() *packet.Publish {
+		select {
+		case pkt := <-pkts:
+			return pkt
+		case <-time.After(time.Second):
+			assert.Fail(t, "receive kafka msg timeout")
+			return nil
+		}
+	}
+
+	// the message with qos 0 is committed once it is handled
+	reader.msgs <- kafka.Message{Topic: "qos0", Offset: 0, Value: []byte("a")}
+	pkt := receive()
+	assert.Equal(t, "a", string(pkt.Message.Payload))
+	assert.Equal(t, mqtt.QOS(0), pkt.Message.QOS)
+	reader.assertCommitted(t, 0)
+
+	// the offset is committed only if all previous messages of partition are acknowledged
+	for i := int64(0); i < 4; i++ {
+		reader.msgs <- kafka.Message{Topic: "qos1", Partition: 1, Offset: i}
+	}
+	var ids []mqtt.ID
+	for i := 0; i < 4; i++ {
+		pkt = receive()
+		assert.Equal(t, mqtt.QOS(1), pkt.Message.QOS)
+		ids = append(ids, pkt.ID)
+	}
+	puback := func(id mqtt.ID) *packet.Puback {
+		ack := packet.NewPuback()
+		ack.ID = id
+		return ack
+	}
+	assert.NoError(t, k.SendPubAck(puback(ids[1])))
+	reader.assertCommitted(t, 0)
+	assert.NoError(t, k.SendPubAck(puback(ids[0])))
+	reader.assertCommitted(t, 0, 1)
+
+	// the message failed to be delivered is skipped, so the following ones are committed
+	assert.NoError(t, k.SendPubAck(puback(ids[3])))
+	reader.assertCommitted(t, 0, 1)
+	assert.NoError(t, k.SendNack(ids[2]))
+	reader.assertCommitted(t, 0, 1, 3)
+	// the ack of message released is ignored
+	assert.NoError(t, k.SendPubAck(puback(ids[2])))
+	reader.assertCommitted(t, 0, 1, 3)
+
+	// the partitions are committed independently
+	reader.msgs <- kafka.Message{Topic: "qos1", Partition: 1, Offset: 4}
+	reader.msgs <- kafka.Message{Topic: "qos1", Partition: 2, Offset: 0}
+	first, second := receive(), receive()
+	reader.assertCommitted(t, 0, 1, 3)
+	assert.NoError(t, k.SendPubAck(puback(second.ID)))
+	reader.assertCommitted(t, 0, 1, 3, 0)
+	assert.NoError(t, k.SendPubAck(puback(first.ID)))
+	reader.assertCommitted(t, 0, 1, 3, 0, 4)
+
+	k.mu.Lock()
+	assert.Empty(t, k.pending)
+	assert.Empty(t, k.offsets[kafkaPartition{topic: "qos1", partition: 1}])
+	assert.Empty(t, k.offsets[kafkaPartition{topic: "qos1", partition: 2}])
+	k.mu.Unlock()
+}
+
+func TestKafkaClientReader(t *testing.T) {
+	k := &KafkaClient{cli: &kafka.Dialer{}, qos: map[string]mqtt.QOS{}}
+	cfg := &KafkaClientCfg{
+		Address:       []string{"127.0.0.1:9092"},
+		StartOffset:   "latest",
+		Subscriptions: []mqtt.QOSTopic{{Topic: "t1", QOS: 0}, {Topic: "t2", QOS: 1}, {Topic: "t1", QOS: 1}},
+	}
+
+	// the consumer group is required
+	_, err := k.newReader(cfg)
+	assert.EqualError(t, err, "groupId is required when kafka is used as source")
+
+	// the start offset is checked
+	cfg.GroupID = "group"
+	cfg.StartOffset = "middle"
+	_, err = k.newReader(cfg)
+	assert.EqualError(t, err, "kafka start offset (middle) is not supported")
+
+	// the topics subscribed more than once are read once with the max qos
+	cfg.StartOffset = "earliest"
+	k.qos = map[string]mqtt.QOS{}
+	reader, err := k.newReader(cfg)
+	assert.NoError(t, err)
+	defer reader.Close()
+	assert.Equal(t, map[string]mqtt.QOS{"t1": 1, "t2": 1}, k.qos)
+	rc := reader.(*kafka.Reader).Config()
+	assert.Equal(t, "group", rc.GroupID)
+	assert.Equal(t, []string{"t1", "t2"}, rc.GroupTopics)
+	assert.Equal(t, kafka.FirstOffset, rc.StartOffset)
+}
+
+func TestKafkaMessage(t *testing.T) {
+	// the topic rendered from the template of target is written, with the headers in order
+	msg := kafkaMessage(&config.TargetMsg{
+		TargetInfo: config.ClientRef{Client: "kafka", MQTTRef: config.MQTTRef{Topic: "site-{1}-{rule}"}},
+		Topic:      "site-s1-rule1",
+		Data:       []byte("data"),
+		Meta:       map[string]any{config.MetaHeaders: map[string]string{"b": "2", "a": "1"}},
+	})
+	assert.Equal(t, "site-s1-rule1", msg.Topic)
+	assert.Equal(t, "data", string(msg.Value))
+	assert.Equal(t, []kafka.Header{{Key: "a", Value: []byte("1")}, {Key: "b", Value: []byte("2")}}, msg.Headers)
+}
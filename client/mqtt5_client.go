@@ -0,0 +1,552 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/baetyl/baetyl-go/v2/utils"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/jpillora/backoff"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+var ErrNotConnected = errors.New("client is not connected")
+
+// MetaObserver is implemented by the observers which receive the meta of messages along with the packets,
+// e.g. the mqtt 5 properties, which can not be carried by the packets of mqtt 3.1.1
+type MetaObserver interface {
+	OnPublishWithMeta(pkt *packet.Publish, meta map[string]any) error
+}
+
+type Mqtt5ClientCfg struct {
+	mqtt.ClientConfig `yaml:",inline" json:",inline"`
+	// AckTimeout the max time to wait for the rule to acknowledge a message with qos 1, then the connection
+	// is re-established, so that the unacknowledged messages are redelivered by the broker if the session is kept
+	AckTimeout time.Duration `yaml:"ackTimeout" json:"ackTimeout" default:"1m"`
+	// SessionExpiry the time the broker keeps the session after the connection is lost, the session ends
+	// once the connection is lost if it is 0, then the unacknowledged messages are not redelivered
+	SessionExpiry time.Duration `yaml:"sessionExpiry" json:"sessionExpiry" default:"1h"`
+}
+
+// mqtt5Received the message with qos 1 received from broker, which waits for the ack of rule
+type mqtt5Received struct {
+	cli  *paho.Client
+	pub  *paho.Publish
+	time time.Time
+}
+
+type Mqtt5Client struct {
+	cfg      *Mqtt5ClientCfg
+	tls      *tls.Config
+	cli      *paho.Client
+	ready    chan struct{} // closed once connected
+	ids      *mqtt.Counter
+	received map[mqtt.ID]*mqtt5Received
+	sending  chan struct{}     // limits the messages with qos 1 waiting for puback
+	nacks    chan *paho.Client // the connections whose received message is nacked
+	mu       sync.Mutex
+	subMu    sync.Mutex // orders the subscriptions changed by rules with the ones of connecting
+	ctx      context.Context
+	cancel   context.CancelFunc
+	started  bool
+	done     chan struct{}
+	logger   *log.Logger
+}
+
+func NewMqtt5Client(cfg *Mqtt5ClientCfg) (Client, error) {
+	uri, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch uri.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts":
+	default:
+		return nil, errors.Errorf("scheme (%s) of mqtt5 address is not supported", uri.Scheme)
+	}
+	if cfg.SessionExpiry < 0 || cfg.SessionExpiry.Seconds() > math.MaxUint32 {
+		return nil, errors.Errorf("session expiry (%s) of mqtt5 is out of range", cfg.SessionExpiry)
+	}
+	var tlsConfig *tls.Config
+	if cfg.Certificate.CA != "" || cfg.Certificate.Key != "" || cfg.Certificate.Cert != "" {
+		tlsConfig, err = utils.NewTLSConfigClient(cfg.Certificate)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	maxSending := cfg.MaxCacheMessages
+	if maxSending <= 0 {
+		maxSending = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Mqtt5Client{
+		cfg:      cfg,
+		tls:      tlsConfig,
+		ready:    make(chan struct{}),
+		ids:      mqtt.NewCounter(),
+		received: map[mqtt.ID]*mqtt5Received{},
+		sending:  make(chan struct{}, maxSending),
+		nacks:    make(chan *paho.Client, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		logger:   log.With(log.Any("client", "mqtt5")),
+	}, nil
+}
+
+// SendOrDrop publishes the message with its mqtt 5 properties in meta, the qos follows the rules of mqtt client.
+// A message with qos 0 is dropped if the client is not connected, while a message with qos 1 waits for the
+// connection, and is completed when the puback of target broker is received
+func (m *Mqtt5Client) SendOrDrop(pkt *config.TargetMsg) error {
+	pub := &paho.Publish{
+		Topic:      pkt.Topic,
+		Payload:    pkt.Data,
+		QoS:        byte(pkt.TargetInfo.QOS),
+		Properties: metaToProperties(pkt.Meta),
+	}
+	if _, ok := pkt.Meta["ID"]; ok {
+		pub.Retain = pkt.Meta["Retain"].(bool)
+		if qos := byte(pkt.Meta["QoS"].(mqtt.QOS)); qos < pub.QoS {
+			pub.QoS = qos
+		}
+	}
+	if pub.QoS == 0 {
+		cli, _ := m.client()
+		if cli == nil {
+			return errors.Trace(ErrNotConnected)
+		}
+		_, err := cli.Publish(m.ctx, pub)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		pkt.Complete(nil)
+		return nil
+	}
+	pub.QoS = 1
+	select {
+	case m.sending <- struct{}{}:
+	case <-m.ctx.Done():
+		return errors.Trace(ErrNotConnected)
+	}
+	go func() {
+		defer func() { <-m.sending }()
+		pkt.Complete(m.publish(pub))
+	}()
+	return nil
+}
+
+func (m *Mqtt5Client) publish(pub *paho.Publish) error {
+	cli, err := m.waitClient()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ctx, cancel := context.WithTimeout(m.ctx, m.cfg.Timeout)
+	defer cancel()
+	res, err := cli.Publish(ctx, pub)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if res != nil && res.ReasonCode >= 0x80 {
+		return errors.Errorf("message is rejected by mqtt5 broker with reason code (%d)", res.ReasonCode)
+	}
+	return nil
+}
+
+// SendPubAck acknowledges the message received from the connection, it is ignored if the connection is lost
+func (m *Mqtt5Client) SendPubAck(pkt mqtt.Packet) error {
+	ack, ok := pkt.(*packet.Puback)
+	if !ok {
+		return errors.Errorf("packet (%v) is not puback", pkt)
+	}
+	m.mu.Lock()
+	r, ok := m.received[ack.ID]
+	delete(m.received, ack.ID)
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return errors.Trace(r.cli.Ack(r.pub))
+}
+
+// SendNack drops the connection the message is received from, since the messages are acknowledged in order
+// and the message never acknowledged holds back the pubacks of the later ones. The broker redelivers
+// the messages not acknowledged once reconnected if the session is kept
+func (m *Mqtt5Client) SendNack(id mqtt.ID) error {
+	m.mu.Lock()
+	r, ok := m.received[id]
+	delete(m.received, id)
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	select {
+	case m.nacks <- r.cli:
+	default:
+	}
+	return nil
+}
+
+// Start connects to the broker and reconnects once the connection is lost, until the client is closed
+func (m *Mqtt5Client) Start(obs mqtt.Observer) error {
+	m.mu.Lock()
+	m.started = true
+	m.mu.Unlock()
+	go m.connecting(obs)
+	return nil
+}
+
+func (m *Mqtt5Client) connecting(obs mqtt.Observer) {
+	defer close(m.done)
+	b := &backoff.Backoff{
+		Min:    time.Second,
+		Max:    m.cfg.MaxReconnectInterval,
+		Factor: 2,
+	}
+	for {
+		errs := make(chan error, 1)
+		m.subMu.Lock()
+		cli, err := m.connect(obs, errs)
+		if err == nil {
+			m.setClient(cli)
+		}
+		m.subMu.Unlock()
+		if err != nil {
+			m.logger.Error("failed to connect to mqtt5 broker", log.Any("address", m.cfg.Address), log.Error(err))
+			select {
+			case <-time.After(b.Duration()):
+				continue
+			case <-m.ctx.Done():
+				return
+			}
+		}
+		b.Reset()
+		err = m.serving(cli, errs)
+		m.setClient(nil)
+		if err == nil {
+			return
+		}
+		m.logger.Warn("connection of mqtt5 broker is lost, reconnect later", log.Error(err))
+		if obs != nil {
+			obs.OnError(err)
+		}
+	}
+}
+
+func (m *Mqtt5Client) connect(obs mqtt.Observer, errs chan error) (*paho.Client, error) {
+	conn, err := m.dial()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	onError := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	var cli *paho.Client
+	cli = paho.NewClient(paho.ClientConfig{
+		ClientID: m.cfg.ClientID,
+		Conn:     packets.NewThreadSafeConn(conn),
+		Router: paho.NewSingleHandlerRouter(func(pub *paho.Publish) {
+			m.onPublish(cli, pub, obs)
+		}),
+		PacketTimeout:              m.cfg.Timeout,
+		EnableManualAcknowledgment: m.cfg.DisableAutoAck,
+		OnClientError:              onError,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			onError(errors.Errorf("disconnected by mqtt5 broker with reason code (%d)", d.ReasonCode))
+		},
+	})
+	ctx, cancel := context.WithTimeout(m.ctx, m.cfg.Timeout)
+	defer cancel()
+	// the session is kept after the connection is lost only if the expiry is set
+	expiry := uint32(m.cfg.SessionExpiry.Seconds())
+	_, err = cli.Connect(ctx, &paho.Connect{
+		ClientID:     m.cfg.ClientID,
+		KeepAlive:    uint16(m.cfg.KeepAlive.Seconds()),
+		CleanStart:   m.cfg.CleanSession,
+		Username:     m.cfg.Username,
+		UsernameFlag: m.cfg.Username != "",
+		Password:     []byte(m.cfg.Password),
+		PasswordFlag: m.cfg.Password != "",
+		Properties:   &paho.ConnectProperties{SessionExpiryInterval: &expiry},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	err = subscribe(ctx, cli, m.cfg.Subscriptions)
+	if err != nil {
+		cli.Disconnect(&paho.Disconnect{})
+		return nil, errors.Trace(err)
+	}
+	return cli, nil
+}
+
+func subscribe(ctx context.Context, cli *paho.Client, subs []mqtt.QOSTopic) error {
+	if len(subs) == 0 {
+		return nil
+	}
+	sub := &paho.Subscribe{Subscriptions: map[string]paho.SubscribeOptions{}}
+	for _, s := range subs {
+		sub.Subscriptions[s.Topic] = paho.SubscribeOptions{QoS: byte(s.QOS)}
+	}
+	res, err := cli.Subscribe(ctx, sub)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, code := range res.Reasons {
+		if code >= 0x80 {
+			return errors.Errorf("subscription is rejected by mqtt5 broker with reason code (%d)", code)
+		}
+	}
+	return nil
+}
+
+// Subscribe subscribes the topics on the current connection, the topics are also subscribed once reconnected
+func (m *Mqtt5Client) Subscribe(subs []mqtt.QOSTopic) error {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	m.cfg.Subscriptions = mergeSubscriptions(m.cfg.Subscriptions, subs)
+	cli, _ := m.client()
+	if cli == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(m.ctx, m.cfg.Timeout)
+	defer cancel()
+	return errors.Trace(subscribe(ctx, cli, subs))
+}
+
+// Unsubscribe unsubscribes the topics on the current connection, the topics are not subscribed once reconnected
+func (m *Mqtt5Client) Unsubscribe(topics []string) error {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+	m.cfg.Subscriptions = removeSubscriptions(m.cfg.Subscriptions, topics)
+	cli, _ := m.client()
+	if cli == nil || len(topics) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(m.ctx, m.cfg.Timeout)
+	defer cancel()
+	res, err := cli.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, code := range res.Reasons {
+		if code >= 0x80 {
+			return errors.Errorf("unsubscription is rejected by mqtt5 broker with reason code (%d)", code)
+		}
+	}
+	return nil
+}
+
+func (m *Mqtt5Client) dial() (net.Conn, error) {
+	uri, err := url.Parse(m.cfg.Address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dialer := &net.Dialer{Timeout: m.cfg.Timeout}
+	switch uri.Scheme {
+	case "ssl", "tls", "mqtts":
+		return tls.DialWithDialer(dialer, "tcp", uri.Host, m.tls)
+	default:
+		return dialer.Dial("tcp", uri.Host)
+	}
+}
+
+// serving waits until the connection is lost, or the client is closed, in which case nil is returned.
+// The connection is dropped if a received message is nacked, or not acknowledged in time
+func (m *Mqtt5Client) serving(cli *paho.Client, errs chan error) error {
+	defer m.dropReceived(cli)
+	var check <-chan time.Time
+	if m.cfg.DisableAutoAck && m.cfg.AckTimeout > 0 {
+		ticker := time.NewTicker(m.cfg.AckTimeout / 2)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case <-m.ctx.Done():
+			cli.Disconnect(&paho.Disconnect{})
+			return nil
+		case c := <-m.nacks:
+			// the nack of a lost connection is ignored
+			if c == cli {
+				cli.Disconnect(&paho.Disconnect{})
+				return errors.New("message is nacked, reconnect to receive the messages not acknowledged")
+			}
+		case <-check:
+			if id, ok := m.expired(cli); ok {
+				cli.Disconnect(&paho.Disconnect{})
+				return errors.Errorf("message (%d) is not acknowledged in %s", id, m.cfg.AckTimeout)
+			}
+		}
+	}
+}
+
+func (m *Mqtt5Client) onPublish(cli *paho.Client, pub *paho.Publish, obs mqtt.Observer) {
+	if obs == nil {
+		return
+	}
+	pkt := mqtt.NewPublish()
+	pkt.Message = packet.Message{
+		Topic:   pub.Topic,
+		Payload: pub.Payload,
+		QOS:     mqtt.QOS(pub.QoS),
+		Retain:  pub.Retain,
+	}
+	if pub.QoS > 0 {
+		// the packet id of broker is not used, since it may be reused by the broker after reconnecting
+		pkt.Message.QOS = 1
+		pkt.ID = m.ids.NextID()
+		if m.cfg.DisableAutoAck {
+			m.mu.Lock()
+			m.received[pkt.ID] = &mqtt5Received{cli: cli, pub: pub, time: time.Now()}
+			m.mu.Unlock()
+		}
+	}
+	var err error
+	if o, ok := obs.(MetaObserver); ok {
+		err = o.OnPublishWithMeta(pkt, propertiesToMeta(pub.Properties))
+	} else {
+		err = obs.OnPublish(pkt)
+	}
+	if err != nil {
+		m.logger.Warn("failed to handle publish packet in user code", log.Error(err))
+	}
+}
+
+// expired returns the id of a message received from the connection, which is not acknowledged in time
+func (m *Mqtt5Client) expired(cli *paho.Client) (mqtt.ID, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, r := range m.received {
+		if r.cli == cli && time.Since(r.time) > m.cfg.AckTimeout {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// dropReceived drops the messages received from the lost connection, which are redelivered by the broker
+func (m *Mqtt5Client) dropReceived(cli *paho.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, r := range m.received {
+		if r.cli == cli {
+			delete(m.received, id)
+		}
+	}
+}
+
+func (m *Mqtt5Client) client() (*paho.Client, chan struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cli, m.ready
+}
+
+func (m *Mqtt5Client) waitClient() (*paho.Client, error) {
+	for {
+		cli, ready := m.client()
+		if cli != nil {
+			return cli, nil
+		}
+		select {
+		case <-ready:
+		case <-m.ctx.Done():
+			return nil, errors.Trace(ErrNotConnected)
+		}
+	}
+}
+
+func (m *Mqtt5Client) setClient(cli *paho.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cli = cli
+	if cli != nil {
+		close(m.ready)
+	} else {
+		m.ready = make(chan struct{})
+	}
+}
+
+func (m *Mqtt5Client) ResetClient(_ *mqtt.ClientConfig) {}
+
+func (m *Mqtt5Client) SetReconnectCallback(_ mqtt.ReconnectCallback) {}
+
+func (m *Mqtt5Client) Close() error {
+	m.cancel()
+	m.mu.Lock()
+	started := m.started
+	m.mu.Unlock()
+	if started {
+		<-m.done
+	}
+	return nil
+}
+
+// propertiesToMeta returns the meta of the mqtt 5 properties, the user properties are kept in order
+func propertiesToMeta(props *paho.PublishProperties) map[string]any {
+	meta := map[string]any{}
+	if props == nil {
+		return meta
+	}
+	if props.ContentType != "" {
+		meta[config.MetaContentType] = props.ContentType
+	}
+	if props.MessageExpiry != nil {
+		meta[config.MetaMessageExpiry] = *props.MessageExpiry
+	}
+	if props.ResponseTopic != "" {
+		meta[config.MetaResponseTopic] = props.ResponseTopic
+	}
+	if props.CorrelationData != nil {
+		meta[config.MetaCorrelationData] = props.CorrelationData
+	}
+	if len(props.User) != 0 {
+		users := make([]config.UserProperty, len(props.User))
+		for i, u := range props.User {
+			users[i] = config.UserProperty{Key: u.Key, Value: u.Value}
+		}
+		meta[config.MetaUserProperties] = users
+	}
+	return meta
+}
+
+// metaToProperties returns the mqtt 5 properties in meta
+func metaToProperties(meta map[string]any) *paho.PublishProperties {
+	props := &paho.PublishProperties{}
+	if v, ok := meta[config.MetaContentType].(string); ok {
+		props.ContentType = v
+	}
+	if v, ok := meta[config.MetaMessageExpiry].(uint32); ok {
+		props.MessageExpiry = &v
+	}
+	if v, ok := meta[config.MetaResponseTopic].(string); ok {
+		props.ResponseTopic = v
+	}
+	if v, ok := meta[config.MetaCorrelationData].([]byte); ok {
+		props.CorrelationData = v
+	}
+	users := config.UserProperties(meta)
+	if headers := metaHeaders(meta); len(headers) != 0 {
+		// the headers set by the envelope of function replace the user properties with the same keys
+		users = config.MergeUserProperties(users, headers)
+	}
+	for _, u := range users {
+		props.User.Add(u.Key, u.Value)
+	}
+	return props
+}
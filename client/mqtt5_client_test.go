@@ -0,0 +1,287 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/baetyl/baetyl-go/v2/utils"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+// mockMqtt5Broker serves a connection of mqtt 5, the packets received are recorded
+type mockMqtt5Broker struct {
+	listener net.Listener
+	conns    chan net.Conn
+	received chan *packets.ControlPacket
+}
+
+func newMockMqtt5Broker(t *testing.T) *mockMqtt5Broker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	b := &mockMqtt5Broker{
+		listener: listener,
+		conns:    make(chan net.Conn, 1),
+		received: make(chan *packets.ControlPacket, 10),
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.conns <- conn
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *mockMqtt5Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.Content.(type) {
+		case *packets.Connect:
+			_, err = (&packets.Connack{Properties: &packets.Properties{}}).WriteTo(conn)
+		case *packets.Subscribe:
+			_, err = (&packets.Suback{PacketID: p.PacketID, Reasons: []byte{1}, Properties: &packets.Properties{}}).WriteTo(conn)
+		case *packets.Unsubscribe:
+			_, err = (&packets.Unsuback{PacketID: p.PacketID, Reasons: []byte{0}, Properties: &packets.Properties{}}).WriteTo(conn)
+		case *packets.Publish:
+			if p.QoS == 1 {
+				_, err = (&packets.Puback{PacketID: p.PacketID, Properties: &packets.Properties{}}).WriteTo(conn)
+			}
+		case *packets.Pingreq:
+			_, err = (&packets.Pingresp{}).WriteTo(conn)
+		case *packets.Disconnect:
+			return
+		}
+		if err != nil {
+			return
+		}
+		b.received <- cp
+	}
+}
+
+func (b *mockMqtt5Broker) receive(t *testing.T, typ byte) *packets.ControlPacket {
+	for {
+		select {
+		case cp := <-b.received:
+			if cp.Type == typ {
+				return cp
+			}
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "receive packet timeout")
+		}
+	}
+}
+
+type mockMetaObserver struct {
+	mqtt.Observer
+	pkts  chan *packet.Publish
+	metas chan map[string]any
+}
+
+func (o *mockMetaObserver) OnError(error) {}
+
+func (o *mockMetaObserver) OnPublishWithMeta(pkt *packet.Publish, meta map[string]any) error {
+	o.pkts <- pkt
+	o.metas <- meta
+	return nil
+}
+
+func TestMqtt5Client(t *testing.T) {
+	broker := newMockMqtt5Broker(t)
+	defer broker.listener.Close()
+
+	var cfg Mqtt5ClientCfg
+	err := utils.UnmarshalYAML([]byte("address: tcp://"+broker.listener.Addr().String()), &cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, cfg.AckTimeout)
+	cfg.ClientID = "test"
+	cfg.DisableAutoAck = true
+	cfg.Subscriptions = []mqtt.QOSTopic{{Topic: "site/+", QOS: 1}}
+	cli, err := NewMqtt5Client(&cfg)
+	assert.NoError(t, err)
+	defer cli.Close()
+
+	obs := &mockMetaObserver{pkts: make(chan *packet.Publish, 1), metas: make(chan map[string]any, 1)}
+	assert.NoError(t, cli.Start(obs))
+	// the session is kept for a while after the connection is lost, so that the unacknowledged messages are redelivered
+	cp := broker.receive(t, packets.CONNECT)
+	assert.Equal(t, uint32(3600), *cp.Content.(*packets.Connect).Properties.SessionExpiryInterval)
+	broker.receive(t, packets.SUBSCRIBE)
+
+	// the properties of source message are passed in meta
+	expiry := uint32(60)
+	conn := <-broker.conns
+	_, err = (&packets.Publish{
+		Topic:    "site/s1",
+		QoS:      1,
+		PacketID: 7,
+		Payload:  []byte("hello"),
+		Properties: &packets.Properties{
+			ContentType:     "text/plain",
+			MessageExpiry:   &expiry,
+			ResponseTopic:   "site/s1/reply",
+			CorrelationData: []byte("c1"),
+			User:            []packets.User{{Key: "tenant", Value: "t1"}, {Key: "tag", Value: "a"}, {Key: "tag", Value: "b"}},
+		},
+	}).WriteTo(conn)
+	assert.NoError(t, err)
+	pkt := <-obs.pkts
+	assert.Equal(t, "site/s1", pkt.Message.Topic)
+	assert.Equal(t, mqtt.QOS(1), pkt.Message.QOS)
+	assert.Equal(t, map[string]any{
+		config.MetaContentType:     "text/plain",
+		config.MetaMessageExpiry:   uint32(60),
+		config.MetaResponseTopic:   "site/s1/reply",
+		config.MetaCorrelationData: []byte("c1"),
+		config.MetaUserProperties:  []config.UserProperty{{Key: "tenant", Value: "t1"}, {Key: "tag", Value: "a"}, {Key: "tag", Value: "b"}},
+	}, <-obs.metas)
+
+	// the source message is acked with the packet id of broker
+	puback := packet.NewPuback()
+	puback.ID = pkt.ID
+	assert.NoError(t, cli.SendPubAck(puback))
+	cp = broker.receive(t, packets.PUBACK)
+	assert.Equal(t, uint16(7), cp.Content.(*packets.Puback).PacketID)
+
+	// the properties in meta are published to target, the message is completed once the puback is received
+	done := make(chan error, 1)
+	err = cli.SendOrDrop(&config.TargetMsg{
+		TargetInfo: config.ClientRef{MQTTRef: config.MQTTRef{QOS: 1}},
+		Topic:      "cloud/s1",
+		Data:       []byte("hello"),
+		Meta: map[string]any{
+			config.MetaContentType:    "text/plain",
+			config.MetaUserProperties: []config.UserProperty{{Key: "tenant", Value: "t2"}, {Key: "tag", Value: "a"}, {Key: "tag", Value: "b"}},
+			config.MetaHeaders:        map[string]string{"tenant": "t3"},
+		},
+		Callback: func(err error) {
+			done <- err
+		},
+	})
+	assert.NoError(t, err)
+	cp = broker.receive(t, packets.PUBLISH)
+	pub := cp.Content.(*packets.Publish)
+	assert.Equal(t, "cloud/s1", pub.Topic)
+	assert.Equal(t, byte(1), pub.QoS)
+	assert.Equal(t, "text/plain", pub.Properties.ContentType)
+	// the duplicate keys are kept, and the headers of envelope replace the user properties with the same keys
+	assert.Equal(t, []packets.User{{Key: "tag", Value: "a"}, {Key: "tag", Value: "b"}, {Key: "tenant", Value: "t3"}}, pub.Properties.User)
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "receive callback timeout")
+	}
+}
+
+func TestMqtt5ClientNack(t *testing.T) {
+	broker := newMockMqtt5Broker(t)
+	defer broker.listener.Close()
+
+	var cfg Mqtt5ClientCfg
+	err := utils.UnmarshalYAML([]byte("address: tcp://"+broker.listener.Addr().String()), &cfg)
+	assert.NoError(t, err)
+	cfg.ClientID = "test"
+	cfg.DisableAutoAck = true
+	cfg.Subscriptions = []mqtt.QOSTopic{{Topic: "site/+", QOS: 1}}
+	cli, err := NewMqtt5Client(&cfg)
+	assert.NoError(t, err)
+	defer cli.Close()
+	assert.Implements(t, (*Nacker)(nil), cli)
+
+	obs := &mockMetaObserver{pkts: make(chan *packet.Publish, 10), metas: make(chan map[string]any, 10)}
+	assert.NoError(t, cli.Start(obs))
+	broker.receive(t, packets.SUBSCRIBE)
+	publish := func(conn net.Conn, id uint16) *packet.Publish {
+		_, err := (&packets.Publish{Topic: "site/s1", QoS: 1, PacketID: id, Payload: []byte("hello"), Properties: &packets.Properties{}}).WriteTo(conn)
+		assert.NoError(t, err)
+		return <-obs.pkts
+	}
+	ack := func(pkt *packet.Publish) {
+		puback := packet.NewPuback()
+		puback.ID = pkt.ID
+		assert.NoError(t, cli.SendPubAck(puback))
+	}
+
+	// the nacked message holds back the pubacks of the later ones, so the connection is dropped at once
+	conn := <-broker.conns
+	pkt1, pkt2 := publish(conn, 1), publish(conn, 2)
+	ack(pkt2)
+	assert.NoError(t, cli.(Nacker).SendNack(pkt1.ID))
+	broker.receive(t, packets.CONNECT)
+	broker.receive(t, packets.SUBSCRIBE)
+
+	// the messages redelivered and the later ones are acked on the new connection
+	conn = <-broker.conns
+	ack(publish(conn, 1))
+	ack(publish(conn, 2))
+	ack(publish(conn, 3))
+	for _, id := range []uint16{1, 2, 3} {
+		cp := broker.receive(t, packets.PUBACK)
+		assert.Equal(t, id, cp.Content.(*packets.Puback).PacketID)
+	}
+
+	// the nack of the message unknown is ignored
+	assert.NoError(t, cli.(Nacker).SendNack(pkt1.ID))
+}
+
+func TestMqtt5ClientSubscribe(t *testing.T) {
+	broker := newMockMqtt5Broker(t)
+	defer broker.listener.Close()
+
+	var cfg Mqtt5ClientCfg
+	err := utils.UnmarshalYAML([]byte("address: tcp://"+broker.listener.Addr().String()), &cfg)
+	assert.NoError(t, err)
+	cfg.ClientID = "test"
+	cfg.Subscriptions = []mqtt.QOSTopic{{Topic: "site/+", QOS: 1}, {Topic: "site/s1", QOS: 0}}
+	cli, err := NewMqtt5Client(&cfg)
+	assert.NoError(t, err)
+	defer cli.Close()
+	assert.Implements(t, (*Subscriber)(nil), cli)
+
+	assert.NoError(t, cli.Start(nil))
+	broker.receive(t, packets.SUBSCRIBE)
+	conn := <-broker.conns
+
+	// the subscriptions are changed on the live connection
+	assert.NoError(t, cli.(Subscriber).Subscribe([]mqtt.QOSTopic{{Topic: "site/s1", QOS: 1}, {Topic: "device/+", QOS: 0}}))
+	cp := broker.receive(t, packets.SUBSCRIBE)
+	assert.Equal(t, map[string]packets.SubOptions{"site/s1": {QoS: 1}, "device/+": {QoS: 0}}, cp.Content.(*packets.Subscribe).Subscriptions)
+	assert.NoError(t, cli.(Subscriber).Unsubscribe([]string{"site/+"}))
+	cp = broker.receive(t, packets.UNSUBSCRIBE)
+	assert.Equal(t, []string{"site/+"}, cp.Content.(*packets.Unsubscribe).Topics)
+
+	// the changed subscriptions are subscribed once reconnected
+	conn.Close()
+	broker.receive(t, packets.CONNECT)
+	cp = broker.receive(t, packets.SUBSCRIBE)
+	assert.Equal(t, map[string]packets.SubOptions{"site/s1": {QoS: 1}, "device/+": {QoS: 0}}, cp.Content.(*packets.Subscribe).Subscriptions)
+}
+
+func TestMqtt5ClientTLS(t *testing.T) {
+	// the ca alone enables the tls config to verify the broker
+	certPath := "../example/var/lib/baetyl/testcert/"
+	cli, err := NewMqtt5Client(&Mqtt5ClientCfg{ClientConfig: mqtt.ClientConfig{
+		Address:     "ssl://127.0.0.1:8883",
+		Certificate: utils.Certificate{CA: certPath + "ca.crt"},
+	}})
+	assert.NoError(t, err)
+	assert.NotNil(t, cli.(*Mqtt5Client).tls)
+	assert.NotNil(t, cli.(*Mqtt5Client).tls.RootCAs)
+
+	_, err = NewMqtt5Client(&Mqtt5ClientCfg{ClientConfig: mqtt.ClientConfig{Address: "tcp://127.0.0.1:1883"}, SessionExpiry: -time.Second})
+	assert.EqualError(t, err, "session expiry (-1s) of mqtt5 is out of range")
+}
@@ -1,6 +1,8 @@
 package client
 
 import (
+	"sync"
+
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/log"
@@ -9,9 +11,18 @@ import (
 	"github.com/baetyl/baetyl-rule/v2/config"
 )
 
+var ErrPubackLost = errors.New("connection lost before puback is received")
+
+// ErrUnsubscribeNotSupported the mqtt client of baetyl-go can not handle the unsuback, which breaks the connection
+var ErrUnsubscribeNotSupported = errors.New("unsubscribe is not supported by mqtt client")
+
 type MqttClient struct {
-	cli    *mqtt.Client
-	logger *log.Logger
+	cli     *mqtt.Client
+	ops     *mqtt.ClientOptions // shared with the client, whose subscriptions are subscribed once connected
+	ids     *mqtt.Counter
+	pending map[mqtt.ID]*config.TargetMsg // messages with qos 1 waiting for puback
+	mu      sync.Mutex
+	logger  *log.Logger
 }
 
 func NewMqttClient(cfg *mqtt.ClientConfig) (Client, error) {
@@ -22,34 +33,119 @@ func NewMqttClient(cfg *mqtt.ClientConfig) (Client, error) {
 
 	cli := mqtt.NewClient(ops)
 	source := &MqttClient{
-		cli:    cli,
-		logger: log.With(log.Any("client", "mqtt")),
+		cli:     cli,
+		ops:     ops,
+		ids:     mqtt.NewCounter(),
+		pending: map[mqtt.ID]*config.TargetMsg{},
+		logger:  log.With(log.Any("client", "mqtt")),
 	}
 	return source, nil
 }
 
+// SendOrDrop publishes the message with the qos of target, which is downgraded to the qos of source packet if the
+// message comes from mqtt. A message with qos 1 is completed when the puback of target broker is received
 func (m *MqttClient) SendOrDrop(pkt *config.TargetMsg) error {
 	out := mqtt.NewPublish()
 	out.Message = packet.Message{
 		Topic:   pkt.Topic,
 		Payload: pkt.Data,
-		QOS:     mqtt.QOS(0),
+		QOS:     mqtt.QOS(pkt.TargetInfo.QOS),
 	}
 	if _, ok := pkt.Meta["ID"]; ok {
-		out.ID = pkt.Meta["ID"].(packet.ID)
-		out.Dup = pkt.Meta["Dup"].(bool)
 		out.Message.Retain = pkt.Meta["Retain"].(bool)
-		out.Message.QOS = pkt.Meta["QoS"].(mqtt.QOS)
+		if qos := pkt.Meta["QoS"].(mqtt.QOS); qos < out.Message.QOS {
+			out.Message.QOS = qos
+		}
+	}
+	if out.Message.QOS == 0 {
+		err := m.cli.SendOrDrop(out)
+		if err != nil {
+			return err
+		}
+		pkt.Complete(nil)
+		return nil
 	}
-	return m.cli.SendOrDrop(out)
+	// the packet id of source can not be reused, since packets of different sources may have the same id
+	out.Message.QOS = 1
+	out.ID = m.ids.NextID()
+	m.mu.Lock()
+	m.pending[out.ID] = pkt
+	m.mu.Unlock()
+	// the packet with qos 1 is never dropped, it waits until the cache of client is available
+	err := m.cli.Send(out)
+	if err != nil {
+		m.mu.Lock()
+		delete(m.pending, out.ID)
+		m.mu.Unlock()
+		return err
+	}
+	return nil
 }
 
 func (m *MqttClient) SendPubAck(pkt mqtt.Packet) error {
 	return m.cli.SendOrDrop(pkt)
 }
 
+// Start starts the client, the pubacks of published messages are handled before passed to the observer
 func (m *MqttClient) Start(obs mqtt.Observer) error {
-	return m.cli.Start(obs)
+	return m.cli.Start(mqtt.NewObserverWrapper(func(pkt *packet.Publish) error {
+		if obs == nil {
+			return nil
+		}
+		return obs.OnPublish(pkt)
+	}, func(pkt *packet.Puback) error {
+		m.mu.Lock()
+		msg, ok := m.pending[pkt.ID]
+		delete(m.pending, pkt.ID)
+		m.mu.Unlock()
+		if ok {
+			msg.Complete(nil)
+		}
+		if obs == nil {
+			return nil
+		}
+		return obs.OnPuback(pkt)
+	}, func(err error) {
+		// the client does not resend messages after reconnecting, so the messages waiting for puback are failed
+		m.failPending(errors.Trace(ErrPubackLost))
+		if obs != nil {
+			obs.OnError(err)
+		}
+	}))
+}
+
+func (m *MqttClient) failPending(err error) {
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = map[mqtt.ID]*config.TargetMsg{}
+	m.mu.Unlock()
+	for _, msg := range pending {
+		msg.Complete(err)
+	}
+}
+
+// Subscribe sends the subscribe packet on the current connection, the topics are also subscribed once reconnected
+func (m *MqttClient) Subscribe(subs []mqtt.QOSTopic) error {
+	sub := mqtt.NewSubscribe()
+	sub.ID = m.ids.NextID()
+	replaced := map[string]bool{}
+	for _, s := range subs {
+		sub.Subscriptions = append(sub.Subscriptions, mqtt.Subscription{Topic: s.Topic, QOS: mqtt.QOS(s.QOS)})
+		replaced[s.Topic] = true
+	}
+	var res []mqtt.Subscription
+	for _, s := range m.ops.Subscriptions {
+		if !replaced[s.Topic] {
+			res = append(res, s)
+		}
+	}
+	m.ops.Subscriptions = append(res, sub.Subscriptions...)
+	return m.cli.Send(sub)
+}
+
+// Unsubscribe is not supported, the client is restarted with the new subscriptions instead
+func (m *MqttClient) Unsubscribe(_ []string) error {
+	return errors.Trace(ErrUnsubscribeNotSupported)
 }
 
 func (m *MqttClient) ResetClient(cfg *mqtt.ClientConfig) {
@@ -67,7 +163,9 @@ func (m *MqttClient) SetReconnectCallback(callback mqtt.ReconnectCallback) {
 
 func (m *MqttClient) Close() error {
 	if m.cli != nil {
-		return m.cli.Close()
+		err := m.cli.Close()
+		m.failPending(errors.Trace(ErrPubackLost))
+		return err
 	}
 	return nil
 }
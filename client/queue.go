@@ -0,0 +1,347 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/utils"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+var (
+	ErrQueueClosed = errors.New("queue has closed")
+	// ErrQueueEvicted the message is evicted from the full queue before it is sent
+	ErrQueueEvicted = errors.New("message is evicted from the full queue")
+	bucketMessages  = []byte("messages")
+)
+
+// queueOpenTimeout the max time to wait for the lock of bolt file, which is held by the queue opening it
+const queueOpenTimeout = 5 * time.Second
+
+// QueueConfig queue config of target client
+type QueueConfig struct {
+	// Path the bolt file of the persistent queue, messages are buffered in memory if it is empty
+	Path string `yaml:"path" json:"path"`
+	// MaxCount the max number of messages in the persistent queue
+	MaxCount int `yaml:"maxCount" json:"maxCount" default:"100000"`
+	// MaxSize the max bytes of messages in the persistent queue
+	MaxSize utils.Size `yaml:"maxSize" json:"maxSize" default:"104857600"`
+}
+
+// Message message popped from queue
+type Message struct {
+	ID uint64
+	*config.TargetMsg
+}
+
+// Queue buffers the messages sent to target client
+type Queue interface {
+	// Push appends a message to the tail of the queue
+	Push(msg *config.TargetMsg) error
+	// Pop returns the next message, it blocks until a message is available or the queue is closed
+	Pop() (*Message, error)
+	// Ack removes a delivered message from the queue
+	Ack(msg *Message) error
+	// Len returns the number of messages in the queue
+	Len() int
+	// Persistent returns true if the messages survive restarts
+	Persistent() bool
+	Close() error
+}
+
+// NewQueue creates a persistent queue if path is configured, otherwise creates a memory queue
+func NewQueue(cfg QueueConfig) (Queue, error) {
+	if cfg.Path == "" {
+		return NewMemoryQueue(config.TaskLength), nil
+	}
+	return NewPersistentQueue(cfg)
+}
+
+type memoryQueue struct {
+	msgs   chan *config.TargetMsg
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewMemoryQueue creates a queue buffering messages in memory, push blocks if the queue is full
+func NewMemoryQueue(size int) Queue {
+	return &memoryQueue{
+		msgs:   make(chan *config.TargetMsg, size),
+		closed: make(chan struct{}),
+	}
+}
+
+func (q *memoryQueue) Push(msg *config.TargetMsg) error {
+	select {
+	case <-q.closed:
+		return errors.Trace(ErrQueueClosed)
+	default:
+	}
+	select {
+	case <-q.closed:
+		return errors.Trace(ErrQueueClosed)
+	case q.msgs <- msg:
+		return nil
+	}
+}
+
+func (q *memoryQueue) Pop() (*Message, error) {
+	select {
+	case <-q.closed:
+		return nil, errors.Trace(ErrQueueClosed)
+	case msg := <-q.msgs:
+		return &Message{TargetMsg: msg}, nil
+	}
+}
+
+func (q *memoryQueue) Ack(_ *Message) error {
+	return nil
+}
+
+func (q *memoryQueue) Len() int {
+	return len(q.msgs)
+}
+
+func (q *memoryQueue) Persistent() bool {
+	return false
+}
+
+func (q *memoryQueue) Close() error {
+	q.once.Do(func() {
+		close(q.closed)
+	})
+	return nil
+}
+
+type persistentQueue struct {
+	cfg   QueueConfig
+	db    *bolt.DB
+	next  uint64 // id of the next message to pop
+	count int
+	size  int64
+	// pushed the messages pushed in process and not popped yet, whose callback and response are not persisted
+	pushed map[uint64]*config.TargetMsg
+	mu     sync.Mutex
+	notify chan struct{}
+	closed chan struct{}
+	once   sync.Once
+	logger *log.Logger
+}
+
+// NewPersistentQueue creates a queue stored in bolt file, messages not acked are replayed in order after restart,
+// the oldest messages are evicted if the queue exceeds the max count or max size
+func NewPersistentQueue(cfg QueueConfig) (Queue, error) {
+	err := os.MkdirAll(filepath.Dir(cfg.Path), 0755)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: queueOpenTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, errors.Errorf("file (%s) of persistent queue is in use by another client or process", cfg.Path)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	q := &persistentQueue{
+		cfg:    cfg,
+		db:     db,
+		pushed: map[uint64]*config.TargetMsg{},
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		logger: log.With(log.Any("queue", cfg.Path)),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucketMessages)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			q.count++
+			q.size += int64(len(v))
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Trace(err)
+	}
+	if q.count > 0 {
+		q.logger.Info("replay messages of persistent queue", log.Any("count", q.count))
+	}
+	return q, nil
+}
+
+func (q *persistentQueue) Push(msg *config.TargetMsg) error {
+	select {
+	case <-q.closed:
+		return errors.Trace(ErrQueueClosed)
+	default:
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var evicted []*config.TargetMsg
+	q.mu.Lock()
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMessages)
+		ids, size, err := q.evict(b, len(data))
+		if err != nil {
+			return err
+		}
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		err = b.Put(uint64ToBytes(id), data)
+		if err != nil {
+			return err
+		}
+		q.count += 1 - len(ids)
+		q.size += int64(len(data)) - size
+		for _, k := range ids {
+			if m, ok := q.pushed[k]; ok {
+				evicted = append(evicted, m)
+				delete(q.pushed, k)
+			}
+		}
+		q.pushed[id] = msg
+		if len(ids) > 0 {
+			q.logger.Warn("queue is full, the oldest messages are evicted", log.Any("count", len(ids)))
+		}
+		return nil
+	})
+	q.mu.Unlock()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// the messages evicted before they are sent are finished as failures
+	for _, m := range evicted {
+		m.Complete(ErrQueueEvicted)
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// evict deletes the oldest messages to make room for a new message with the given length,
+// it returns the ids and the total size of messages evicted
+func (q *persistentQueue) evict(b *bolt.Bucket, length int) ([]uint64, int64, error) {
+	var evicted []uint64
+	var size int64
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		if q.count-len(evicted) < q.cfg.MaxCount && q.size-size+int64(length) <= int64(q.cfg.MaxSize) {
+			break
+		}
+		size += int64(len(v))
+		evicted = append(evicted, bytesToUint64(k))
+		if err := c.Delete(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return evicted, size, nil
+}
+
+func (q *persistentQueue) Pop() (*Message, error) {
+	for {
+		select {
+		case <-q.closed:
+			return nil, errors.Trace(ErrQueueClosed)
+		default:
+		}
+		msg, err := q.peek()
+		if err != nil || msg != nil {
+			return msg, errors.Trace(err)
+		}
+		select {
+		case <-q.closed:
+			return nil, errors.Trace(ErrQueueClosed)
+		case <-q.notify:
+		}
+	}
+}
+
+func (q *persistentQueue) peek() (*Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var msg *Message
+	err := q.db.View(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(bucketMessages).Cursor().Seek(uint64ToBytes(q.next))
+		if k == nil {
+			return nil
+		}
+		msg = &Message{ID: bytesToUint64(k), TargetMsg: new(config.TargetMsg)}
+		return json.Unmarshal(v, msg.TargetMsg)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if msg != nil {
+		q.next = msg.ID + 1
+		// the message pushed in process keeps its callback and response
+		if m, ok := q.pushed[msg.ID]; ok {
+			msg.TargetMsg = m
+			delete(q.pushed, msg.ID)
+		}
+	}
+	return msg, nil
+}
+
+func (q *persistentQueue) Ack(msg *Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return errors.Trace(q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketMessages)
+		k := uint64ToBytes(msg.ID)
+		v := b.Get(k)
+		if v == nil {
+			// the message has been evicted
+			return nil
+		}
+		q.count--
+		q.size -= int64(len(v))
+		return b.Delete(k)
+	}))
+}
+
+func (q *persistentQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count
+}
+
+func (q *persistentQueue) Persistent() bool {
+	return true
+}
+
+func (q *persistentQueue) Close() error {
+	var err error
+	q.once.Do(func() {
+		close(q.closed)
+		q.mu.Lock()
+		err = q.db.Close()
+		q.mu.Unlock()
+	})
+	return errors.Trace(err)
+}
+
+func uint64ToBytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func bytesToUint64(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestPersistentQueue(t *testing.T) {
+	cfg := QueueConfig{
+		Path:     path.Join(t.TempDir(), "queue.db"),
+		MaxCount: 3,
+		MaxSize:  1024,
+	}
+	q, err := NewQueue(cfg)
+	assert.NoError(t, err)
+	assert.True(t, q.Persistent())
+
+	for i := 0; i < 5; i++ {
+		err = q.Push(&config.TargetMsg{Topic: fmt.Sprintf("topic%d", i), Data: []byte("data")})
+		assert.NoError(t, err)
+	}
+	// the oldest messages are evicted
+	assert.Equal(t, 3, q.Len())
+
+	msg, err := q.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "topic2", msg.Topic)
+	assert.NoError(t, q.Ack(msg))
+	assert.Equal(t, 2, q.Len())
+
+	// the popped message is replayed after restart if it is not acked
+	msg, err = q.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "topic3", msg.Topic)
+	assert.NoError(t, q.Close())
+	_, err = q.Pop()
+	assert.Error(t, err)
+
+	q, err = NewQueue(cfg)
+	assert.NoError(t, err)
+	defer q.Close()
+	assert.Equal(t, 2, q.Len())
+	msg, err = q.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "topic3", msg.Topic)
+	assert.Equal(t, []byte("data"), msg.Data)
+	assert.NoError(t, q.Ack(msg))
+	msg, err = q.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "topic4", msg.Topic)
+	assert.NoError(t, q.Ack(msg))
+	assert.Equal(t, 0, q.Len())
+
+	// evicted by size
+	err = q.Push(&config.TargetMsg{Topic: "big", Data: make([]byte, 600)})
+	assert.NoError(t, err)
+	err = q.Push(&config.TargetMsg{Topic: "big2", Data: make([]byte, 600)})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.Len())
+	msg, err = q.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "big2", msg.Topic)
+	assert.NoError(t, q.Ack(msg))
+
+	// the message pushed in process keeps its callback and response, the one evicted before popped fails
+	var results []error
+	callback := func(err error) { results = append(results, err) }
+	res := &config.TargetResponse{}
+	for i := 0; i < 4; i++ {
+		err = q.Push(&config.TargetMsg{Topic: fmt.Sprintf("cb%d", i), Callback: callback, Response: res})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []error{ErrQueueEvicted}, results)
+	msg, err = q.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "cb1", msg.Topic)
+	assert.Equal(t, res, msg.Response)
+	msg.Complete(nil)
+	assert.Equal(t, []error{ErrQueueEvicted, nil}, results)
+	// the message popped is not failed by eviction, it is finished by its delivery
+	assert.NoError(t, q.Push(&config.TargetMsg{Topic: "cb4", Callback: callback}))
+	assert.Equal(t, []error{ErrQueueEvicted, nil}, results)
+	assert.Equal(t, 3, q.Len())
+
+	// the file is locked by the queue opening it
+	_, err = NewQueue(cfg)
+	assert.EqualError(t, err, fmt.Sprintf("file (%s) of persistent queue is in use by another client or process", cfg.Path))
+}
+
+func TestMemoryQueue(t *testing.T) {
+	q, err := NewQueue(QueueConfig{})
+	assert.NoError(t, err)
+	assert.False(t, q.Persistent())
+	assert.NoError(t, q.Push(&config.TargetMsg{Topic: "a"}))
+	assert.Equal(t, 1, q.Len())
+	msg, err := q.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "a", msg.Topic)
+	assert.NoError(t, q.Close())
+	assert.Error(t, q.Push(&config.TargetMsg{Topic: "b"}))
+}
@@ -3,11 +3,15 @@ package client
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/256dpi/gomqtt/packet"
 	gcontext "github.com/baetyl/baetyl-go/v2/context"
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/log"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
+	amqp "github.com/rabbitmq/amqp091-go"
 	"github.com/wagslane/go-rabbitmq"
 
 	"github.com/baetyl/baetyl-rule/v2/config"
@@ -17,91 +21,261 @@ type RabbitClientCfg struct {
 	Address  string `yaml:"address" json:"address"`
 	Username string `yaml:"username" json:"username"`
 	Password string `yaml:"password" json:"password"`
+	// Durable declares the consumed queues as durable queues
+	Durable bool `yaml:"durable" json:"durable"`
+	// AckTimeout the max time to wait for the rule to acknowledge a delivery with qos 1, then it is requeued
+	AckTimeout     time.Duration        `yaml:"ackTimeout" json:"ackTimeout" default:"1m"`
+	Subscriptions  []RabbitSubscription `yaml:"subscriptions" json:"subscriptions" default:"[]"`
+	DeliveryConfig `yaml:",inline" json:",inline"`
+}
+
+// RabbitSubscription queue consumed when rabbit-mq is the source of rules
+type RabbitSubscription struct {
+	Queue      string `yaml:"queue" json:"queue"`
+	Exchange   string `yaml:"exchange" json:"exchange"`
+	RoutingKey string `yaml:"routingKey" json:"routingKey"`
+	QOS        uint32 `yaml:"qos" json:"qos"`
 }
 
 type RabbitClient struct {
-	cfg    *RabbitClientCfg
-	conn   *rabbitmq.Conn
-	pub    *rabbitmq.Publisher
-	tasks  chan *config.TargetMsg
-	ctx    context.Context
-	cancel context.CancelFunc
-	logger *log.Logger
+	cfg        *RabbitClientCfg
+	conn       *rabbitmq.Conn
+	pub        *rabbitPublisher
+	consumers  []*rabbitmq.Consumer
+	ids        *mqtt.Counter
+	pending    map[mqtt.ID]chan bool
+	mu         sync.Mutex
+	dispatcher *dispatcher
+	ctx        context.Context
+	cancel     context.CancelFunc
+	logger     *log.Logger
 }
 
 func NewRabbitClient(_ gcontext.Context, cfg *RabbitClientCfg) (Client, error) {
-	var err error
-	var conn *rabbitmq.Conn
+	url := fmt.Sprintf("amqp://%s", cfg.Address)
 	if cfg.Username != "" && cfg.Password != "" {
-		conn, err = rabbitmq.NewConn(
-			fmt.Sprintf("amqp://%s:%s@%s", cfg.Username, cfg.Password, cfg.Address),
-			rabbitmq.WithConnectionOptionsLogging,
-		)
-	} else {
-		conn, err = rabbitmq.NewConn(
-			fmt.Sprintf("amqp://%s", cfg.Address),
-			rabbitmq.WithConnectionOptionsLogging,
-		)
+		url = fmt.Sprintf("amqp://%s:%s@%s", cfg.Username, cfg.Password, cfg.Address)
 	}
+	conn, err := rabbitmq.NewConn(url, rabbitmq.WithConnectionOptionsLogging)
 	if err != nil {
 		return nil, err
 	}
-	pub, err := rabbitmq.NewPublisher(
-		conn,
-		rabbitmq.WithPublisherOptionsLogging,
-	)
+	pub := &rabbitPublisher{url: url}
+	if _, err = pub.channel(); err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &RabbitClient{
+		conn:    conn,
+		cfg:     cfg,
+		pub:     pub,
+		ids:     mqtt.NewCounter(),
+		pending: map[mqtt.ID]chan bool{},
+		ctx:     ctx,
+		cancel:  cancel,
+		logger:  log.With(log.Any("client", "rabbit-mq")),
+	}
+	r.dispatcher, err = newDispatcher(cfg.DeliveryConfig, r.RabbitSend, true, r.logger)
 	if err != nil {
-		return nil, err
+		cancel()
+		pub.close()
+		conn.Close()
+		return nil, errors.Trace(err)
 	}
-	ctxCancel, cancel := context.WithCancel(context.Background())
-	return &RabbitClient{
-		conn:   conn,
-		cfg:    cfg,
-		pub:    pub,
-		ctx:    ctxCancel,
-		cancel: cancel,
-		tasks:  make(chan *config.TargetMsg, config.TaskLength),
-		logger: log.With(log.Any("client", "rabbit-mq")),
-	}, nil
+	r.dispatcher.batching(r.RabbitSendBatch, func(*config.TargetMsg) string { return "" })
+	return r, nil
 }
 
 func (r *RabbitClient) SendOrDrop(pkt *config.TargetMsg) error {
-	select {
-	case <-r.ctx.Done():
-		return errors.New("rabbit mq has exited")
-	case r.tasks <- pkt:
+	return r.dispatcher.push(pkt)
+}
+
+func (r *RabbitClient) QueueLen() int {
+	return r.dispatcher.queue.Len()
+}
+
+func (r *RabbitClient) InFlight() int {
+	return r.dispatcher.InFlight()
+}
+
+// SendPubAck marks the delivery as handled by the rule, so that it will be acked to rabbit-mq
+func (r *RabbitClient) SendPubAck(pkt mqtt.Packet) error {
+	ack, ok := pkt.(*packet.Puback)
+	if !ok {
 		return nil
 	}
+	r.done(ack.ID, true)
+	return nil
 }
 
-func (r *RabbitClient) SendPubAck(_ mqtt.Packet) error {
+// SendNack requeues the delivery failed to be delivered by the rule
+func (r *RabbitClient) SendNack(id mqtt.ID) error {
+	r.done(id, false)
 	return nil
 }
 
-func (r *RabbitClient) Start(_ mqtt.Observer) error {
-	go func() {
-		for {
-			select {
-			case <-r.ctx.Done():
-				return
-			case task := <-r.tasks:
-				go r.RabbitSend(task)
-			}
+// done sends the result of rule to the handler of delivery
+func (r *RabbitClient) done(id mqtt.ID, acked bool) {
+	r.mu.Lock()
+	done, ok := r.pending[id]
+	delete(r.pending, id)
+	r.mu.Unlock()
+	if ok {
+		done <- acked
+	}
+}
+
+func (r *RabbitClient) Start(obs mqtt.Observer) error {
+	if obs != nil {
+		err := r.consuming(obs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return r.dispatcher.start()
+}
+
+// consuming starts one consumer per subscribed queue, the queue is bound to
+// the exchange with all routing keys of the rules using it
+func (r *RabbitClient) consuming(obs mqtt.Observer) error {
+	bindings, err := rabbitBindings(r.cfg.Subscriptions)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, b := range bindings {
+		ops := []func(*rabbitmq.ConsumerOptions){
+			rabbitmq.WithConsumerOptionsLogging,
+		}
+		if r.cfg.Durable {
+			ops = append(ops, rabbitmq.WithConsumerOptionsQueueDurable)
 		}
-	}()
+		if b.exchange != "" {
+			ops = append(ops, rabbitmq.WithConsumerOptionsExchangeName(b.exchange))
+		}
+		for _, key := range b.routingKeys {
+			ops = append(ops, rabbitmq.WithConsumerOptionsRoutingKey(key))
+		}
+		consumer, err := rabbitmq.NewConsumer(r.conn, r.handler(obs, b.queue, b.qos), b.queue, ops...)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		r.consumers = append(r.consumers, consumer)
+	}
 	return nil
 }
 
-func (r *RabbitClient) RabbitSend(task *config.TargetMsg) {
-	err := r.pub.Publish(
-		task.Data,
-		[]string{task.TargetInfo.RoutingKey},
-		rabbitmq.WithPublishOptionsContentType("application/json"),
-		rabbitmq.WithPublishOptionsExchange(task.TargetInfo.Exchange),
-	)
+// rabbitBinding a queue consumed, which is bound to the exchange with the routing keys if the exchange is set
+type rabbitBinding struct {
+	queue       string
+	exchange    string
+	routingKeys []string
+	qos         mqtt.QOS
+}
+
+// rabbitBindings merges the subscriptions of the same queue in order, the queue is consumed with the max qos
+// of its subscriptions, and can only be bound to one exchange
+func rabbitBindings(subs []RabbitSubscription) ([]*rabbitBinding, error) {
+	var bindings []*rabbitBinding
+	queues := map[string]*rabbitBinding{}
+	for _, sub := range subs {
+		b, ok := queues[sub.Queue]
+		if !ok {
+			b = &rabbitBinding{queue: sub.Queue, exchange: sub.Exchange}
+			queues[sub.Queue] = b
+			bindings = append(bindings, b)
+		}
+		if sub.Exchange != b.exchange {
+			return nil, errors.Errorf("queue (%s) can not be bound to more than one exchange", sub.Queue)
+		}
+		if b.exchange != "" {
+			b.routingKeys = append(b.routingKeys, sub.RoutingKey)
+		}
+		if q := mqtt.QOS(sub.QOS); q > b.qos {
+			b.qos = q
+		}
+	}
+	return bindings, nil
+}
+
+// handler hands the delivery to the observer, a delivery with qos 1 is acked once the rule has acknowledged it,
+// it is requeued at once if the rule fails to deliver it, or if the ack of rule times out
+func (r *RabbitClient) handler(obs mqtt.Observer, queue string, qos mqtt.QOS) rabbitmq.Handler {
+	return func(d rabbitmq.Delivery) rabbitmq.Action {
+		pkt := packet.NewPublish()
+		pkt.Message.Topic = queue
+		pkt.Message.Payload = d.Body
+		pkt.Message.QOS = qos
+		if qos == 0 {
+			err := obs.OnPublish(pkt)
+			if err != nil {
+				r.logger.Error("failed to handle rabbit delivery", log.Error(err))
+			}
+			return rabbitmq.Ack
+		}
+		// the result of rule, true for ack and false for nack
+		done := make(chan bool, 1)
+		pkt.ID = r.ids.NextID()
+		r.mu.Lock()
+		r.pending[pkt.ID] = done
+		r.mu.Unlock()
+		// the rule nacks the delivery if it fails to handle it
+		err := obs.OnPublish(pkt)
+		if err != nil {
+			r.logger.Error("failed to handle rabbit delivery", log.Error(err))
+		}
+		timer := time.NewTimer(r.cfg.AckTimeout)
+		defer timer.Stop()
+		select {
+		case acked := <-done:
+			return rabbitAction(acked, queue, r.logger)
+		case <-timer.C:
+			r.logger.Warn("rabbit delivery is not acknowledged in time, requeue it", log.Any("queue", queue))
+		case <-r.ctx.Done():
+		}
+		r.mu.Lock()
+		delete(r.pending, pkt.ID)
+		r.mu.Unlock()
+		select {
+		case acked := <-done:
+			return rabbitAction(acked, queue, r.logger)
+		default:
+			return rabbitmq.NackRequeue
+		}
+	}
+}
+
+// rabbitAction returns the action of the delivery acknowledged or not by the rule
+func rabbitAction(acked bool, queue string, logger *log.Logger) rabbitmq.Action {
+	if acked {
+		return rabbitmq.Ack
+	}
+	logger.Warn("rabbit delivery is not delivered by the rule, requeue it", log.Any("queue", queue))
+	return rabbitmq.NackRequeue
+}
+
+// RabbitSend publishes the message and waits for the publisher confirm of rabbit-mq
+func (r *RabbitClient) RabbitSend(task *config.TargetMsg) error {
+	return r.RabbitSendBatch([]*config.TargetMsg{task})
+}
+
+// RabbitSendBatch publishes the messages and waits for their publisher confirms of rabbit-mq at once,
+// so the messages are not sent one round trip after another
+func (r *RabbitClient) RabbitSendBatch(tasks []*config.TargetMsg) error {
+	confs, err := r.pub.publish(r.ctx, tasks)
 	if err != nil {
-		r.logger.Error("failed to publish rabbit data", log.Error(err))
+		return errors.Trace(err)
 	}
+	for _, conf := range confs {
+		acked, err := conf.WaitContext(r.ctx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !acked {
+			return errors.New("message is nacked by rabbit-mq")
+		}
+	}
+	return nil
 }
 
 func (r *RabbitClient) ResetClient(_ *mqtt.ClientConfig) {}
@@ -111,6 +285,81 @@ func (r *RabbitClient) SetReconnectCallback(_ mqtt.ReconnectCallback) {}
 // Close closes client
 func (r *RabbitClient) Close() error {
 	r.cancel()
-	r.pub.Close()
+	if err := r.dispatcher.close(); err != nil {
+		r.logger.Error("failed to close rabbit dispatcher", log.Error(err))
+	}
+	for _, consumer := range r.consumers {
+		consumer.Close()
+	}
+	if err := r.pub.close(); err != nil {
+		r.logger.Error("failed to close rabbit publisher", log.Error(err))
+	}
 	return r.conn.Close()
 }
+
+// rabbitPublisher publishes messages over its own channel, which is put into confirm mode before any
+// message is published on it, and is reopened by the next publishing once it is closed
+type rabbitPublisher struct {
+	url  string
+	conn *amqp.Connection
+	ch   *amqp.Channel
+	mu   sync.Mutex
+}
+
+// channel returns the channel in confirm mode, the caller must hold the lock unless it is the only user
+func (p *rabbitPublisher) channel() (*amqp.Channel, error) {
+	if p.ch != nil && !p.ch.IsClosed() {
+		return p.ch, nil
+	}
+	if p.conn == nil || p.conn.IsClosed() {
+		conn, err := amqp.Dial(p.url)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		p.conn = conn
+	}
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, errors.Trace(err)
+	}
+	p.ch = ch
+	return ch, nil
+}
+
+func (p *rabbitPublisher) publish(ctx context.Context, tasks []*config.TargetMsg) ([]*amqp.DeferredConfirmation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch, err := p.channel()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var confs []*amqp.DeferredConfirmation
+	for _, task := range tasks {
+		conf, err := ch.PublishWithDeferredConfirmWithContext(
+			ctx,
+			task.TargetInfo.Exchange,
+			task.TargetInfo.RoutingKey,
+			false,
+			false,
+			amqp.Publishing{ContentType: "application/json", Body: task.Data},
+		)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		confs = append(confs, conf)
+	}
+	return confs, nil
+}
+
+func (p *rabbitPublisher) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil || p.conn.IsClosed() {
+		return nil
+	}
+	return p.conn.Close()
+}
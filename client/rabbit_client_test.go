@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/wagslane/go-rabbitmq"
+)
+
+func TestRabbitClientHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &RabbitClient{
+		cfg:     &RabbitClientCfg{AckTimeout: 200 * time.Millisecond},
+		ids:     mqtt.NewCounter(),
+		pending: map[mqtt.ID]chan bool{},
+		ctx:     ctx,
+		cancel:  cancel,
+		logger:  log.With(log.Any("client", "rabbit-mq")),
+	}
+	delivery := rabbitmq.Delivery{Delivery: amqp.Delivery{Body: []byte("data")}}
+
+	// the delivery with qos 0 is acked once it is handled
+	var pkt *packet.Publish
+	handler := r.handler(mqtt.NewObserverWrapper(func(p *packet.Publish) error {
+		pkt = p
+		return nil
+	}, nil, nil), "queue0", 0)
+	assert.Equal(t, rabbitmq.Ack, handler(delivery))
+	assert.Equal(t, "queue0", pkt.Message.Topic)
+	assert.Equal(t, "data", string(pkt.Message.Payload))
+
+	// the delivery with qos 1 is acked or requeued by the result of rule, which may be sent later
+	for _, acked := range []bool{true, false} {
+		acked := acked
+		handler = r.handler(mqtt.NewObserverWrapper(func(p *packet.Publish) error {
+			assert.Equal(t, mqtt.QOS(1), p.Message.QOS)
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				if acked {
+					ack := packet.NewPuback()
+					ack.ID = p.ID
+					assert.NoError(t, r.SendPubAck(ack))
+				} else {
+					assert.NoError(t, r.SendNack(p.ID))
+				}
+			}()
+			return nil
+		}, nil, nil), "queue1", 1)
+		start := time.Now()
+		if acked {
+			assert.Equal(t, rabbitmq.Ack, handler(delivery))
+		} else {
+			assert.Equal(t, rabbitmq.NackRequeue, handler(delivery))
+		}
+		assert.Less(t, time.Since(start), 200*time.Millisecond)
+	}
+
+	// the delivery failed to be handled is requeued at once if the rule nacks it
+	handler = r.handler(mqtt.NewObserverWrapper(func(p *packet.Publish) error {
+		assert.NoError(t, r.SendNack(p.ID))
+		return assert.AnError
+	}, nil, nil), "queue1", 1)
+	start := time.Now()
+	assert.Equal(t, rabbitmq.NackRequeue, handler(delivery))
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+
+	// the delivery is requeued if the rule does not acknowledge it in time
+	handler = r.handler(mqtt.NewObserverWrapper(func(p *packet.Publish) error {
+		return nil
+	}, nil, nil), "queue1", 1)
+	start = time.Now()
+	assert.Equal(t, rabbitmq.NackRequeue, handler(delivery))
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	r.mu.Lock()
+	assert.Empty(t, r.pending)
+	r.mu.Unlock()
+}
+
+func TestRabbitBindings(t *testing.T) {
+	// the subscriptions of queue are merged in order, with the max qos and all routing keys of exchange
+	bindings, err := rabbitBindings([]RabbitSubscription{
+		{Queue: "q1", Exchange: "ex", RoutingKey: "a", QOS: 0},
+		{Queue: "q2", QOS: 0},
+		{Queue: "q1", Exchange: "ex", RoutingKey: "b", QOS: 1},
+		{Queue: "q2", QOS: 0},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []*rabbitBinding{
+		{queue: "q1", exchange: "ex", routingKeys: []string{"a", "b"}, qos: 1},
+		{queue: "q2"},
+	}, bindings)
+
+	// a queue can not be bound to more than one exchange, or to both an exchange and the default one
+	_, err = rabbitBindings([]RabbitSubscription{
+		{Queue: "q1", Exchange: "ex1", RoutingKey: "a"},
+		{Queue: "q1", Exchange: "ex2", RoutingKey: "a"},
+	})
+	assert.EqualError(t, err, "queue (q1) can not be bound to more than one exchange")
+	_, err = rabbitBindings([]RabbitSubscription{
+		{Queue: "q1"},
+		{Queue: "q1", Exchange: "ex1", RoutingKey: "a"},
+	})
+	assert.EqualError(t, err, "queue (q1) can not be bound to more than one exchange")
+}
@@ -18,7 +18,6 @@ import (
 	"github.com/baetyl/baetyl-go/v2/log"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
 	v1 "github.com/baetyl/baetyl-go/v2/spec/v1"
-	"github.com/baetyl/baetyl-go/v2/utils"
 
 	"github.com/baetyl/baetyl-rule/v2/config"
 )
@@ -46,6 +45,8 @@ type S3ClientCfg struct {
 	Sk      string `yaml:"sk" json:"sk"`
 	Bucket  string `yaml:"bucket" json:"bucket"`
 	Token   string `yaml:"token,omitempty" json:"token,omitempty" default:""`
+
+	DeliveryConfig `yaml:",inline" json:",inline"`
 }
 
 type S3Client struct {
@@ -53,10 +54,9 @@ type S3Client struct {
 	cli          *http.Client
 	s3Client     *s3.S3
 	uploader     *s3manager.Uploader
-	tasks        chan *UploadEvent
+	dispatcher   *dispatcher
 	stsDeadline  time.Time
 	remotePrefix string
-	tomb         utils.Tomb
 	logger       *log.Logger
 }
 
@@ -64,7 +64,6 @@ func NewS3Client(ctx gcontext.Context, cfg *S3ClientCfg) (Client, error) {
 	client := &S3Client{
 		s3Client:    &s3.S3{},
 		cfg:         cfg,
-		tasks:       make(chan *UploadEvent, config.TaskLength),
 		uploader:    &s3manager.Uploader{},
 		stsDeadline: time.Now(),
 		logger:      log.With(log.Any("storage", "s3")),
@@ -75,21 +74,27 @@ func NewS3Client(ctx gcontext.Context, cfg *S3ClientCfg) (Client, error) {
 			return nil, errors.Trace(err)
 		}
 		client.cli = cli
-		return client, nil
-	}
-	s3Config := &aws.Config{
-		Credentials:      credentials.NewStaticCredentials(cfg.Ak, cfg.Sk, cfg.Token),
-		Endpoint:         aws.String(cfg.Address),
-		Region:           aws.String(cfg.Region),
-		DisableSSL:       aws.Bool(!strings.HasPrefix(cfg.Address, "https")),
-		S3ForcePathStyle: aws.Bool(true),
+	} else {
+		s3Config := &aws.Config{
+			Credentials:      credentials.NewStaticCredentials(cfg.Ak, cfg.Sk, cfg.Token),
+			Endpoint:         aws.String(cfg.Address),
+			Region:           aws.String(cfg.Region),
+			DisableSSL:       aws.Bool(!strings.HasPrefix(cfg.Address, "https")),
+			S3ForcePathStyle: aws.Bool(true),
+		}
+		sessionProvider, err := session.NewSession(s3Config)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		client.s3Client = s3.New(sessionProvider)
+		client.uploader = s3manager.NewUploader(sessionProvider)
 	}
-	sessionProvider, err := session.NewSession(s3Config)
+	// files are uploaded one by one, since the sts credential is refreshed in place
+	dispatcher, err := newDispatcher(cfg.DeliveryConfig, client.S3Send, false, client.logger)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	client.s3Client = s3.New(sessionProvider)
-	client.uploader = s3manager.NewUploader(sessionProvider)
+	client.dispatcher = dispatcher
 	return client, nil
 }
 
@@ -203,12 +208,25 @@ func (s *S3Client) SendOrDrop(pkt *config.TargetMsg) error {
 	if err != nil {
 		return errors.New("Unexpected message content")
 	}
-	select {
-	case <-s.tomb.Dying():
-		return errors.New("ctx done")
-	case s.tasks <- &e.Content:
-		return nil
+	return s.dispatcher.push(pkt)
+}
+
+func (s *S3Client) QueueLen() int {
+	return s.dispatcher.queue.Len()
+}
+
+func (s *S3Client) InFlight() int {
+	return s.dispatcher.InFlight()
+}
+
+// S3Send uploads the local file of the upload event
+func (s *S3Client) S3Send(task *config.TargetMsg) error {
+	var e Event
+	err := json.Unmarshal(task.Data, &e)
+	if err != nil {
+		return Permanent(errors.Trace(err))
 	}
+	return errors.Trace(s.Upload(e.Content.LocalPath, e.Content.RemotePath))
 }
 
 func (s *S3Client) SendPubAck(_ mqtt.Packet) error {
@@ -216,19 +234,7 @@ func (s *S3Client) SendPubAck(_ mqtt.Packet) error {
 }
 
 func (s *S3Client) Start(_ mqtt.Observer) error {
-	return s.tomb.Go(func() error {
-		for {
-			select {
-			case <-s.tomb.Dying():
-				return nil
-			case task := <-s.tasks:
-				err := s.Upload(task.LocalPath, task.RemotePath)
-				if err != nil {
-					s.logger.Error("failed to Upload file", log.Error(err))
-				}
-			}
-		}
-	})
+	return s.dispatcher.start()
 }
 
 func (s *S3Client) ResetClient(_ *mqtt.ClientConfig) {}
@@ -237,10 +243,9 @@ func (s *S3Client) SetReconnectCallback(_ mqtt.ReconnectCallback) {}
 
 // Close closes client
 func (s *S3Client) Close() error {
-	s.tomb.Kill(nil)
-	err := s.tomb.Wait()
+	err := s.dispatcher.close()
 	if err != nil {
-		s.logger.Error("failed to wait on tomb", log.Error(err))
+		s.logger.Error("failed to close dispatcher", log.Error(err))
 	}
 	return nil
 }
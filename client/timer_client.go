@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/robfig/cron/v3"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+// ErrSourceOnly the client can only be the source of rules
+var ErrSourceOnly = errors.New("client can only be the source of rules")
+
+// timerPlaceholder the placeholders of timer payload, which are replaced by the time of tick
+//   - {timestamp} the time in RFC 3339 format, or {timestamp:<layout>} in the layout of go, e.g. {timestamp:2006-01-02}
+//   - {unix} the unix time in seconds
+//   - {unixMilli} the unix time in milliseconds
+//   - {count} the count of ticks since the timer is started, starting from 1
+var timerPlaceholder = regexp.MustCompile(`\{(timestamp(:[^}]+)?|unix|unixMilli|count)\}`)
+
+type TimerClientCfg struct {
+	// Interval the interval between two ticks, e.g. 10s
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	// Cron the cron expression of ticks, which has 5 fields like "*/5 * * * *", or descriptors like "@hourly"
+	Cron string `yaml:"cron" json:"cron"`
+	// Location the time zone of cron expression and timestamp, e.g. Asia/Shanghai
+	Location string `yaml:"location" json:"location" default:"UTC"`
+	// Topic the topic of messages emitted, which is matched by the source topic of rules
+	Topic string `yaml:"topic" json:"topic"`
+	// Payload the payload of messages emitted, the placeholders of time are replaced
+	Payload string `yaml:"payload" json:"payload"`
+}
+
+// TimerClient emits a message on every tick of schedule, it can only be the source of rules
+type TimerClient struct {
+	schedule cron.Schedule
+	location *time.Location
+	topic    string
+	payload  string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+	logger   *log.Logger
+}
+
+func NewTimerClient(cfg *TimerClientCfg) (Client, error) {
+	location, err := time.LoadLocation(cfg.Location)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var schedule cron.Schedule
+	switch {
+	case cfg.Cron != "" && cfg.Interval != 0:
+		return nil, errors.New("only one of interval and cron can be set")
+	case cfg.Cron != "":
+		schedule, err = cron.ParseStandard(cfg.Cron)
+		if err != nil {
+			return nil, errors.Errorf("invalid cron (%s): %s", cfg.Cron, err.Error())
+		}
+	case cfg.Interval > 0:
+		schedule = intervalSchedule(cfg.Interval)
+	default:
+		return nil, errors.New("interval or cron must be set")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TimerClient{
+		schedule: schedule,
+		location: location,
+		topic:    cfg.Topic,
+		payload:  cfg.Payload,
+		ctx:      ctx,
+		cancel:   cancel,
+		logger:   log.With(log.Any("client", "timer")),
+	}, nil
+}
+
+// intervalSchedule ticks at the fixed interval, unlike the one of cron it is not rounded to seconds
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+func (t *TimerClient) SendOrDrop(_ *config.TargetMsg) error {
+	return errors.Trace(ErrSourceOnly)
+}
+
+func (t *TimerClient) SendPubAck(_ mqtt.Packet) error {
+	return nil
+}
+
+func (t *TimerClient) Start(obs mqtt.Observer) error {
+	if obs == nil {
+		return nil
+	}
+	t.done = make(chan struct{})
+	go t.ticking(obs)
+	return nil
+}
+
+// ticking emits the messages until the client is closed, the ticks missed while the observer is busy are skipped
+func (t *TimerClient) ticking(obs mqtt.Observer) {
+	defer close(t.done)
+	var count int
+	for {
+		now := time.Now().In(t.location)
+		timer := time.NewTimer(t.schedule.Next(now).Sub(now))
+		select {
+		case <-t.ctx.Done():
+			timer.Stop()
+			return
+		case tick := <-timer.C:
+			count++
+			pkt := packet.NewPublish()
+			pkt.Message.Topic = t.topic
+			pkt.Message.Payload = []byte(renderTimerPayload(t.payload, tick.In(t.location), count))
+			if err := obs.OnPublish(pkt); err != nil {
+				t.logger.Error("failed to handle timer msg", log.Error(err))
+			}
+		}
+	}
+}
+
+// renderTimerPayload replaces the placeholders of payload by the time of tick
+func renderTimerPayload(payload string, tick time.Time, count int) string {
+	return timerPlaceholder.ReplaceAllStringFunc(payload, func(s string) string {
+		switch name := s[1 : len(s)-1]; name {
+		case "unix":
+			return strconv.FormatInt(tick.Unix(), 10)
+		case "unixMilli":
+			return strconv.FormatInt(tick.UnixNano()/int64(time.Millisecond), 10)
+		case "count":
+			return strconv.Itoa(count)
+		case "timestamp":
+			return tick.Format(time.RFC3339)
+		default:
+			return tick.Format(name[len("timestamp:"):])
+		}
+	})
+}
+
+func (t *TimerClient) ResetClient(_ *mqtt.ClientConfig) {}
+
+func (t *TimerClient) SetReconnectCallback(_ mqtt.ReconnectCallback) {}
+
+// Close stops the ticks
+func (t *TimerClient) Close() error {
+	t.cancel()
+	if t.done != nil {
+		<-t.done
+	}
+	return nil
+}
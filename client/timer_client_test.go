@@ -0,0 +1,57 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/baetyl/baetyl-go/v2/utils"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestTimerClient(t *testing.T) {
+	var cfg TimerClientCfg
+	err := utils.UnmarshalYAML([]byte(`
+interval: 50ms
+topic: timer/heartbeat
+payload: '{"count":{count},"ts":{unixMilli}}'
+`), &cfg)
+	assert.NoError(t, err)
+	cli, err := NewTimerClient(&cfg)
+	assert.NoError(t, err)
+
+	pkts := make(chan *packet.Publish, 10)
+	obs := mqtt.NewObserverWrapper(func(pkt *packet.Publish) error {
+		pkts <- pkt
+		return nil
+	}, nil, nil)
+	assert.NoError(t, cli.Start(obs))
+	for i := 1; i <= 2; i++ {
+		select {
+		case pkt := <-pkts:
+			assert.Equal(t, "timer/heartbeat", pkt.Message.Topic)
+			assert.Regexp(t, `^\{"count":`+string(rune('0'+i))+`,"ts":\d{13}\}$`, string(pkt.Message.Payload))
+		case <-time.After(5 * time.Second):
+			assert.FailNow(t, "receive tick timeout")
+		}
+	}
+	assert.NoError(t, cli.Close())
+	assert.ErrorIs(t, cli.SendOrDrop(&config.TargetMsg{}), ErrSourceOnly)
+
+	tick := time.Date(2023, 4, 5, 6, 7, 8, 9000000, time.UTC)
+	assert.Equal(t, "2023-04-05T06:07:08Z 2023-04-05 1680674828 1680674828009 3 {name}",
+		renderTimerPayload("{timestamp} {timestamp:2006-01-02} {unix} {unixMilli} {count} {name}", tick, 3))
+
+	_, err = NewTimerClient(&TimerClientCfg{Cron: "*/5 * * *", Location: "UTC"})
+	assert.EqualError(t, err, "invalid cron (*/5 * * *): expected exactly 5 fields, found 4: [*/5 * * *]")
+	_, err = NewTimerClient(&TimerClientCfg{Cron: "@hourly", Interval: time.Second, Location: "UTC"})
+	assert.EqualError(t, err, "only one of interval and cron can be set")
+	_, err = NewTimerClient(&TimerClientCfg{Location: "UTC"})
+	assert.EqualError(t, err, "interval or cron must be set")
+	cli, err = NewTimerClient(&TimerClientCfg{Cron: "@hourly", Location: "UTC"})
+	assert.NoError(t, err)
+	assert.NoError(t, cli.Close())
+}
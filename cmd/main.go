@@ -1,51 +1,113 @@
 package main
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/baetyl/baetyl-go/v2/context"
+	"github.com/baetyl/baetyl-go/v2/log"
 
 	"github.com/baetyl/baetyl-rule/v2/config"
 	"github.com/baetyl/baetyl-rule/v2/rule"
 )
 
+// configCheckInterval the interval to check whether the config file is changed
+const configCheckInterval = 5 * time.Second
+
 func main() {
 	context.Run(func(ctx context.Context) error {
 		if err := ctx.CheckSystemCert(); err != nil {
 			return err
 		}
 
-		var cfg config.Config
-		err := ctx.LoadCustomConfig(&cfg)
+		cfg, err := loadConfig(ctx)
 		if err != nil {
 			return err
 		}
 
-		// baetyl-broker client is the mqtt broker in edge
-		systemCert := ctx.SystemConfig().Certificate
-		cfg.Clients = append(cfg.Clients, config.ClientInfo{
-			Name: "baetyl-broker",
-			Kind: config.KindMqtt,
-			Value: map[string]interface{}{
-				"address": fmt.Sprintf("%s://%s:%s", "ssl", context.BrokerHost(), context.BrokerPort()),
-				"ca":      systemCert.CA,
-				"cert":    systemCert.Cert,
-				"key":     systemCert.Key,
-			},
-		})
-
 		function, err := ctx.NewFunctionHttpClient()
 		if err != nil {
 			return err
 		}
 
 		rulers, err := rule.NewRulers(ctx, cfg, function)
-		defer rulers.Close()
 		if err != nil {
 			return err
 		}
+		defer rulers.Close()
 
-		ctx.Wait()
+		watching(ctx, rulers)
 		return nil
 	})
 }
+
+func loadConfig(ctx context.Context) (config.Config, error) {
+	var cfg config.Config
+	err := ctx.LoadCustomConfig(&cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	// baetyl-broker client is the mqtt broker in edge
+	systemCert := ctx.SystemConfig().Certificate
+	cfg.Clients = append(cfg.Clients, config.ClientInfo{
+		Name: "baetyl-broker",
+		Kind: config.KindMqtt,
+		Value: map[string]interface{}{
+			"address": fmt.Sprintf("%s://%s:%s", "ssl", context.BrokerHost(), context.BrokerPort()),
+			"ca":      systemCert.CA,
+			"cert":    systemCert.Cert,
+			"key":     systemCert.Key,
+		},
+	})
+	return cfg, nil
+}
+
+// watching reloads the rules when the config file is changed or SIGHUP is received, until the program exits
+func watching(ctx context.Context, rulers *rule.ClientSet) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+
+	exit := ctx.WaitChan()
+	digest := configDigest(ctx.ConfFile())
+	for {
+		select {
+		case <-exit:
+			return
+		case <-hup:
+			ctx.Log().Info("reload rules on signal")
+		case <-ticker.C:
+			if configDigest(ctx.ConfFile()) == digest {
+				continue
+			}
+			ctx.Log().Info("config file is changed, reload rules")
+		}
+		digest = configDigest(ctx.ConfFile())
+		cfg, err := loadConfig(ctx)
+		if err != nil {
+			ctx.Log().Error("failed to load config", log.Error(err))
+			continue
+		}
+		err = rulers.Reload(cfg)
+		if err != nil {
+			ctx.Log().Error("failed to reload rules", log.Error(err))
+			continue
+		}
+		ctx.Log().Info("rules are reloaded")
+	}
+}
+
+func configDigest(file string) [sha256.Size]byte {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(data)
+}
@@ -0,0 +1,27 @@
+package config
+
+// AuthConfig the credentials accepted by http server and admin server, the caller must present one of them
+// if any is configured
+type AuthConfig struct {
+	// Tokens the static bearer tokens, passed as "Authorization: Bearer <token>"
+	Tokens []TokenCredential `yaml:"tokens" json:"tokens"`
+	// Basic the basic credentials, the username is the identity of caller
+	Basic []BasicCredential `yaml:"basic" json:"basic"`
+}
+
+// Enabled returns true if any credential is configured
+func (c *AuthConfig) Enabled() bool {
+	return len(c.Tokens)+len(c.Basic) > 0
+}
+
+// TokenCredential the bearer token and the identity it stands for
+type TokenCredential struct {
+	Identity string `yaml:"identity" json:"identity" validate:"nonzero"`
+	Token    string `yaml:"token" json:"token" validate:"nonzero"`
+}
+
+// BasicCredential the username and password of basic auth
+type BasicCredential struct {
+	Username string `yaml:"username" json:"username" validate:"nonzero"`
+	Password string `yaml:"password" json:"password" validate:"nonzero"`
+}
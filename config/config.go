@@ -1,9 +1,11 @@
 package config
 
 import (
-	"encoding/json"
+	"sort"
+	"time"
 
 	"github.com/baetyl/baetyl-go/v2/utils"
+	"gopkg.in/yaml.v2"
 )
 
 type Kind string
@@ -11,26 +13,147 @@ type Kind string
 // All kinds
 const (
 	KindMqtt       Kind = "mqtt"
+	KindMqtt5      Kind = "mqtt5"
 	KinkHTTP       Kind = "http"
 	KindHTTPServer Kind = "http-server"
 	KindRabbit     Kind = "rabbit-mq"
 	KindKafka      Kind = "kafka"
 	KindS3         Kind = "s3"
+	KindTimer      Kind = "timer"
 )
 
 const TaskLength = 1024
 
+// The keys of the mqtt 5 properties in the meta of message
+const (
+	MetaContentType     = "ContentType"
+	MetaMessageExpiry   = "MessageExpiry"
+	MetaResponseTopic   = "ResponseTopic"
+	MetaCorrelationData = "CorrelationData"
+	// MetaUserProperties the user properties of message in order, which are []UserProperty
+	MetaUserProperties = "UserProperties"
+	// MetaHeaders the headers set by the envelope of function, which are sent as the headers of http or kafka
+	// targets, or the user properties of mqtt 5 targets
+	MetaHeaders = "Headers"
+)
+
+// UserProperty the mqtt 5 user property, the keys of user properties may repeat
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// UserProperties returns the user properties in meta, which may be decoded from the persistent queue
+func UserProperties(meta map[string]any) []UserProperty {
+	switch v := meta[MetaUserProperties].(type) {
+	case []UserProperty:
+		return v
+	case []any:
+		users := make([]UserProperty, 0, len(v))
+		for _, item := range v {
+			if m, ok := item.(map[string]any); ok {
+				key, _ := m["key"].(string)
+				value, _ := m["value"].(string)
+				users = append(users, UserProperty{Key: key, Value: value})
+			}
+		}
+		return users
+	}
+	return nil
+}
+
+// MergeUserProperties returns the user properties whose keys are replaced by the properties given, which are
+// appended in order of keys, the property given with empty value is removed. The user properties are not changed
+func MergeUserProperties(users []UserProperty, props map[string]string) []UserProperty {
+	merged := make([]UserProperty, 0, len(users)+len(props))
+	for _, u := range users {
+		if _, ok := props[u.Key]; !ok {
+			merged = append(merged, u)
+		}
+	}
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if props[k] != "" {
+			merged = append(merged, UserProperty{Key: k, Value: props[k]})
+		}
+	}
+	return merged
+}
+
+// The policies when a function of rule fails
+const (
+	// OnErrorAbort the message fails, e.g. it is not acknowledged to the source
+	OnErrorAbort = "abort"
+	// OnErrorSkip the function is skipped, its input is passed to the next function
+	OnErrorSkip = "skip"
+	// OnErrorRoute the failure is sent to the error target of function, and the message is not processed any more
+	OnErrorRoute = "route"
+)
+
+// The fallbacks of messages while the circuit breaker of functions is open
+const (
+	// FallbackPass the original payload is sent to the targets without calling the functions
+	FallbackPass = "pass"
+	// FallbackDrop the message is dropped
+	FallbackDrop = "drop"
+	// FallbackRoute the message is sent to the error target of breaker
+	FallbackRoute = "route"
+)
+
+// The contents responded to the callers of http-server rules
+const (
+	ResponseFunction = "function"
+	ResponseTarget   = "target"
+)
+
 type TargetMsg struct {
 	TargetInfo ClientRef
 	Meta       map[string]any
 	Data       []byte
 	Topic      string
+	// Callback is invoked with the result once the delivery is finished, it is not persisted
+	Callback func(err error) `json:"-"`
+	// Response is filled with the response of target before the callback is invoked, if it is set
+	Response *TargetResponse `json:"-"`
+}
+
+// TargetResponse the response of target, e.g. the response of http target
+type TargetResponse struct {
+	StatusCode  int
+	ContentType string
+	Header      map[string]string
+	Body        []byte
+}
+
+// Complete invokes the callback of message if it is set
+func (m *TargetMsg) Complete(err error) {
+	if m.Callback != nil {
+		m.Callback(err)
+	}
 }
 
 // Config config of rule
 type Config struct {
 	Clients []ClientInfo `yaml:"clients" json:"clients"`
 	Rules   []RuleInfo   `yaml:"rules" json:"rules"`
+	// Admin the admin api is served if it is configured
+	Admin *AdminConfig `yaml:"admin" json:"admin"`
+}
+
+// AdminConfig config of admin server
+type AdminConfig struct {
+	// Address the host the admin server listens on, which is localhost by default since the api can disable rules
+	Address string `yaml:"address" json:"address" default:"127.0.0.1"`
+	Port    int32  `yaml:"port" json:"port" validate:"nonzero"`
+	// ClientAuth requires the callers of the api to present a client certificate, like the http server
+	ClientAuth bool `yaml:"clientAuth" json:"clientAuth"`
+	// Auth the credentials accepted from callers, like the http server
+	Auth              AuthConfig `yaml:"auth" json:"auth"`
+	utils.Certificate `yaml:",inline" json:",inline"`
 }
 
 // ClientInfo client info
@@ -40,21 +163,180 @@ type ClientInfo struct {
 	Value map[string]interface{} `yaml:",inline" json:",inline"`
 }
 
-// Parse parse to get real config
+// Parse parse to get real config, the value is converted by yaml instead of json, since json can not parse
+// the durations written as strings like 1s, which are used by the retry, ack timeout and other fields of clients
 func (v *ClientInfo) Parse(in any) error {
-	data, err := json.Marshal(v.Value)
+	data, err := yaml.Marshal(v.Value)
 	if err != nil {
 		return err
 	}
-	return utils.UnmarshalJSON(data, in)
+	return utils.UnmarshalYAML(data, in)
 }
 
 // RuleInfo rule info
 type RuleInfo struct {
-	Name     string        `yaml:"name" json:"name" validate:"nonzero"`
-	Source   *ClientRef    `yaml:"source" json:"source" validate:"nonzero"`
-	Target   *ClientRef    `yaml:"target" json:"target"`
+	Name   string     `yaml:"name" json:"name" validate:"nonzero"`
+	Source *ClientRef `yaml:"source" json:"source" validate:"nonzero"`
+	Target *ClientRef `yaml:"target" json:"target"`
+	// Targets the message processed by function is sent to all targets, together with the target
+	Targets  []ClientRef   `yaml:"targets" json:"targets" default:"[]"`
 	Function *FunctionInfo `yaml:"function" json:"function"`
+	// Functions the functions called in order, the result of a function is the input of the next one,
+	// only one of function and functions can be set
+	Functions []FunctionInfo `yaml:"functions" json:"functions,omitempty" default:"[]"`
+	// FunctionLimits limits the calls of the functions in rule
+	FunctionLimits *FunctionLimits `yaml:"functionLimits" json:"functionLimits,omitempty"`
+	// Select and Where filter and project json payloads in process, before the function is invoked
+	Select string `yaml:"select" json:"select"`
+	Where  string `yaml:"where" json:"where"`
+	// DeadLetter receives the failed message once the target has exhausted its retries
+	DeadLetter *ClientRef `yaml:"deadLetter" json:"deadLetter"`
+	// Response the content responded to the caller of http-server rule, it is "function" for the result of function,
+	// or "target" for the response of the first target which must be http, the caller gets success if it is not set
+	Response string `yaml:"response" json:"response,omitempty"`
+	// Allow the identities of callers permitted to trigger the http-server rule, all callers are permitted if it is empty
+	Allow []string `yaml:"allow" json:"allow,omitempty"`
+	// Routes the message is sent to the targets of the first route whose condition matches, or the default route
+	// if none matches, together with the targets of rule
+	Routes []Route `yaml:"routes" json:"routes,omitempty"`
+}
+
+// Route the targets which the message of rule is sent to if the condition matches
+type Route struct {
+	// When the boolean expression like the where of rule, the route without condition is the default route
+	When    string      `yaml:"when" json:"when,omitempty"`
+	Target  *ClientRef  `yaml:"target" json:"target,omitempty"`
+	Targets []ClientRef `yaml:"targets" json:"targets,omitempty" default:"[]"`
+}
+
+// AllTargets returns the target followed by the targets of route
+func (r *Route) AllTargets() []ClientRef {
+	var targets []ClientRef
+	if r.Target != nil {
+		targets = append(targets, *r.Target)
+	}
+	return append(targets, r.Targets...)
+}
+
+// AllFunctions returns the function, or the functions, of rule
+func (r *RuleInfo) AllFunctions() []FunctionInfo {
+	if r.Function != nil {
+		return append([]FunctionInfo{*r.Function}, r.Functions...)
+	}
+	return r.Functions
+}
+
+// AllTargets returns the target followed by the targets of rule
+func (r *RuleInfo) AllTargets() []ClientRef {
+	var targets []ClientRef
+	if r.Target != nil {
+		targets = append(targets, *r.Target)
+	}
+	return append(targets, r.Targets...)
+}
+
+// Clone returns a deep copy of rule, so that the rule in use is not changed along with the config of caller
+func (r *RuleInfo) Clone() RuleInfo {
+	c := *r
+	c.Source = r.Source.clone()
+	c.Target = r.Target.clone()
+	c.DeadLetter = r.DeadLetter.clone()
+	c.Targets = cloneRefs(r.Targets)
+	if r.Function != nil {
+		fn := r.Function.clone()
+		c.Function = &fn
+	}
+	if r.Functions != nil {
+		c.Functions = make([]FunctionInfo, len(r.Functions))
+		for i, fn := range r.Functions {
+			c.Functions[i] = fn.clone()
+		}
+	}
+	if r.FunctionLimits != nil {
+		limits := *r.FunctionLimits
+		if limits.Breaker != nil {
+			breaker := *limits.Breaker
+			breaker.ErrorTarget = breaker.ErrorTarget.clone()
+			limits.Breaker = &breaker
+		}
+		c.FunctionLimits = &limits
+	}
+	c.Allow = append([]string(nil), r.Allow...)
+	if r.Routes != nil {
+		c.Routes = make([]Route, len(r.Routes))
+		for i, route := range r.Routes {
+			route.Target = route.Target.clone()
+			route.Targets = cloneRefs(route.Targets)
+			c.Routes[i] = route
+		}
+	}
+	return c
+}
+
+func (f FunctionInfo) clone() FunctionInfo {
+	f.ErrorTarget = f.ErrorTarget.clone()
+	return f
+}
+
+func (c *ClientRef) clone() *ClientRef {
+	if c == nil {
+		return nil
+	}
+	ref := *c
+	if c.Properties != nil {
+		props := *c.Properties
+		if props.MessageExpiry != nil {
+			expiry := *props.MessageExpiry
+			props.MessageExpiry = &expiry
+		}
+		if props.UserProperties != nil {
+			props.UserProperties = make(map[string]string, len(c.Properties.UserProperties))
+			for k, v := range c.Properties.UserProperties {
+				props.UserProperties[k] = v
+			}
+		}
+		ref.Properties = &props
+	}
+	if c.Reply != nil {
+		reply := *c.Reply
+		reply.ClientRef = *c.Reply.ClientRef.clone()
+		ref.Reply = &reply
+	}
+	return &ref
+}
+
+func cloneRefs(refs []ClientRef) []ClientRef {
+	if refs == nil {
+		return nil
+	}
+	c := make([]ClientRef, len(refs))
+	for i := range refs {
+		c[i] = *refs[i].clone()
+	}
+	return c
+}
+
+// FunctionLimits the limits of the function calls of rule, which protect the source from a slow or unhealthy function runtime
+type FunctionLimits struct {
+	// Timeout the max time to wait for the result of each function, unless the timeout of function is set
+	Timeout time.Duration `yaml:"timeout" json:"timeout,omitempty"`
+	// MaxInFlight the max number of concurrent calls of rule, the call exceeding it fails at once, 0 means no limit
+	MaxInFlight int `yaml:"maxInFlight" json:"maxInFlight,omitempty"`
+	// Breaker the circuit breaker of function calls, which is disabled if it is not set
+	Breaker *BreakerConfig `yaml:"breaker" json:"breaker,omitempty"`
+}
+
+// BreakerConfig the circuit breaker which opens after consecutive failures of functions, the functions are not called
+// while it is open, and a trial call is permitted once it has been open for a while, which closes it if succeeded
+type BreakerConfig struct {
+	// Failures the number of consecutive failures which opens the breaker
+	Failures int `yaml:"failures" json:"failures" default:"5"`
+	// OpenTimeout the time the breaker keeps open before a trial call is permitted
+	OpenTimeout time.Duration `yaml:"openTimeout" json:"openTimeout" default:"30s"`
+	// Fallback the handling of messages while the breaker is open, which is one of pass, drop (default) and route
+	Fallback string `yaml:"fallback" json:"fallback" default:"drop"`
+	// ErrorTarget receives the messages while the breaker is open if the fallback is route
+	ErrorTarget *ClientRef `yaml:"errorTarget" json:"errorTarget,omitempty"`
 }
 
 type RabbitMQRef struct {
@@ -70,6 +352,17 @@ type HTTPRef struct {
 type MQTTRef struct {
 	QOS   int    `yaml:"qos" json:"qos" default:"0"`
 	Topic string `yaml:"topic" json:"topic" default:""`
+	// Properties the mqtt 5 properties set to the messages sent to target, which override the ones of source
+	Properties *Properties `yaml:"properties" json:"properties,omitempty"`
+}
+
+// Properties the mqtt 5 properties of message, the user property with empty value is removed
+type Properties struct {
+	ContentType     string            `yaml:"contentType" json:"contentType,omitempty"`
+	MessageExpiry   *uint32           `yaml:"messageExpiry" json:"messageExpiry,omitempty"`
+	ResponseTopic   string            `yaml:"responseTopic" json:"responseTopic,omitempty"`
+	CorrelationData string            `yaml:"correlationData" json:"correlationData,omitempty"`
+	UserProperties  map[string]string `yaml:"userProperties" json:"userProperties,omitempty"`
 }
 
 // ClientRef ref to client
@@ -78,9 +371,30 @@ type ClientRef struct {
 	MQTTRef     `yaml:",inline" json:",inline"`
 	HTTPRef     `yaml:",inline" json:",inline"`
 	RabbitMQRef `yaml:",inline" json:",inline"`
+	// Reply the response of http target is published to the reply target if it is set
+	Reply *ReplyRef `yaml:"reply" json:"reply,omitempty"`
+}
+
+// ReplyRef the mqtt target which the response of http target is published to, the topic is taken from
+// the response topic of mqtt 5 source message, the field of source payload, or the topic configured, in order
+type ReplyRef struct {
+	ClientRef `yaml:",inline" json:",inline"`
+	// TopicField the field of json source payload whose value is the reply topic, e.g. "reply.topic"
+	TopicField string `yaml:"topicField" json:"topicField,omitempty"`
+	// CorrelationField the field of json source payload whose value is passed as correlation id of reply
+	CorrelationField string `yaml:"correlationField" json:"correlationField,omitempty"`
 }
 
 // FunctionInfo function info
 type FunctionInfo struct {
 	Name string `yaml:"name" json:"name" validate:"nonzero"`
+	// Envelope the result of function is an envelope, or a list of envelopes, which directs the topic, client,
+	// qos and headers of the messages sent, instead of the payload sent to the targets of rule
+	Envelope bool `yaml:"envelope" json:"envelope,omitempty"`
+	// OnError the policy when the function fails, which is one of abort (default), skip and route
+	OnError string `yaml:"onError" json:"onError,omitempty"`
+	// ErrorTarget receives the failure of function if the policy is route
+	ErrorTarget *ClientRef `yaml:"errorTarget" json:"errorTarget,omitempty"`
+	// Timeout the max time to wait for the result of function, the function fails once it is exceeded
+	Timeout time.Duration `yaml:"timeout" json:"timeout,omitempty"`
 }
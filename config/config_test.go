@@ -1,9 +1,11 @@
 package config
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"path"
 	"testing"
+	"time"
 
 	"github.com/baetyl/baetyl-go/v2/mqtt"
 	"github.com/baetyl/baetyl-go/v2/utils"
@@ -50,3 +52,116 @@ rules:
 	assert.Equal(t, cfg.Cert, "var/db/baetyl/cert/client.pem")
 	assert.Equal(t, cfg.Key, "var/db/baetyl/cert/client.key")
 }
+
+func TestRuleTargets(t *testing.T) {
+	rules := `
+rules:
+  - name: rule1
+    source:
+      topic: broker/topic1
+    target:
+      topic: broker/topic2
+    targets:
+      - client: iotcore
+        topic: iotcore/topic2
+        qos: 1
+      - client: http-client
+        path: /nodes/test
+`
+	var c Config
+	err := utils.UnmarshalYAML([]byte(rules), &c)
+	assert.NoError(t, err)
+	targets := c.Rules[0].AllTargets()
+	assert.Len(t, targets, 3)
+	assert.Equal(t, "baetyl-broker", targets[0].Client)
+	assert.Equal(t, "broker/topic2", targets[0].Topic)
+	assert.Equal(t, "iotcore", targets[1].Client)
+	assert.Equal(t, 1, targets[1].QOS)
+	assert.Equal(t, "http-client", targets[2].Client)
+	assert.Equal(t, "POST", targets[2].Method)
+
+	c.Rules[0].Target = nil
+	assert.Len(t, c.Rules[0].AllTargets(), 2)
+}
+
+func TestRuleInfoClone(t *testing.T) {
+	expiry := uint32(10)
+	rule := RuleInfo{
+		Name:   "rule",
+		Source: &ClientRef{Client: "broker", MQTTRef: MQTTRef{Topic: "in"}},
+		Target: &ClientRef{
+			Client:  "http",
+			HTTPRef: HTTPRef{Path: "/api"},
+			Reply:   &ReplyRef{ClientRef: ClientRef{Client: "broker", MQTTRef: MQTTRef{Topic: "reply"}}},
+		},
+		Targets:        []ClientRef{{Client: "broker", MQTTRef: MQTTRef{Properties: &Properties{MessageExpiry: &expiry, UserProperties: map[string]string{"k": "v"}}}}},
+		Functions:      []FunctionInfo{{Name: "fn", ErrorTarget: &ClientRef{Client: "broker"}}},
+		FunctionLimits: &FunctionLimits{Breaker: &BreakerConfig{ErrorTarget: &ClientRef{Client: "broker"}}},
+		Routes:         []Route{{When: "true", Target: &ClientRef{Client: "broker"}}},
+		Allow:          []string{"device"},
+	}
+	c := rule.Clone()
+	assert.Equal(t, rule, c)
+
+	// the copy is not changed along with the rule
+	rule.Target.Reply.Client = "other"
+	*rule.Targets[0].Properties.MessageExpiry = 20
+	rule.Targets[0].Properties.UserProperties["k"] = "other"
+	rule.Functions[0].ErrorTarget.Client = "other"
+	rule.FunctionLimits.Breaker.ErrorTarget.Client = "other"
+	rule.Routes[0].Target.Client = "other"
+	rule.Allow[0] = "other"
+	assert.Equal(t, "broker", c.Target.Reply.Client)
+	assert.Equal(t, uint32(10), *c.Targets[0].Properties.MessageExpiry)
+	assert.Equal(t, "v", c.Targets[0].Properties.UserProperties["k"])
+	assert.Equal(t, "broker", c.Functions[0].ErrorTarget.Client)
+	assert.Equal(t, "broker", c.FunctionLimits.Breaker.ErrorTarget.Client)
+	assert.Equal(t, "broker", c.Routes[0].Target.Client)
+	assert.Equal(t, "device", c.Allow[0])
+}
+
+func TestUserProperties(t *testing.T) {
+	users := []UserProperty{{Key: "tag", Value: "a"}, {Key: "site", Value: "s1"}, {Key: "tag", Value: "b"}}
+	assert.Equal(t, users, UserProperties(map[string]any{MetaUserProperties: users}))
+	assert.Nil(t, UserProperties(nil))
+
+	// the user properties decoded from the persistent queue are kept in order
+	data, err := json.Marshal(map[string]any{MetaUserProperties: users})
+	assert.NoError(t, err)
+	var meta map[string]any
+	assert.NoError(t, json.Unmarshal(data, &meta))
+	assert.Equal(t, users, UserProperties(meta))
+
+	// the properties given replace the ones with the same keys, and the one with empty value is removed
+	merged := MergeUserProperties(users, map[string]string{"tag": "c", "site": "", "tenant": "t1"})
+	assert.Equal(t, []UserProperty{{Key: "tag", Value: "c"}, {Key: "tenant", Value: "t1"}}, merged)
+	assert.Len(t, users, 3)
+}
+
+func TestClientInfoParse(t *testing.T) {
+	in := `
+clients:
+  - name: iotcore
+    kind: mqtt
+    address: 'tcp://127.0.0.1:1883'
+    timeout: 10s
+    keepalive: 60000000000
+    ca: ca.pem
+    subscriptions:
+      - topic: a
+        qos: 1
+`
+	var cfg Config
+	assert.NoError(t, utils.UnmarshalYAML([]byte(in), &cfg))
+	assert.Len(t, cfg.Clients, 1)
+
+	// the durations may be written as strings, which are not supported by json, the defaults and inline fields are kept
+	var cc mqtt.ClientConfig
+	assert.NoError(t, cfg.Clients[0].Parse(&cc))
+	assert.Equal(t, "tcp://127.0.0.1:1883", cc.Address)
+	assert.Equal(t, 10*time.Second, cc.Timeout)
+	assert.Equal(t, time.Minute, cc.KeepAlive)
+	assert.Equal(t, 3*time.Minute, cc.MaxReconnectInterval)
+	assert.Equal(t, "ca.pem", cc.CA)
+	assert.Equal(t, []mqtt.QOSTopic{{Topic: "a", QOS: 1}}, cc.Subscriptions)
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// The order keys of messages, the messages with the same key are processed in order
+const (
+	// OrderKeyTopic orders the messages by topic
+	OrderKeyTopic = "topic"
+	// OrderKeyPayload the prefix of the field of json payload ordering the messages, e.g. "payload.device.id"
+	OrderKeyPayload = "payload."
+)
+
+// ParseOrderKey returns the field of json payload of the order key, which is empty if the messages are ordered
+// by topic, ok is false if the order key is neither "topic" nor the field of payload
+func ParseOrderKey(key string) (field string, ok bool) {
+	switch {
+	case key == OrderKeyTopic:
+		return "", true
+	case strings.HasPrefix(key, OrderKeyPayload) && len(key) > len(OrderKeyPayload):
+		return key[len(OrderKeyPayload):], true
+	default:
+		return "", false
+	}
+}
+
+// OrderKey returns the order key of message, which is the value of field in json payload,
+// or the topic if the field is empty or not found in payload
+func OrderKey(topic string, payload []byte, field string) string {
+	if field != "" {
+		if v := JSONField(payload, field); v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	return topic
+}
+
+// JSONField returns the value of field in json payload, the field is separated by dots, e.g. "device.id"
+func JSONField(payload []byte, field string) any {
+	var v any
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil
+	}
+	for _, key := range strings.Split(field, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
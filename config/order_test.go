@@ -0,0 +1,42 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOrderKey(t *testing.T) {
+	tests := []struct {
+		key   string
+		field string
+		ok    bool
+	}{
+		{key: "topic", ok: true},
+		{key: "payload.id", field: "id", ok: true},
+		{key: "payload.device.id", field: "device.id", ok: true},
+		{key: "payload."},
+		{key: "id"},
+		{key: ""},
+	}
+	for _, tt := range tests {
+		field, ok := ParseOrderKey(tt.key)
+		assert.Equal(t, tt.field, field, tt.key)
+		assert.Equal(t, tt.ok, ok, tt.key)
+	}
+}
+
+func TestOrderKey(t *testing.T) {
+	payload := []byte(`{"device":{"id":"d1","index":3},"name":"n"}`)
+	assert.Equal(t, "d1", OrderKey("t", payload, "device.id"))
+	assert.Equal(t, "3", OrderKey("t", payload, "device.index"))
+	assert.Equal(t, "n", OrderKey("t", payload, "name"))
+	// the topic is used if the field is empty, not found, or the payload is not json
+	assert.Equal(t, "t", OrderKey("t", payload, ""))
+	assert.Equal(t, "t", OrderKey("t", payload, "device.name"))
+	assert.Equal(t, "t", OrderKey("t", payload, "name.id"))
+	assert.Equal(t, "t", OrderKey("t", []byte("text"), "name"))
+
+	assert.Equal(t, map[string]any{"id": "d1", "index": float64(3)}, JSONField(payload, "device"))
+	assert.Nil(t, JSONField(payload, "unknown"))
+}
@@ -0,0 +1,136 @@
+package rule
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/http"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+// AdminServer serves the admin api, which lists the rules and clients, enables or disables rules at runtime,
+// and exposes the prometheus metrics
+type AdminServer struct {
+	cfg    config.AdminConfig
+	server *http.Server
+	set    *ClientSet
+	logger *log.Logger
+}
+
+// NewAdminServer creates the admin server backed by the live client set
+func NewAdminServer(cfg config.AdminConfig, set *ClientSet) (*AdminServer, error) {
+	if cfg.ClientAuth {
+		if cfg.CA == "" || cfg.Cert == "" || cfg.Key == "" {
+			return nil, errors.New("ca, cert and key of admin server are required by client auth")
+		}
+		cfg.ClientAuthType = tls.RequireAndVerifyClientCert
+	}
+	svc := &AdminServer{
+		cfg:    cfg,
+		set:    set,
+		logger: log.With(log.Any("admin server", cfg.Port)),
+	}
+	svc.server = http.NewServer(http.ServerConfig{
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		Certificate:  cfg.Certificate,
+	}, svc.initRouter())
+	return svc, nil
+}
+
+func (a *AdminServer) initRouter() fasthttp.RequestHandler {
+	router := routing.New()
+	// all the apis including metrics require the credentials of caller if any is configured
+	router.Use(a.authenticate)
+	router.Get("/admin/rules", Wrapper(a.ListRules))
+	router.Get("/admin/clients", Wrapper(a.ListClients))
+	router.Put("/admin/rules/<name>/enable", Wrapper(a.EnableRule))
+	router.Put("/admin/rules/<name>/disable", Wrapper(a.DisableRule))
+	router.Get("/metrics", a.metricsHandler())
+	return router.HandleRequest
+}
+
+func (a *AdminServer) ListRules(_ *routing.Context) (interface{}, error) {
+	return map[string][]RuleStatus{
+		"rules": a.set.Rules(),
+	}, nil
+}
+
+func (a *AdminServer) ListClients(_ *routing.Context) (interface{}, error) {
+	return map[string][]ClientStatus{
+		"clients": a.set.Clients(),
+	}, nil
+}
+
+func (a *AdminServer) EnableRule(ctx *routing.Context) (interface{}, error) {
+	return a.setRuleEnabled(ctx, true)
+}
+
+func (a *AdminServer) DisableRule(ctx *routing.Context) (interface{}, error) {
+	return a.setRuleEnabled(ctx, false)
+}
+
+func (a *AdminServer) setRuleEnabled(ctx *routing.Context, enabled bool) (interface{}, error) {
+	name := ctx.Param("name")
+	err := a.set.SetRuleEnabled(name, enabled)
+	if err != nil {
+		http.RespondMsg(ctx, 404, "RuleNotFound", err.Error())
+		return nil, errors.Trace(err)
+	}
+	a.logger.Info("rule status is changed", log.Any("rule", name), log.Any("enabled", enabled))
+	return map[string]bool{
+		"success": true,
+	}, nil
+}
+
+func (a *AdminServer) authenticate(ctx *routing.Context) error {
+	if _, err := authenticate(&a.cfg.Auth, ctx.RequestCtx); err != nil {
+		ctx.Response.Header.Set(fasthttp.HeaderWWWAuthenticate, `Bearer, Basic realm="baetyl-rule"`)
+		http.RespondMsg(ctx, fasthttp.StatusUnauthorized, "Unauthorized", err.Error())
+		ctx.Abort()
+	}
+	return nil
+}
+
+// metricsHandler serves the metrics of default registry, along with the queues of the clients in client set
+func (a *AdminServer) metricsHandler() routing.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&queueCollector{set: a.set})
+	handler := fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(prometheus.Gatherers{
+		prometheus.DefaultGatherer, registry,
+	}, promhttp.HandlerOpts{}))
+	return func(ctx *routing.Context) error {
+		handler(ctx.RequestCtx)
+		return nil
+	}
+}
+
+func (a *AdminServer) Start() {
+	go func() {
+		address := net.JoinHostPort(a.cfg.Address, strconv.Itoa(int(a.cfg.Port)))
+		a.logger.Info("admin server is running", log.Any("address", address))
+		secure := a.cfg.Cert != "" && a.cfg.Key != ""
+		if err := serve(a.server, address, a.cfg.ClientAuth, secure, a.cfg.Cert, a.cfg.Key); err != nil {
+			a.logger.Error("admin server shutdown", log.Error(err))
+		}
+	}()
+}
+
+func (a *AdminServer) Close() {
+	if a.server != nil {
+		err := a.server.Shutdown()
+		if err != nil {
+			a.logger.Error("failed to shut down admin server")
+		}
+	}
+}
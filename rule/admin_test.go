@@ -0,0 +1,140 @@
+package rule
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestAdmin(t *testing.T) {
+	e := newTestEnv(t)
+	source := e.port("SOURCE_PORT")
+	admin := e.port("ADMIN_PORT")
+	requests := make(chan string, 10)
+	e.router.Post("/admin", func(c *routing.Context) error {
+		requests <- string(c.Request.Body())
+		return nil
+	})
+	e.serveHTTP(nil)
+
+	rules, _ := e.startRules(`
+clients:
+  - name: mock-http
+    kind: http
+    address: '$HTTP'
+  - name: http-source
+    kind: http-server
+    port: $SOURCE_PORT
+rules:
+  - name: rule1
+    source:
+      client: http-source
+    target:
+      client: mock-http
+      path: /admin
+admin:
+  port: $ADMIN_PORT
+`)
+	time.Sleep(500 * time.Millisecond)
+
+	call := func(method string, port int, uri, body string) (int, []byte) {
+		resp, err := httpRequest(nil, method, fmt.Sprintf("http://127.0.0.1:%d%s", port, uri), nil, body)
+		assert.NoError(t, err)
+		return resp.StatusCode(), resp.Body()
+	}
+
+	// the admin server listens on localhost by default
+	assert.Equal(t, "127.0.0.1", rules.admin.cfg.Address)
+
+	code, body := call("GET", admin, "/admin/rules", "")
+	assert.Equal(t, 200, code)
+	var ruleList struct {
+		Rules []RuleStatus `json:"rules"`
+	}
+	assert.NoError(t, json.Unmarshal(body, &ruleList))
+	assert.Len(t, ruleList.Rules, 1)
+	assert.Equal(t, "rule1", ruleList.Rules[0].Name)
+	assert.Equal(t, "mock-http", ruleList.Rules[0].Targets[0].Client)
+	assert.True(t, ruleList.Rules[0].Enabled)
+
+	code, body = call("GET", admin, "/admin/clients", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"clients":[{"name":"http-source","kind":"http-server"},{"name":"mock-http","kind":"http"}]}`, string(body))
+
+	// the disabled rule does not handle messages
+	code, _ = call("PUT", admin, "/admin/rules/rule1/disable", "")
+	assert.Equal(t, 200, code)
+	assert.False(t, rules.Rules()[0].Enabled)
+	code, _ = call("POST", source, "/rules/rule1", `{"temp":1}`)
+	assert.Equal(t, 403, code)
+
+	code, _ = call("PUT", admin, "/admin/rules/rule1/enable", "")
+	assert.Equal(t, 200, code)
+	code, _ = call("POST", source, "/rules/rule1", `{"temp":2}`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"temp":2}`, receiveString(t, requests))
+	assert.Len(t, requests, 0)
+
+	code, _ = call("PUT", admin, "/admin/rules/unknown/disable", "")
+	assert.Equal(t, 404, code)
+
+	// the delivery is recorded once the target has responded
+	assert.Eventually(t, func() bool {
+		_, body = call("GET", admin, "/metrics", "")
+		return strings.Contains(string(body), `baetyl_rule_sent_total{rule="rule1",target="mock-http"}`)
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.Contains(t, string(body), `baetyl_rule_received_total{rule="rule1"}`)
+	assert.Contains(t, string(body), `baetyl_rule_delivery_duration_seconds_count{client="mock-http",result="success"}`)
+	assert.Contains(t, string(body), `baetyl_rule_client_queue_length{client="mock-http"} 0`)
+	assert.Contains(t, string(body), `baetyl_rule_client_in_flight{client="mock-http"} 0`)
+}
+
+func TestAdminAuth(t *testing.T) {
+	e := newTestEnv(t)
+	port := e.port("ADMIN_PORT")
+	e.startRules(`
+admin:
+  port: $ADMIN_PORT
+  auth:
+    tokens:
+      - identity: operator
+        token: token1
+    basic:
+      - username: admin
+        password: pass
+`)
+	time.Sleep(300 * time.Millisecond)
+
+	call := func(method, uri, authorization string) int {
+		var header map[string]string
+		if authorization != "" {
+			header = map[string]string{fasthttp.HeaderAuthorization: authorization}
+		}
+		resp, err := httpRequest(nil, method, fmt.Sprintf("http://127.0.0.1:%d%s", port, uri), header, "")
+		assert.NoError(t, err)
+		return resp.StatusCode()
+	}
+
+	// all the apis require the credentials once they are configured
+	for _, uri := range []string{"/admin/rules", "/admin/clients", "/metrics"} {
+		assert.Equal(t, 401, call("GET", uri, ""), uri)
+		assert.Equal(t, 401, call("GET", uri, "Bearer token2"), uri)
+		assert.Equal(t, 200, call("GET", uri, "Bearer token1"), uri)
+	}
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:pass"))
+	assert.Equal(t, 401, call("PUT", "/admin/rules/unknown/disable", ""))
+	assert.Equal(t, 404, call("PUT", "/admin/rules/unknown/disable", basic))
+
+	// the client auth requires the certificates
+	_, err := NewAdminServer(config.AdminConfig{Port: 8091, ClientAuth: true}, nil)
+	assert.EqualError(t, err, "ca, cert and key of admin server are required by client auth")
+}
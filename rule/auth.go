@@ -0,0 +1,91 @@
+package rule
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/valyala/fasthttp"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+var (
+	errUnauthorized = errors.New("invalid or missing credentials")
+
+	prefixBearer = []byte("Bearer ")
+	prefixBasic  = []byte("Basic ")
+)
+
+// authenticate returns the identity of caller, which is the identity of bearer token, the username of basic auth,
+// or the common name of verified client certificate, the identity is empty if no authentication is configured.
+// The authorization header is ignored if no credentials are configured, e.g. it is set by the proxy
+func authenticate(c *config.AuthConfig, ctx *fasthttp.RequestCtx) (string, error) {
+	credentials := c.Enabled()
+	if header := ctx.Request.Header.Peek(fasthttp.HeaderAuthorization); len(header) != 0 && credentials {
+		switch {
+		case bytes.HasPrefix(header, prefixBearer):
+			token := header[len(prefixBearer):]
+			for _, v := range c.Tokens {
+				if subtle.ConstantTimeCompare(token, []byte(v.Token)) == 1 {
+					return v.Identity, nil
+				}
+			}
+		case bytes.HasPrefix(header, prefixBasic):
+			decoded, err := base64.StdEncoding.DecodeString(string(header[len(prefixBasic):]))
+			if err != nil {
+				return "", errUnauthorized
+			}
+			username, password, ok := bytes.Cut(decoded, []byte(":"))
+			if !ok {
+				return "", errUnauthorized
+			}
+			for _, v := range c.Basic {
+				if subtle.ConstantTimeCompare(username, []byte(v.Username)) == 1 &&
+					subtle.ConstantTimeCompare(password, []byte(v.Password)) == 1 {
+					return v.Username, nil
+				}
+			}
+		}
+		return "", errUnauthorized
+	}
+	// the client certificate is verified against ca during handshake if client auth is enabled
+	if state := ctx.TLSConnectionState(); state != nil && len(state.VerifiedChains) != 0 {
+		return state.VerifiedChains[0][0].Subject.CommonName, nil
+	}
+	if credentials {
+		return "", errUnauthorized
+	}
+	return "", nil
+}
+
+// checkRuleAllow checks that the callers of http server are authenticated if the rule has an allow-list,
+// otherwise the identity of every caller is empty and the rule rejects all of them
+func checkRuleAllow(rule config.RuleInfo, server config.ClientInfo) error {
+	if len(rule.Allow) == 0 {
+		return nil
+	}
+	cfg := new(ServerConfig)
+	if err := server.Parse(cfg); err != nil {
+		return errors.Trace(err)
+	}
+	if !cfg.Auth.Enabled() && !cfg.ClientAuth {
+		return errors.Errorf("allow of rule (%s) requires the callers of http server (%s) to be authenticated, "+
+			"but neither auth tokens, basic credentials nor client auth with ca is configured", rule.Name, server.Name)
+	}
+	return nil
+}
+
+// allowed checks whether the identity may trigger the rule, any caller is allowed if the rule has no allow-list
+func allowed(allow []string, identity string) bool {
+	if len(allow) == 0 {
+		return true
+	}
+	for _, v := range allow {
+		if v == identity {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package rule
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/utils"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestAuthenticate(t *testing.T) {
+	request := func(authorization string) *fasthttp.RequestCtx {
+		var ctx fasthttp.RequestCtx
+		if authorization != "" {
+			ctx.Request.Header.Set(fasthttp.HeaderAuthorization, authorization)
+		}
+		return &ctx
+	}
+	basic := func(username, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	// the caller presents one of the credentials configured
+	auth := &config.AuthConfig{
+		Tokens: []config.TokenCredential{{Identity: "device", Token: "token"}},
+		Basic:  []config.BasicCredential{{Username: "user", Password: "pass"}},
+	}
+	identity, err := authenticate(auth, request("Bearer token"))
+	assert.NoError(t, err)
+	assert.Equal(t, "device", identity)
+	identity, err = authenticate(auth, request(basic("user", "pass")))
+	assert.NoError(t, err)
+	assert.Equal(t, "user", identity)
+	for _, authorization := range []string{"", "Bearer other", basic("user", "other"), "Basic invalid", "Digest token"} {
+		_, err = authenticate(auth, request(authorization))
+		assert.Equal(t, errUnauthorized, err, authorization)
+	}
+
+	// the authorization header is ignored if no credentials are configured
+	auth = &config.AuthConfig{}
+	for _, authorization := range []string{"", "Bearer token", basic("user", "pass"), "Digest token"} {
+		identity, err = authenticate(auth, request(authorization))
+		assert.NoError(t, err, authorization)
+		assert.Empty(t, identity)
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	assert.True(t, allowed(nil, ""))
+	assert.True(t, allowed([]string{"a", "b"}, "b"))
+	assert.False(t, allowed([]string{"a", "b"}, "c"))
+	assert.False(t, allowed([]string{"a"}, ""))
+}
+
+func TestHttpSourceAuth(t *testing.T) {
+	e := newTestEnv(t)
+	port := e.port("SOURCE_PORT")
+	e.router.Post("/api", func(c *routing.Context) error {
+		return nil
+	})
+	e.serveHTTP(nil)
+
+	rules, cfg := e.startRules(`
+clients:
+  - name: mock-http
+    kind: http
+    address: '$HTTP'
+  - name: http-source
+    kind: http-server
+    port: $SOURCE_PORT
+    auth:
+      tokens:
+        - identity: app1
+          token: token1
+      basic:
+        - username: app2
+          password: pass2
+rules:
+  - name: rule-any
+    source:
+      client: http-source
+    target:
+      client: mock-http
+      path: /api
+  - name: rule-app1
+    source:
+      client: http-source
+    target:
+      client: mock-http
+      path: /api
+    allow:
+      - app1
+      - client
+`)
+	time.Sleep(500 * time.Millisecond)
+
+	post := func(cli *fasthttp.Client, scheme, rule string, header map[string]string) int {
+		resp, err := httpRequest(cli, "POST", fmt.Sprintf("%s://localhost:%d/rules/%s", scheme, port, rule), header, `{"temp":1}`)
+		if err != nil {
+			return 0
+		}
+		return resp.StatusCode()
+	}
+	basic := func(username, password string) map[string]string {
+		return map[string]string{"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))}
+	}
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Authorization": "Bearer " + token}
+	}
+
+	tests := []struct {
+		name   string
+		rule   string
+		header map[string]string
+		code   int
+	}{
+		// the caller must present one of the credentials
+		{name: "no credential", rule: "rule-any", code: 401},
+		{name: "unknown token", rule: "rule-any", header: bearer("token2"), code: 401},
+		{name: "wrong password", rule: "rule-any", header: basic("app2", "pass1"), code: 401},
+		{name: "token", rule: "rule-any", header: bearer("token1"), code: 200},
+		{name: "basic", rule: "rule-any", header: basic("app2", "pass2"), code: 200},
+		// only the identities in allow-list may trigger the rule
+		{name: "allowed", rule: "rule-app1", header: bearer("token1"), code: 200},
+		{name: "not allowed", rule: "rule-app1", header: basic("app2", "pass2"), code: 403},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.code, post(nil, "http", tt.rule, tt.header), tt.name)
+	}
+
+	// the client certificate verified against ca is required, its common name is the identity
+	certPath := "../example/var/lib/baetyl/testcert/"
+	cfg.Clients[1].Value = map[string]interface{}{
+		"port":       port,
+		"clientAuth": true,
+		"ca":         certPath + "ca.crt",
+		"cert":       certPath + "server.crt",
+		"key":        certPath + "server.key",
+	}
+	assert.NoError(t, rules.Reload(cfg))
+	time.Sleep(500 * time.Millisecond)
+
+	tlsCli, err := utils.NewTLSConfigClient(utils.Certificate{CA: certPath + "ca.crt"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, post(&fasthttp.Client{TLSConfig: tlsCli}, "https", "rule-any", bearer("token1")))
+	tlsCli, err = utils.NewTLSConfigClient(utils.Certificate{CA: certPath + "ca.crt", Cert: certPath + "client.crt", Key: certPath + "client.key"})
+	assert.NoError(t, err)
+	cli := &fasthttp.Client{TLSConfig: tlsCli}
+	assert.Equal(t, 200, post(cli, "https", "rule-any", nil))
+	assert.Equal(t, 200, post(cli, "https", "rule-app1", nil))
+	// the authorization header is ignored once no credentials are configured, the identity is taken from the certificate
+	assert.Equal(t, 200, post(cli, "https", "rule-app1", basic("app2", "pass2")))
+
+	// the allow-list requires the callers to be authenticated
+	cfg.Clients[1].Value = map[string]interface{}{"port": port}
+	assert.EqualError(t, rules.Reload(cfg), "allow of rule (rule-app1) requires the callers of http server (http-source) to be authenticated, "+
+		"but neither auth tokens, basic credentials nor client auth with ca is configured")
+
+	// the allow-list is only supported by http-server
+	cfg.Rules[1].Source = &config.ClientRef{Client: "mock-http"}
+	assert.EqualError(t, rules.Reload(cfg), "allow of rule (rule-app1) is only supported by http-server source")
+}
@@ -0,0 +1,178 @@
+package rule
+
+import (
+	"sync"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/http"
+	"github.com/baetyl/baetyl-go/v2/log"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+var (
+	// errFunctionBusy the call exceeds the max in-flight calls of rule
+	errFunctionBusy = errors.New("too many function calls in flight")
+	// errBreakerOpen the call is rejected since the circuit breaker of rule is open
+	errBreakerOpen = errors.New("circuit breaker of functions is open")
+)
+
+// functionGuard applies the limits of rule to its function calls
+type functionGuard struct {
+	rule    string
+	timeout time.Duration
+	slots   chan struct{} // nil if the in-flight calls are not limited
+	breaker *breaker      // nil if the breaker is disabled
+}
+
+func newFunctionGuard(rule string, limits *config.FunctionLimits) *functionGuard {
+	g := &functionGuard{rule: rule}
+	if limits == nil {
+		return g
+	}
+	g.timeout = limits.Timeout
+	if limits.MaxInFlight > 0 {
+		g.slots = make(chan struct{}, limits.MaxInFlight)
+	}
+	if limits.Breaker != nil {
+		g.breaker = newBreaker(rule, limits.Breaker)
+	}
+	return g
+}
+
+// call calls the function if it is permitted by the limits, the timeout of function overrides the one of rule.
+// The calls rejected by the limits are not regarded as the failures of breaker
+func (g *functionGuard) call(functionClient *http.Client, fn config.FunctionInfo, data []byte) ([]byte, error) {
+	if g.breaker != nil && !g.breaker.allow() {
+		functionRejected.WithLabelValues(g.rule, "open").Inc()
+		return nil, errBreakerOpen
+	}
+	if g.slots != nil {
+		select {
+		case g.slots <- struct{}{}:
+		default:
+			functionRejected.WithLabelValues(g.rule, "busy").Inc()
+			if g.breaker != nil {
+				g.breaker.release()
+			}
+			return nil, errFunctionBusy
+		}
+	}
+	functionInFlight.WithLabelValues(g.rule).Inc()
+	// the slot is held until the call returns, since the call timed out is still running in the runtime
+	release := func() {
+		functionInFlight.WithLabelValues(g.rule).Dec()
+		if g.slots != nil {
+			<-g.slots
+		}
+	}
+	if fn.Timeout <= 0 {
+		fn.Timeout = g.timeout
+	}
+	start := time.Now()
+	out, err := callFunction(functionClient, fn, data, release)
+	functionDuration.WithLabelValues(fn.Name).Observe(time.Since(start).Seconds())
+	if g.breaker != nil {
+		g.breaker.done(err)
+	}
+	return out, err
+}
+
+// The states of circuit breaker, which are the values of its metric
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStates = []string{"closed", "open", "half-open"}
+
+// breaker the circuit breaker of function calls, it opens after consecutive failures, and permits
+// a trial call once it has been open for a while, then the result of trial closes or opens it again
+type breaker struct {
+	rule        string
+	threshold   int
+	openTimeout time.Duration
+	mu          sync.Mutex
+	state       int
+	failures    int
+	openedAt    time.Time
+	trial       bool // a trial call is in flight while the breaker is half-open
+	logger      *log.Logger
+}
+
+func newBreaker(rule string, cfg *config.BreakerConfig) *breaker {
+	b := &breaker{
+		rule:        rule,
+		threshold:   cfg.Failures,
+		openTimeout: cfg.OpenTimeout,
+		logger:      log.With(log.Any("rule", rule)),
+	}
+	functionBreakerState.WithLabelValues(rule).Set(breakerClosed)
+	return b
+}
+
+// allow returns whether the call is permitted, only one trial call is permitted while the breaker is half-open
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openTimeout {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// release gives up the call permitted, which is not made
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.trial = false
+	}
+}
+
+// done records the result of call permitted
+func (b *breaker) done(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.trial = false
+		if b.state != breakerClosed {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.trial = false
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+func (b *breaker) setState(state int) {
+	if b.state != state {
+		logf := b.logger.Info
+		if state == breakerOpen {
+			logf = b.logger.Warn
+		}
+		logf("circuit breaker of functions changes", log.Any("from", breakerStates[b.state]), log.Any("to", breakerStates[state]), log.Any("failures", b.failures))
+	}
+	b.state = state
+	functionBreakerState.WithLabelValues(b.rule).Set(float64(state))
+}
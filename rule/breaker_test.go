@@ -0,0 +1,197 @@
+package rule
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker("rule-breaker", &config.BreakerConfig{Failures: 2, OpenTimeout: 100 * time.Millisecond})
+
+	// it opens after consecutive failures
+	assert.True(t, b.allow())
+	b.done(errors.New("failed"))
+	assert.True(t, b.allow())
+	b.done(nil)
+	assert.True(t, b.allow())
+	b.done(errors.New("failed"))
+	assert.True(t, b.allow())
+	b.done(errors.New("failed"))
+	assert.Equal(t, breakerOpen, b.state)
+	assert.False(t, b.allow())
+
+	// only one trial call is permitted once it has been open for a while
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, b.allow())
+	assert.Equal(t, breakerHalfOpen, b.state)
+	assert.False(t, b.allow())
+	b.done(errors.New("failed"))
+	assert.Equal(t, breakerOpen, b.state)
+	assert.False(t, b.allow())
+
+	// the trial given up is permitted again, and the succeeded trial closes it
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, b.allow())
+	b.release()
+	assert.True(t, b.allow())
+	b.done(nil)
+	assert.Equal(t, breakerClosed, b.state)
+	assert.True(t, b.allow())
+}
+
+func TestFunctionLimits(t *testing.T) {
+	e := newTestEnv(t)
+	var healthy int32
+	e.router.Post("/flaky", func(c *routing.Context) error {
+		if atomic.LoadInt32(&healthy) == 0 {
+			return errors.New("unhealthy")
+		}
+		c.SetBodyString("result")
+		return nil
+	})
+	e.router.Post("/slow", func(c *routing.Context) error {
+		time.Sleep(300 * time.Millisecond)
+		c.SetBodyString("slow")
+		return nil
+	})
+	e.serveHTTP(nil)
+	functionClient := e.functionClient()
+	time.Sleep(100 * time.Millisecond)
+
+	info := config.RuleInfo{
+		Name:      "rule-limits",
+		Functions: []config.FunctionInfo{{Name: "flaky"}},
+		FunctionLimits: &config.FunctionLimits{
+			Timeout:     100 * time.Millisecond,
+			MaxInFlight: 1,
+			Breaker:     &config.BreakerConfig{Failures: 2, OpenTimeout: 200 * time.Millisecond, Fallback: config.FallbackPass},
+		},
+	}
+	r, err := newRuler(info)
+	assert.NoError(t, err)
+
+	// the failures are handled by the policy of function until the breaker opens, then the original payload is passed
+	for i := 0; i < 2; i++ {
+		_, err = r.callFunctions(functionClient, []byte("payload"))
+		assert.EqualError(t, err, "failed to call function (flaky): [500] unhealthy")
+	}
+	data, err := r.callFunctions(functionClient, []byte("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", string(data))
+
+	// the trial call closes the breaker once the function runtime is healthy
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(200 * time.Millisecond)
+	data, err = r.callFunctions(functionClient, []byte("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, "result", string(data))
+	assert.Equal(t, breakerClosed, r.guard.breaker.state)
+
+	// the message is dropped, or routed to the error target while the breaker is open
+	r.guard.breaker.done(errors.New("failed"))
+	r.guard.breaker.done(errors.New("failed"))
+	info.FunctionLimits.Breaker.Fallback = config.FallbackDrop
+	data, err = r.callFunctions(functionClient, []byte("payload"))
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+	target := &config.ClientRef{Client: "broker", MQTTRef: config.MQTTRef{Topic: "errors"}}
+	info.FunctionLimits.Breaker.Fallback = config.FallbackRoute
+	info.FunctionLimits.Breaker.ErrorTarget = target
+	_, err = r.callFunctions(functionClient, []byte("payload"))
+	re, ok := err.(*routedError)
+	assert.True(t, ok)
+	assert.Equal(t, target, re.target)
+	assert.Equal(t, "flaky", re.Function)
+	assert.Equal(t, errBreakerOpen.Error(), re.Error())
+	assert.Equal(t, "payload", string(re.Payload))
+
+	// the call exceeding the max in-flight calls fails at once, and the slow call times out
+	r, err = newRuler(config.RuleInfo{
+		Name:           "rule-limits",
+		Functions:      []config.FunctionInfo{{Name: "slow", OnError: config.OnErrorSkip}},
+		FunctionLimits: &config.FunctionLimits{Timeout: 100 * time.Millisecond, MaxInFlight: 1},
+	})
+	assert.NoError(t, err)
+	out, err := r.guard.call(functionClient, config.FunctionInfo{Name: "slow", Timeout: time.Second}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "slow", string(out))
+	go r.guard.call(functionClient, config.FunctionInfo{Name: "slow", Timeout: time.Second}, nil)
+	time.Sleep(50 * time.Millisecond)
+	_, err = r.guard.call(functionClient, config.FunctionInfo{Name: "slow"}, nil)
+	assert.Equal(t, errFunctionBusy, err)
+	time.Sleep(300 * time.Millisecond)
+	_, err = r.guard.call(functionClient, config.FunctionInfo{Name: "slow"}, nil)
+	assert.EqualError(t, err, "no result in 100ms")
+	// the slot of call timed out is held until the call returns in the runtime
+	_, err = r.guard.call(functionClient, config.FunctionInfo{Name: "slow", Timeout: time.Second}, nil)
+	assert.Equal(t, errFunctionBusy, err)
+	time.Sleep(250 * time.Millisecond)
+	out, err = r.guard.call(functionClient, config.FunctionInfo{Name: "slow", Timeout: time.Second}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "slow", string(out))
+	data, err = r.callFunctions(functionClient, []byte("payload"))
+	assert.NoError(t, err)
+	assert.Equal(t, "payload", string(data))
+
+	// the limits are checked
+	details := map[string]*ClientDetail{"broker": {Name: "broker", Info: config.ClientInfo{Name: "broker", Kind: config.KindMqtt}}}
+	info.FunctionLimits.Breaker.ErrorTarget = nil
+	assert.EqualError(t, checkFunctionLimits(info, details), "error target of breaker in rule (rule-limits) is required by the fallback (route)")
+	info.FunctionLimits.Breaker.ErrorTarget = &config.ClientRef{Client: "unknown"}
+	assert.EqualError(t, checkFunctionLimits(info, details), "client (unknown) not found in rule (rule-limits)")
+	info.FunctionLimits.Breaker.Fallback = "retry"
+	assert.EqualError(t, checkFunctionLimits(info, details), "fallback (retry) of breaker in rule (rule-limits) is not supported")
+	info.FunctionLimits.Breaker.Failures = 0
+	assert.EqualError(t, checkFunctionLimits(info, details), "failures and openTimeout of breaker in rule (rule-limits) must be positive")
+	info.FunctionLimits.MaxInFlight = -1
+	assert.EqualError(t, checkFunctionLimits(info, details), "timeout and maxInFlight of function limits in rule (rule-limits) must not be negative")
+}
+
+func TestFunctionLimitsReload(t *testing.T) {
+	e := newTestEnv(t)
+	e.startBroker(5 * time.Second)
+	conf := `
+clients:
+  - name: mock-broker
+    kind: mqtt
+    address: '$BROKER'
+rules:
+  - name: rule-limits
+    source:
+      client: mock-broker
+      topic: limits/in
+    target:
+      client: mock-broker
+      topic: limits/out
+    function:
+      name: flaky
+    functionLimits:
+      breaker:
+        failures: 2
+        openTimeout: 1m
+`
+	rules, cfg := e.startRules(conf)
+	guard := rules.plan.ruler("rule-limits").guard
+	guard.breaker.done(errors.New("failed"))
+	guard.breaker.done(errors.New("failed"))
+	assert.Equal(t, breakerOpen, guard.breaker.state)
+
+	// the breaker keeps open if the limits are unchanged
+	cfg.Rules[0].Target.Topic = "limits/changed"
+	assert.NoError(t, rules.Reload(cfg))
+	assert.Same(t, guard, rules.plan.ruler("rule-limits").guard)
+	assert.Equal(t, breakerOpen, guard.breaker.state)
+
+	// the breaker is reset once the limits are changed
+	cfg.Rules[0].FunctionLimits.Breaker.Failures = 3
+	assert.NoError(t, rules.Reload(cfg))
+	assert.NotSame(t, guard, rules.plan.ruler("rule-limits").guard)
+	assert.Equal(t, breakerClosed, rules.plan.ruler("rule-limits").guard.breaker.state)
+}
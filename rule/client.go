@@ -2,6 +2,7 @@ package rule
 
 import (
 	"github.com/256dpi/gomqtt/packet"
+	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/http"
 	"github.com/baetyl/baetyl-go/v2/log"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
@@ -11,58 +12,173 @@ import (
 )
 
 type SingleClient struct {
-	name    string
-	client  client.Client
-	rulers  map[string]config.RuleInfo // key: rule name
-	subTree *mqtt.Trie
-	logger  *log.Logger
+	name   string
+	client client.Client
+	cfg    SourceConfig
+	pool   *workerPool // nil if the messages are processed one by one
+	set    *ClientSet
+	logger *log.Logger
 }
 
-func (l *SingleClient) Start(clients map[string]*SingleClient, functionClient *http.Client) error {
-	var err error
-	if l.subTree.Count() == 0 {
+// Start starts the client, it observes the messages if any rule subscribes to it, and
+// the messages are routed by the current routes of client set, which may be reloaded
+func (l *SingleClient) Start(source *sourceRoutes, functionClient *http.Client) error {
+	if source.subTree.Count() == 0 {
 		return l.client.Start(nil)
 	}
-	err = l.client.Start(mqtt.NewObserverWrapper(func(pkt *packet.Publish) error {
-		data := pkt.Message.Payload
-		rulers := l.subTree.Match(pkt.Message.Topic)
-		for _, v := range rulers {
-			ruleName := v.(string)
-			rule := l.rulers[ruleName]
-			source := l.client
-			target, _ := clients[rule.Target.Client]
-			l.logger.Debug("process source pkt", log.Any("topic", pkt.Message.Topic), log.Any("id", pkt.ID))
-			if rule.Function != nil {
-				l.logger.Debug("call function", log.Any("function", rule.Function.Name))
-				data, err = functionClient.Call(rule.Function.Name, pkt.Message.Payload)
-				if err != nil {
-					l.logger.Error("error occured when invoke function in source", log.Any("function", rule.Function.Name), log.Error(err))
-					return nil
-				}
-				pkt.Message.Payload = data
+	handle := func(pkt *packet.Publish, meta map[string]any) error {
+		return l.onPublish(pkt, meta, functionClient)
+	}
+	if l.cfg.Workers > 1 {
+		pool, err := newWorkerPool(l.cfg)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		l.pool = pool
+		// the message is processed by the worker of its order key, the error is logged by the worker,
+		// and the message is not acknowledged to the source
+		handle = func(pkt *packet.Publish, meta map[string]any) error {
+			pool.submit(pool.orderKey(pkt), func() {
+				l.onPublish(pkt, meta, functionClient)
+			})
+			return nil
+		}
+	}
+	// the observer may be invoked concurrently by sources like rabbit-mq consumers
+	return l.client.Start(&sourceObserver{
+		Observer: mqtt.NewObserverWrapper(func(pkt *packet.Publish) error {
+			return handle(pkt, nil)
+		}, func(*packet.Puback) error {
+			return nil
+		}, func(err error) {
+			l.logger.Error("error occurs in source", log.Error(err))
+		}),
+		onPublish: handle,
+	})
+}
+
+// Close closes the client, then stops the workers
+func (l *SingleClient) Close() error {
+	err := l.client.Close()
+	if l.pool != nil {
+		l.pool.close()
+	}
+	return errors.Trace(err)
+}
+
+// onPublish routes the message of source to the matched rules, the properties of source message,
+// e.g. the mqtt 5 properties, are passed along with the meta of packet
+func (l *SingleClient) onPublish(pkt *packet.Publish, props map[string]any, functionClient *http.Client) error {
+	var ack *acker
+	if pkt.Message.QOS == 1 {
+		id := pkt.ID
+		ack = newAcker(func() {
+			puback := packet.NewPuback()
+			puback.ID = id
+			if err := l.client.SendPubAck(puback); err != nil {
+				l.logger.Error("error occured when send puback in source", log.Error(err))
 			}
-			if rule.Target != nil && len(data) != 0 {
-				out := generatePackage(config.KindMqtt, pkt, rule.Source, rule.Target)
-				err = target.client.SendOrDrop(out)
-				if err != nil {
-					l.logger.Error("error occurred when send pkt to target in source", log.Error(err))
+		}, func() {
+			// the source without nack, e.g. mqtt, redelivers the packet not acknowledged
+			if nacker, ok := l.client.(client.Nacker); ok {
+				if err := nacker.SendNack(id); err != nil {
+					l.logger.Error("error occured when send nack in source", log.Error(err))
 				}
-				l.logger.Debug("send pkt to target in source", log.Any("pkt", out))
 			}
-			if pkt.Message.QOS == 1 {
-				puback := packet.NewPuback()
-				puback.ID = pkt.ID
-				err = source.SendPubAck(puback)
-				if err != nil {
-					l.logger.Error("error occured when send puback in source", log.Error(err))
+		})
+	}
+	meta := packetMeta(pkt)
+	for k, v := range props {
+		meta[k] = v
+	}
+	var rulers []interface{}
+	rs := l.set.loadRoutes()
+	source, ok := rs.sources[l.name]
+	if ok {
+		rulers = source.subTree.Match(pkt.Message.Topic)
+	}
+	// a failed rule does not stop the others, the failure is recorded and returned after all rules are processed
+	var failed error
+	for _, v := range rulers {
+		ruleName := v.(string)
+		rule := source.rulers[ruleName]
+		if !l.set.ruleEnabled(rule.Name) {
+			continue
+		}
+		l.logger.Debug("process source pkt", log.Any("topic", pkt.Message.Topic), log.Any("id", pkt.ID))
+		// each rule processes the original payload
+		data, err := rule.process(functionClient, pkt.Message.Topic, meta, pkt.Message.Payload)
+		// the failure of function routed to its error target is handled once it is delivered
+		if re, ok := err.(*routedError); ok {
+			var callback func(error)
+			if ack != nil {
+				callback = ack.add()
+			}
+			if err = sendFunctionError(rs, rule, re, nil, callback, l.logger); err == nil {
+				continue
+			}
+			if ack != nil {
+				ack.done(err)
+			}
+		}
+		if err != nil {
+			l.logger.Error("error occured when process pkt in source", log.Any("rule", rule.Name), log.Error(err))
+			if ack != nil {
+				ack.fail()
+			}
+			failed = err
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+		deliveries, err := rule.deliveries(pkt.Message.Topic, meta, data, rs.clients)
+		if err != nil {
+			l.logger.Error("error occured when route pkt in source", log.Any("rule", rule.Name), log.Error(err))
+			if ack != nil {
+				ack.fail()
+			}
+			failed = err
+			continue
+		}
+		for i := range deliveries {
+			target := &deliveries[i].target
+			out := generatePackage(config.KindMqtt, pkt, meta, nil, rule.Name, rule.Source, target)
+			deliveries[i].apply(out)
+			// the source is acked only after all targets have confirmed the delivery
+			if ack != nil {
+				out.Callback = ack.add()
+			}
+			if target.Reply != nil {
+				reply := generatePackage(config.KindMqtt, pkt, meta, nil, rule.Name, rule.Source, &target.Reply.ClientRef)
+				setReply(rule.Name, target.Reply, out, reply, pkt.Message.Payload, rs.clients[target.Reply.Client], l.logger)
+			}
+			if rule.DeadLetter != nil {
+				setDeadLetter(rule.RuleInfo, out, rs.clients[rule.DeadLetter.Client], l.logger)
+			}
+			err := sendToTarget(rs.clients[target.Client], rule.Name, out)
+			if err != nil {
+				l.logger.Error("error occurred when send pkt to target in source", log.Any("target", target.Client), log.Error(err))
+				if ack != nil {
+					ack.done(err)
 				}
+				continue
 			}
+			l.logger.Debug("send pkt to target in source", log.Any("pkt", out))
 		}
-		return nil
-	}, func(*packet.Puback) error {
-		return nil
-	}, func(err error) {
-		l.logger.Error("error occurs in source", log.Error(err))
-	}))
-	return err
+	}
+	if ack != nil {
+		ack.done(nil)
+	}
+	return errors.Trace(failed)
+}
+
+// sourceObserver observes the messages of source client, including the meta of messages
+type sourceObserver struct {
+	mqtt.Observer
+	onPublish func(pkt *packet.Publish, meta map[string]any) error
+}
+
+func (o *sourceObserver) OnPublishWithMeta(pkt *packet.Publish, meta map[string]any) error {
+	return o.onPublish(pkt, meta)
 }
@@ -0,0 +1,52 @@
+package rule
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceFailedRule(t *testing.T) {
+	e := newTestEnv(t)
+	e.startBroker(5 * time.Second)
+	e.router.Post("/fail", func(c *routing.Context) error {
+		return errors.New("func error")
+	})
+	e.serveHTTP(nil)
+	e.startRules(`
+clients:
+  - name: mock-broker
+    kind: mqtt
+    address: '$BROKER'
+rules:
+  - name: rule-fail
+    source:
+      client: mock-broker
+      topic: multi/in
+    target:
+      client: mock-broker
+      topic: multi/fail
+    function:
+      name: fail
+  - name: rule-ok
+    source:
+      client: mock-broker
+      topic: multi/in
+    target:
+      client: mock-broker
+      topic: multi/ok
+`)
+	cli := e.connect("failed-rule", mqtt.Subscription{Topic: "multi/ok", QOS: 0})
+
+	// the other rules matched are processed whatever the order of rules is
+	for _, payload := range []string{"1", "2", "3", "4", "5"} {
+		assert.NoError(t, cli.pub(newPublishPacket(0, 0, "multi/in", payload)))
+		msg := cli.receive().Message
+		assert.Equal(t, "multi/ok", msg.Topic)
+		assert.Equal(t, payload, string(msg.Payload))
+	}
+}
@@ -1,12 +1,16 @@
 package rule
 
 import (
+	"encoding/json"
+	goerrors "errors"
 	"fmt"
-	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/baetyl/baetyl-go/v2/context"
 	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
 
 	"github.com/baetyl/baetyl-rule/v2/client"
@@ -23,6 +27,13 @@ func NewClient(ctx context.Context, clientDetail *ClientDetail) (s client.Client
 		cfg.CleanSession = true
 		cfg.Subscriptions = clientDetail.Subscription
 		s, err = client.NewMqttClient(cfg)
+	case config.KindMqtt5:
+		cfg := new(client.Mqtt5ClientCfg)
+		err = clientDetail.Info.Parse(cfg)
+		cfg.ClientID = generateClientID(ctx.AppName(), clientDetail.Name)
+		cfg.DisableAutoAck = true
+		cfg.Subscriptions = clientDetail.Subscription
+		s, err = client.NewMqtt5Client(cfg)
 	case config.KinkHTTP:
 		cfg := new(client.HTTPClientCfg)
 		err = clientDetail.Info.Parse(cfg)
@@ -30,6 +41,14 @@ func NewClient(ctx context.Context, clientDetail *ClientDetail) (s client.Client
 	case config.KindRabbit:
 		cfg := new(client.RabbitClientCfg)
 		err = clientDetail.Info.Parse(cfg)
+		for _, source := range clientDetail.Sources {
+			cfg.Subscriptions = append(cfg.Subscriptions, client.RabbitSubscription{
+				Queue:      source.Topic,
+				Exchange:   source.Exchange,
+				RoutingKey: source.RoutingKey,
+				QOS:        uint32(source.QOS),
+			})
+		}
 		s, err = client.NewRabbitClient(ctx, cfg)
 	case config.KindS3:
 		cfg := new(client.S3ClientCfg)
@@ -38,51 +57,217 @@ func NewClient(ctx context.Context, clientDetail *ClientDetail) (s client.Client
 	case config.KindKafka:
 		cfg := new(client.KafkaClientCfg)
 		err = clientDetail.Info.Parse(cfg)
+		cfg.Subscriptions = clientDetail.Subscription
+		if cfg.GroupID == "" && len(cfg.Subscriptions) != 0 {
+			cfg.GroupID = generateClientID(ctx.AppName(), clientDetail.Name)
+		}
 		s, err = client.NewKafkaClient(ctx, cfg)
+	case config.KindTimer:
+		cfg := new(client.TimerClientCfg)
+		err = clientDetail.Info.Parse(cfg)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if cfg.Topic == "" {
+			cfg.Topic = clientDetail.Name
+		}
+		s, err = client.NewTimerClient(cfg)
 	default:
 		err = errors.Trace(errors.Errorf("client kind (%s) is not supported", clientDetail.Info.Kind))
 	}
 	return s, err
 }
 
+// DeadLetter the message sent to the dead letter target of rule
+type DeadLetter struct {
+	Rule     string    `json:"rule"`
+	Client   string    `json:"client"`
+	Topic    string    `json:"topic"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Time     time.Time `json:"time"`
+	Payload  []byte    `json:"payload"`
+}
+
+// setDeadLetter sets the callback of message, which sends the original payload with the error
+// to the dead letter target of rule once the delivery failed, the original callback is passed
+// to the dead letter, so that a message is regarded as handled once its dead letter is delivered
+func setDeadLetter(rule config.RuleInfo, msg *config.TargetMsg, deadLetter client.Client, logger *log.Logger) {
+	if rule.DeadLetter == nil || deadLetter == nil {
+		return
+	}
+	callback := msg.Callback
+	msg.Callback = func(err error) {
+		msg.Callback = callback
+		if err == nil {
+			msg.Complete(nil)
+			return
+		}
+		dl := DeadLetter{
+			Rule:     rule.Name,
+			Client:   msg.TargetInfo.Client,
+			Topic:    msg.Topic,
+			Error:    err.Error(),
+			Attempts: 1,
+			Time:     time.Now().UTC(),
+			Payload:  msg.Data,
+		}
+		var de *client.DeliveryError
+		if goerrors.As(err, &de) {
+			dl.Attempts = de.Attempts
+			dl.Error = de.Err.Error()
+		}
+		data, merr := json.Marshal(dl)
+		if merr != nil {
+			logger.Error("failed to marshal dead letter", log.Any("rule", rule.Name), log.Error(merr))
+			msg.Complete(err)
+			return
+		}
+		out := generatePackage(config.KinkHTTP, data, nil, nil, rule.Name, rule.Source, rule.DeadLetter)
+		out.Callback = callback
+		serr := sendToTarget(deadLetter, rule.Name, out)
+		if serr != nil {
+			logger.Error("failed to send dead letter", log.Any("rule", rule.Name), log.Error(serr))
+			msg.Complete(err)
+			return
+		}
+		logger.Debug("send dead letter", log.Any("rule", rule.Name), log.Any("client", rule.DeadLetter.Client))
+	}
+}
+
+// acker sends the puback of a source packet exactly once, after the packet has been
+// delivered to the targets of all matched rules, the nack is sent instead if any delivery fails
+type acker struct {
+	pending int32
+	failed  int32
+	ack     func()
+	nack    func()
+}
+
+// newAcker creates an acker holding a delivery, which must be finished by done when all deliveries are added
+func newAcker(ack, nack func()) *acker {
+	return &acker{pending: 1, ack: ack, nack: nack}
+}
+
+// add adds a delivery and returns its callback
+func (a *acker) add() func(err error) {
+	atomic.AddInt32(&a.pending, 1)
+	return a.done
+}
+
+// fail marks the packet as failed without finishing a delivery, the nack is sent once all deliveries are finished
+func (a *acker) fail() {
+	atomic.StoreInt32(&a.failed, 1)
+}
+
+func (a *acker) done(err error) {
+	if err != nil {
+		atomic.StoreInt32(&a.failed, 1)
+	}
+	if atomic.AddInt32(&a.pending, -1) != 0 {
+		return
+	}
+	if atomic.LoadInt32(&a.failed) == 0 {
+		a.ack()
+	} else {
+		a.nack()
+	}
+}
+
 func generateClientID(appName, name string) string {
 	return fmt.Sprintf("%s-%s", appName, name)
 }
 
-func generatePackage(k config.Kind, pkt any, source *config.ClientRef, target *config.ClientRef) *config.TargetMsg {
+// generatePackage generates the message sent to target, the meta of source message is copied,
+// and the mqtt 5 properties of target are set to the meta
+func generatePackage(k config.Kind, pkt any, meta map[string]any, params map[string]string, rule string, source *config.ClientRef, target *config.ClientRef) *config.TargetMsg {
 	msg := &config.TargetMsg{
 		TargetInfo: *target,
-		Meta:       map[string]any{},
+		Meta:       make(map[string]any, len(meta)),
+	}
+	for key, v := range meta {
+		msg.Meta[key] = v
+	}
+	var client, filter, topic string
+	if source != nil {
+		client, filter = source.Client, source.Topic
 	}
 	switch k {
 	case config.KindMqtt:
 		origin := pkt.(*packet.Publish)
 		msg.Data = origin.Message.Payload
-		msg.Topic = RegularPubTopic(source.Topic, origin.Message.Topic, target.Topic, target.Path)
-		msg.Meta["ID"] = origin.ID
-		msg.Meta["Dup"] = origin.Dup
-		msg.Meta["QoS"] = origin.Message.QOS
-		msg.Meta["Retain"] = origin.Message.Retain
+		topic = origin.Message.Topic
 	case config.KinkHTTP:
-		origin := pkt.([]byte)
-		msg.Data = origin
-		msg.Topic = RegularPubTopic("", "", target.Topic, target.Path)
+		msg.Data = pkt.([]byte)
 	}
+	vars := newTopicVars(rule, client, filter, topic, params)
+	msg.Topic = targetTopic(vars, target)
+	setProperties(msg.Meta, target.Properties, vars)
 	return msg
 }
 
+// setProperties sets the mqtt 5 properties of target to meta, the placeholders of topic are supported in the
+// string properties, the user properties are merged into the ones of source, and the ones with empty value are removed
+func setProperties(meta map[string]any, props *config.Properties, vars *topicVars) {
+	if props == nil {
+		return
+	}
+	if props.ContentType != "" {
+		meta[config.MetaContentType] = vars.render(props.ContentType)
+	}
+	if props.MessageExpiry != nil {
+		meta[config.MetaMessageExpiry] = *props.MessageExpiry
+	}
+	if props.ResponseTopic != "" {
+		meta[config.MetaResponseTopic] = vars.render(props.ResponseTopic)
+	}
+	if props.CorrelationData != "" {
+		meta[config.MetaCorrelationData] = []byte(vars.render(props.CorrelationData))
+	}
+	if len(props.UserProperties) == 0 {
+		return
+	}
+	rendered := make(map[string]string, len(props.UserProperties))
+	for k, v := range props.UserProperties {
+		rendered[k] = vars.render(v)
+	}
+	meta[config.MetaUserProperties] = config.MergeUserProperties(config.UserProperties(meta), rendered)
+}
+
+// propertiesTemplates returns the properties of target which may have placeholders
+func propertiesTemplates(props *config.Properties) []string {
+	if props == nil {
+		return nil
+	}
+	tpls := []string{props.ContentType, props.ResponseTopic, props.CorrelationData}
+	for _, v := range props.UserProperties {
+		tpls = append(tpls, v)
+	}
+	return tpls
+}
+
+// packetMeta returns the meta of mqtt packet which is passed to the target
+func packetMeta(pkt *packet.Publish) map[string]any {
+	return map[string]any{
+		"ID":     pkt.ID,
+		"Dup":    pkt.Dup,
+		"QoS":    pkt.Message.QOS,
+		"Retain": pkt.Message.Retain,
+	}
+}
+
+// RegularPubTopic replaces the wildcards of pub or path by the levels of actual topic matched by the wildcards of source topic
 func RegularPubTopic(source, actual, pub, path string) string {
 	if path != "" {
 		pub = path
 	}
-	index := strings.Index(pub, "+")
-	if index == -1 {
-		return pub
-	}
-	sourceStr := strings.Split(source, "+")
-	if len(sourceStr) != 2 {
-		return pub
+	return newTopicVars("", "", source, actual, nil).render(pub)
+}
+
+// targetTopic returns the topic, or the path if set, of target, whose placeholders are replaced
+func targetTopic(vars *topicVars, target *config.ClientRef) string {
+	if target.Path != "" {
+		return vars.render(target.Path)
 	}
-	replace := strings.TrimSuffix(strings.TrimPrefix(actual, sourceStr[0]), sourceStr[1])
-	return strings.Replace(pub, "+", replace, 1)
+	return vars.render(target.Topic)
 }
@@ -0,0 +1,334 @@
+package rule
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestAcker(t *testing.T) {
+	var acks, nacks int
+	newTestAcker := func() *acker {
+		acks, nacks = 0, 0
+		return newAcker(func() { acks++ }, func() { nacks++ })
+	}
+
+	// the ack is sent once all deliveries are confirmed
+	a := newTestAcker()
+	cb1, cb2 := a.add(), a.add()
+	a.done(nil)
+	cb2(nil)
+	assert.Equal(t, 0, acks)
+	cb1(nil)
+	assert.Equal(t, 1, acks)
+	assert.Equal(t, 0, nacks)
+
+	// the nack is sent once all deliveries are finished if any of them fails
+	a = newTestAcker()
+	cb1, cb2 = a.add(), a.add()
+	cb1(errors.New("failed"))
+	a.done(nil)
+	assert.Equal(t, 0, nacks)
+	cb2(nil)
+	assert.Equal(t, 0, acks)
+	assert.Equal(t, 1, nacks)
+
+	// the message failed to be processed is nacked
+	a = newTestAcker()
+	a.done(errors.New("failed"))
+	assert.Equal(t, 0, acks)
+	assert.Equal(t, 1, nacks)
+	// the failure of a rule is recorded, the nack is sent once the other deliveries are finished
+	a = newTestAcker()
+	cb1 = a.add()
+	a.fail()
+	a.done(nil)
+	assert.Equal(t, 0, nacks)
+	cb1(nil)
+	assert.Equal(t, 0, acks)
+	assert.Equal(t, 1, nacks)
+}
+
+func TestGeneratePackage(t *testing.T) {
+	pkt := packet.NewPublish()
+	pkt.ID = 3
+	pkt.Message = packet.Message{Topic: "site/s1", Payload: []byte("hello"), QOS: 1}
+	meta := packetMeta(pkt)
+	meta[config.MetaContentType] = "text/plain"
+	meta[config.MetaUserProperties] = []config.UserProperty{{Key: "tenant", Value: "t1"}, {Key: "debug", Value: "true"}, {Key: "site", Value: "s0"}, {Key: "site", Value: "s2"}}
+
+	expiry := uint32(30)
+	source := &config.ClientRef{Client: "broker", MQTTRef: config.MQTTRef{Topic: "site/+"}}
+	target := &config.ClientRef{Client: "iothub", MQTTRef: config.MQTTRef{Topic: "cloud/{1}", Properties: &config.Properties{
+		MessageExpiry:  &expiry,
+		ResponseTopic:  "cloud/{1}/reply",
+		UserProperties: map[string]string{"site": "{1}", "debug": ""},
+	}}}
+	msg := generatePackage(config.KindMqtt, pkt, meta, nil, "rule1", source, target)
+	assert.Equal(t, "cloud/s1", msg.Topic)
+	assert.Equal(t, []byte("hello"), msg.Data)
+	assert.Equal(t, map[string]any{
+		"ID":                      mqtt.ID(3),
+		"Dup":                     false,
+		"QoS":                     mqtt.QOS(1),
+		"Retain":                  false,
+		config.MetaContentType:    "text/plain",
+		config.MetaMessageExpiry:  uint32(30),
+		config.MetaResponseTopic:  "cloud/s1/reply",
+		config.MetaUserProperties: []config.UserProperty{{Key: "tenant", Value: "t1"}, {Key: "site", Value: "s1"}},
+	}, msg.Meta)
+	// the meta of source is not changed
+	assert.Equal(t, []config.UserProperty{{Key: "tenant", Value: "t1"}, {Key: "debug", Value: "true"}, {Key: "site", Value: "s0"}, {Key: "site", Value: "s2"}}, meta[config.MetaUserProperties])
+}
+
+// queueEnv the test env whose $QUEUE is the path of persistent queue, or empty to queue in memory
+func queueEnv(t *testing.T, persistent bool) *testEnv {
+	e := newTestEnv(t)
+	e.vars["QUEUE"] = ""
+	if persistent {
+		e.vars["QUEUE"] = path.Join(e.dir, "queue.db")
+	}
+	return e
+}
+
+func TestRuleDeadLetter(t *testing.T) {
+	tests := []struct {
+		name       string
+		persistent bool
+	}{
+		{name: "memory"},
+		{name: "persistent", persistent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := queueEnv(t, tt.persistent)
+			e.startBroker(5 * time.Second)
+
+			attempts := make(chan string, 10)
+			e.router.Post("/unavailable", func(c *routing.Context) error {
+				attempts <- "unavailable"
+				c.SetStatusCode(503)
+				return nil
+			})
+			e.router.Post("/bad", func(c *routing.Context) error {
+				attempts <- "bad"
+				c.SetStatusCode(400)
+				return nil
+			})
+			e.serveHTTP(nil)
+
+			rules, cfg := e.startRules(`
+clients:
+  - name: mock-broker
+    kind: mqtt
+    address: '$BROKER'
+  - name: mock-http
+    kind: http
+    address: '$HTTP'
+    retry:
+      maxAttempts: 3
+      min: 10ms
+      max: 20ms
+    queue:
+      path: '$QUEUE'
+rules:
+  - name: rule-retry
+    source:
+      client: mock-broker
+      topic: dl/retry
+    target:
+      client: mock-http
+      path: /unavailable
+    deadLetter:
+      client: mock-broker
+      topic: dl/dead
+  - name: rule-permanent
+    source:
+      client: mock-broker
+      topic: dl/permanent
+    target:
+      client: mock-http
+      path: /bad
+    deadLetter:
+      client: mock-broker
+      topic: dl/dead
+`)
+			cli := e.connect("dead-letter", mqtt.Subscription{Topic: "dl/dead", QOS: 0})
+
+			assertDeadLetter := func(rule string, attempts int, payload string) {
+				var dl DeadLetter
+				assert.NoError(t, json.Unmarshal(cli.receive().Message.Payload, &dl))
+				assert.Equal(t, rule, dl.Rule)
+				assert.Equal(t, "mock-http", dl.Client)
+				assert.Equal(t, attempts, dl.Attempts)
+				assert.Equal(t, payload, string(dl.Payload))
+				assert.NotEmpty(t, dl.Error)
+			}
+
+			// the dead letters are counted by the metrics of target like the other deliveries
+			sent := testutil.ToFloat64(ruleSent.WithLabelValues("rule-retry", "mock-broker"))
+
+			// retryable status code is retried until the attempts are exhausted
+			assert.NoError(t, cli.pub(newPublishPacket(0, 0, "dl/retry", `{"temp":1}`)))
+			assertDeadLetter("rule-retry", 3, `{"temp":1}`)
+			assert.Eventually(t, func() bool {
+				return testutil.ToFloat64(ruleSent.WithLabelValues("rule-retry", "mock-broker")) == sent+1
+			}, time.Second, 10*time.Millisecond)
+			assert.Len(t, attempts, 3)
+			for len(attempts) > 0 {
+				assert.Equal(t, "unavailable", <-attempts)
+			}
+
+			// permanent status code is not retried
+			assert.NoError(t, cli.pub(newPublishPacket(0, 0, "dl/permanent", `{"temp":2}`)))
+			assertDeadLetter("rule-permanent", 1, `{"temp":2}`)
+			assert.Len(t, attempts, 1)
+
+			// the file of persistent queue can not be shared by clients
+			if tt.persistent {
+				assertConfigErrors(t, rules, cfg, []configError{{
+					change: func(cfg *config.Config) {
+						cfg.Clients = append(cfg.Clients, config.ClientInfo{Name: "mock-http2", Kind: config.KinkHTTP, Value: map[string]any{
+							"address": e.vars["HTTP"],
+							"queue":   map[string]any{"path": e.dir + "/./queue.db"},
+						}})
+					},
+					err: "queue path (" + e.dir + "/./queue.db) of client (mock-http2) is already used by client (mock-http)",
+				}})
+			}
+		})
+	}
+}
+
+func TestRuleQOS1Ack(t *testing.T) {
+	tests := []struct {
+		name       string
+		persistent bool
+		// the rule with the http target only, whose source is not lowered by the qos of mqtt targets
+		httpOnly bool
+		// the message is forwarded on every delivery of source, but only once if it is queued persistently
+		forwards int
+	}{
+		{name: "memory", forwards: 3},
+		{name: "persistent", persistent: true, forwards: 1},
+		{name: "http only", httpOnly: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := queueEnv(t, tt.persistent)
+			e.startBroker(time.Second)
+
+			// the target fails twice, then succeeds
+			requests := make(chan string, 10)
+			var count int32
+			e.router.Post("/ack", func(c *routing.Context) error {
+				requests <- string(c.Request.Body())
+				if atomic.AddInt32(&count, 1) <= 2 {
+					c.SetStatusCode(503)
+				}
+				return nil
+			})
+			e.serveHTTP(nil)
+
+			conf := `
+clients:
+  - name: mock-broker
+    kind: mqtt
+    address: '$BROKER'
+  - name: mock-http
+    kind: http
+    address: '$HTTP'
+    retry:
+      min: 10ms
+      max: 20ms
+    queue:
+      path: '$QUEUE'
+rules:
+  - name: rule-http
+    source:
+      client: mock-broker
+      topic: ack/topic
+      qos: 1
+    target:
+      client: mock-http
+      path: /ack
+`
+			if !tt.httpOnly {
+				conf += `
+  - name: rule-mqtt
+    source:
+      client: mock-broker
+      topic: ack/topic
+      qos: 1
+    target:
+      client: mock-broker
+      topic: ack/forward
+      qos: 1
+`
+			}
+			e.startRules(conf)
+			cli := e.connect("qos1-ack", mqtt.Subscription{Topic: "ack/forward", QOS: 0})
+
+			// the message is redelivered by the source, or retried from the persistent queue, until all targets have confirmed it
+			assert.NoError(t, cli.pub(newPublishPacket(1, 1, "ack/topic", `{"temp":1}`)))
+			for i := 0; i < 3; i++ {
+				assert.Equal(t, `{"temp":1}`, receiveString(t, requests))
+			}
+			select {
+			case body := <-requests:
+				assert.Fail(t, "unexpected redelivery", body)
+			case <-time.After(3 * time.Second):
+			}
+			assert.Equal(t, tt.forwards, len(cli.s2c))
+		})
+	}
+
+	// the source is lowered to the highest qos of targets only if they are all mqtt
+	e := newTestEnv(t)
+	p, err := newPlan(e.config(`
+clients:
+  - name: mock-broker
+    kind: mqtt
+  - name: mock-kafka
+    kind: kafka
+  - name: mock-http
+    kind: http
+rules:
+  - name: rule-mqtt-http
+    source:
+      client: mock-broker
+      topic: a
+      qos: 1
+    target:
+      client: mock-http
+  - name: rule-mqtt-mqtt
+    source:
+      client: mock-broker
+      topic: b
+      qos: 1
+    target:
+      client: mock-broker
+      topic: c
+  - name: rule-kafka-http
+    source:
+      client: mock-kafka
+      topic: kt
+      qos: 1
+    target:
+      client: mock-http
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []mqtt.QOSTopic{{QOS: 1, Topic: "a"}, {QOS: 0, Topic: "b"}}, p.details["mock-broker"].Subscription)
+	assert.Equal(t, []mqtt.QOSTopic{{QOS: 1, Topic: "kt"}}, p.details["mock-kafka"].Subscription)
+}
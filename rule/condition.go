@@ -0,0 +1,78 @@
+package rule
+
+import (
+	"encoding/json"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+// conditionalRoute the targets of route and its compiled condition, the default route has no condition
+type conditionalRoute struct {
+	when    *vm.Program
+	targets []config.ClientRef
+}
+
+// newConditionalRoutes compiles the routes of rule, only one default route is allowed
+func newConditionalRoutes(info config.RuleInfo) ([]*conditionalRoute, *conditionalRoute, error) {
+	var routes []*conditionalRoute
+	var def *conditionalRoute
+	for i, route := range info.Routes {
+		r := &conditionalRoute{targets: route.Targets}
+		if route.When == "" {
+			if def != nil {
+				return nil, nil, errors.Errorf("rule (%s) has more than one default route", info.Name)
+			}
+			def = r
+			continue
+		}
+		program, err := expr.Compile(route.When, expr.AsBool())
+		if err != nil {
+			return nil, nil, errors.Errorf("failed to compile condition (%s) of route (%d) in rule (%s): %s", route.When, i, info.Name, err.Error())
+		}
+		r.when = program
+		routes = append(routes, r)
+	}
+	return routes, def, nil
+}
+
+// targets returns the targets of rule, followed by the targets of the first route matched by the processed
+// payload, the topic and meta of source message. The condition is evaluated like the where of rule, but the
+// payload which is not json is allowed and passed as string
+func (r *Ruler) targets(topic string, meta map[string]any, data []byte) ([]config.ClientRef, error) {
+	if len(r.routes) == 0 && r.defaultRoute == nil {
+		return r.Targets, nil
+	}
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		value = string(data)
+	}
+	env := sqlEnv(topic, meta, value)
+	route := r.defaultRoute
+	for _, v := range r.routes {
+		ok, err := expr.Run(v.when, env)
+		if err != nil {
+			return nil, errors.Errorf("failed to evaluate route condition: %s", err.Error())
+		}
+		if ok.(bool) {
+			route = v
+			break
+		}
+	}
+	if route == nil {
+		return r.Targets, nil
+	}
+	return append(r.Targets[:len(r.Targets):len(r.Targets)], route.targets...), nil
+}
+
+// allTargets returns the targets of rule and all its routes
+func allTargets(info config.RuleInfo) []config.ClientRef {
+	targets := info.Targets
+	for _, route := range info.Routes {
+		targets = append(targets[:len(targets):len(targets)], route.Targets...)
+	}
+	return targets
+}
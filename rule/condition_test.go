@@ -0,0 +1,105 @@
+package rule
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestRuleRoutes(t *testing.T) {
+	e := newTestEnv(t)
+	e.startBroker(5 * time.Second)
+	rules, cfg := e.startRules(`
+clients:
+  - name: mock-broker
+    kind: mqtt
+    address: '$BROKER'
+rules:
+  - name: rule-routes
+    source:
+      client: mock-broker
+      topic: sensors/+/data
+    target:
+      client: mock-broker
+      topic: all/{1}
+    routes:
+      - when: severity == "critical"
+        target:
+          client: mock-broker
+          topic: alarm/{1}
+      - when: split(topic, "/")[1] == "line2" || meta.Retain
+        targets:
+          - client: mock-broker
+            topic: line2/{1}
+      - target:
+          client: mock-broker
+          topic: telemetry/{1}
+  - name: rule-no-default
+    source:
+      client: mock-broker
+      topic: raw/+
+    routes:
+      - when: payload == "ping"
+        target:
+          client: mock-broker
+          topic: pong/{1}
+`)
+	cli := e.connect("routes",
+		mqtt.Subscription{Topic: "all/#", QOS: 0},
+		mqtt.Subscription{Topic: "alarm/#", QOS: 0},
+		mqtt.Subscription{Topic: "line2/#", QOS: 0},
+		mqtt.Subscription{Topic: "telemetry/#", QOS: 0},
+		mqtt.Subscription{Topic: "pong/#", QOS: 0},
+	)
+
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		// the topics of messages routed, in order
+		routed []string
+	}{
+		// the targets of rule are always sent, together with the first route matched
+		{name: "first route", topic: "sensors/line2/data", payload: `{"severity":"critical"}`, routed: []string{"alarm/line2", "all/line2"}},
+		{name: "second route", topic: "sensors/line2/data", payload: `{"severity":"info"}`, routed: []string{"all/line2", "line2/line2"}},
+		// the default route is used if none matches, the payload which is not json is allowed
+		{name: "default route", topic: "sensors/line1/data", payload: `hello`, routed: []string{"all/line1", "telemetry/line1"}},
+	}
+	for _, tt := range tests {
+		assert.NoError(t, cli.pub(newPublishPacket(0, 0, tt.topic, tt.payload)), tt.name)
+		var topics []string
+		for range tt.routed {
+			topics = append(topics, cli.receive().Message.Topic)
+		}
+		sort.Strings(topics)
+		assert.Equal(t, tt.routed, topics, tt.name)
+	}
+
+	// the message is dropped if no route matches and the rule has no targets
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "raw/r1", `"pong"`)))
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "raw/r2", `"ping"`)))
+	assert.Equal(t, "pong/r2", cli.receive().Message.Topic)
+
+	// only one default route is allowed, and the conditions must be boolean expressions
+	assertConfigErrors(t, rules, cfg, []configError{
+		{
+			change: func(cfg *config.Config) {
+				cfg.Rules[1].Routes = append(cfg.Rules[1].Routes, config.Route{}, config.Route{})
+			},
+			err: "rule (rule-no-default) has more than one default route",
+		},
+		{
+			change: func(cfg *config.Config) {
+				cfg.Rules[1].Routes = []config.Route{{When: "true", Target: &config.ClientRef{Client: "unknown"}}}
+			},
+			err: "client (unknown) not found in rule (rule-no-default)",
+		},
+	})
+	cfg.Rules[1].Routes = []config.Route{{When: "1 + 1", Target: &config.ClientRef{Client: "mock-broker"}}}
+	assert.ErrorContains(t, rules.Reload(cfg), "failed to compile condition (1 + 1) of route (0) in rule (rule-no-default)")
+}
@@ -0,0 +1,149 @@
+package rule
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+
+	"github.com/baetyl/baetyl-rule/v2/client"
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+// Envelope the message directed by the result of function whose envelope is enabled, the result is an envelope
+// or a list of envelopes, e.g. {"topic": "alarm/1", "client": "iothub", "payload": {"temp": 90}}
+type Envelope struct {
+	// Topic the topic, or the path of http target, of message, the one of target is used if it is not set
+	Topic string `json:"topic"`
+	// Client the client which the message is sent to, the message is sent to the targets of rule if it is not set
+	Client string `json:"client"`
+	// QOS the qos of message sent to mqtt target, the one of target is used if it is not set
+	QOS *int `json:"qos"`
+	// Payload the payload of message, the json string is sent unquoted, and others are sent as json
+	Payload json.RawMessage `json:"payload"`
+	// Headers the headers of http or kafka target, or the user properties of mqtt 5 target
+	Headers map[string]string `json:"headers"`
+}
+
+// delivery the message sent to a target of rule
+type delivery struct {
+	target   config.ClientRef
+	data     []byte
+	envelope *Envelope
+}
+
+// apply sets the topic and headers of envelope to the message generated for the target, the topic of
+// envelope is used as it is, without replacing the placeholders
+func (d *delivery) apply(msg *config.TargetMsg) {
+	msg.Data = d.data
+	if d.envelope == nil {
+		return
+	}
+	if d.envelope.Topic != "" {
+		msg.Topic = d.envelope.Topic
+	}
+	if len(d.envelope.Headers) != 0 {
+		msg.Meta[config.MetaHeaders] = d.envelope.Headers
+	}
+}
+
+// deliveries returns the messages sent by rule. The processed payload is sent to the targets routed, unless the
+// envelope of function is enabled, then the payload of each envelope is sent to the client of envelope, or to the
+// targets routed by the payload if no client is set. No message is sent if the envelopes are empty
+func (r *Ruler) deliveries(topic string, meta map[string]any, data []byte, clients map[string]client.Client) ([]delivery, error) {
+	if !envelopeEnabled(r.RuleInfo) {
+		targets, err := r.targets(topic, meta, data)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		res := make([]delivery, len(targets))
+		for i, target := range targets {
+			res[i] = delivery{target: target, data: data}
+		}
+		return res, nil
+	}
+	envelopes, err := parseEnvelopes(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var res []delivery
+	for i := range envelopes {
+		env := &envelopes[i]
+		payload := env.payload()
+		var targets []config.ClientRef
+		if env.Client != "" {
+			if _, ok := clients[env.Client]; !ok {
+				return nil, errors.Errorf("client (%s) of envelope not found in rule (%s)", env.Client, r.Name)
+			}
+			targets = []config.ClientRef{r.targetOf(env.Client)}
+		} else {
+			targets, err = r.targets(topic, meta, payload)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		for _, target := range targets {
+			if env.Topic != "" {
+				target.Topic = env.Topic
+				target.Path = ""
+			}
+			if env.QOS != nil {
+				target.QOS = *env.QOS
+			}
+			res = append(res, delivery{target: target, data: payload, envelope: env})
+		}
+	}
+	return res, nil
+}
+
+// targetOf returns the first target of rule referring to the client, so that its settings like the method of
+// http target are kept, or a target with the default settings if the client is not a target of rule
+func (r *Ruler) targetOf(name string) config.ClientRef {
+	for _, target := range allTargets(r.RuleInfo) {
+		if target.Client == name {
+			return target
+		}
+	}
+	return config.ClientRef{Client: name, HTTPRef: config.HTTPRef{Method: "POST"}}
+}
+
+// parseEnvelopes parses the result of function, which is an envelope or a list of envelopes
+func parseEnvelopes(data []byte) ([]Envelope, error) {
+	var envelopes []Envelope
+	data = bytes.TrimSpace(data)
+	if len(data) != 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &envelopes); err != nil {
+			return nil, errors.Errorf("invalid envelopes of function: %s", err.Error())
+		}
+	} else {
+		var env Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			return nil, errors.Errorf("invalid envelope of function: %s", err.Error())
+		}
+		envelopes = append(envelopes, env)
+	}
+	for _, env := range envelopes {
+		if env.QOS != nil && *env.QOS != 0 && *env.QOS != 1 {
+			return nil, errors.Errorf("qos (%d) of envelope must be 0 or 1", *env.QOS)
+		}
+	}
+	return envelopes, nil
+}
+
+// payload returns the payload of envelope sent to the target
+func (e *Envelope) payload() []byte {
+	var s string
+	if err := json.Unmarshal(e.Payload, &s); err == nil {
+		return []byte(s)
+	}
+	if bytes.Equal(e.Payload, []byte("null")) {
+		return nil
+	}
+	return e.Payload
+}
+
+// envelopeEnabled returns whether the result of the last function in rule is an envelope
+func envelopeEnabled(info config.RuleInfo) bool {
+	fns := info.AllFunctions()
+	return len(fns) != 0 && fns[len(fns)-1].Envelope
+}
@@ -0,0 +1,90 @@
+package rule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestParseEnvelopes(t *testing.T) {
+	envelopes, err := parseEnvelopes([]byte(`{"qos":2}`))
+	assert.EqualError(t, err, "qos (2) of envelope must be 0 or 1")
+	assert.Nil(t, envelopes)
+	_, err = parseEnvelopes([]byte(`"text"`))
+	assert.ErrorContains(t, err, "invalid envelope of function")
+}
+
+func TestFunctionEnvelope(t *testing.T) {
+	e := newTestEnv(t)
+	e.startBroker(5 * time.Second)
+
+	// the function responds with the envelopes in the payload of message
+	hooks := make(chan string, 10)
+	e.router.Post("/echo", func(c *routing.Context) error {
+		c.SetBody(c.Request.Body())
+		return nil
+	})
+	e.router.Post("/<path>", func(c *routing.Context) error {
+		hooks <- string(c.Path()) + " " + string(c.Request.Header.Peek("X-Trace")) + " " + string(c.Request.Body())
+		return nil
+	})
+	e.serveHTTP(nil)
+
+	rules, cfg := e.startRules(`
+clients:
+  - name: mock-broker
+    kind: mqtt
+    address: '$BROKER'
+  - name: mock-http
+    kind: http
+    address: '$HTTP'
+rules:
+  - name: rule-envelope
+    source:
+      client: mock-broker
+      topic: envelope/+
+    target:
+      client: mock-broker
+      topic: default/{1}
+    function:
+      name: echo
+      envelope: true
+`)
+	cli := e.connect("envelope", mqtt.Subscription{Topic: "default/#", QOS: 0}, mqtt.Subscription{Topic: "dynamic/#", QOS: 0})
+
+	assertMessage := func(topic, payload string) {
+		msg := cli.receive().Message
+		assert.Equal(t, topic, msg.Topic)
+		assert.Equal(t, payload, string(msg.Payload))
+	}
+
+	// the envelope without client is sent to the targets of rule, with the topic of envelope if it is set
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "envelope/a", `{"topic":"dynamic/a","payload":{"v":1}}`)))
+	assertMessage("dynamic/a", `{"v":1}`)
+
+	// a list of envelopes emits many messages, the string payload is unquoted
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "envelope/b", `[
+		{"payload":"text"},
+		{"client":"mock-http","topic":"/hook","headers":{"X-Trace":"t1"},"payload":{"v":2}}
+	]`)))
+	assertMessage("default/b", "text")
+	assert.Equal(t, `/hook t1 {"v":2}`, receiveString(t, hooks))
+
+	// no message is emitted by the empty list, or the envelope with unknown client
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "envelope/c", `[]`)))
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "envelope/d", `{"client":"unknown","payload":1}`)))
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "envelope/e", `{"qos":1}`)))
+	assertMessage("default/e", "")
+
+	// the rule with envelope can not respond with the response of target
+	cfg.Clients = append(cfg.Clients, config.ClientInfo{Name: "http-source", Kind: config.KindHTTPServer, Value: map[string]interface{}{"port": e.port("SOURCE_PORT")}})
+	cfg.Rules[0].Source = &config.ClientRef{Client: "http-source"}
+	cfg.Rules[0].Target = &config.ClientRef{Client: "mock-http"}
+	cfg.Rules[0].Response = config.ResponseTarget
+	assert.EqualError(t, rules.Reload(cfg), "response (target) of rule (rule-envelope) is not supported by the envelope of function")
+}
@@ -0,0 +1,211 @@
+package rule
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/http"
+	"github.com/baetyl/baetyl-go/v2/log"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+// FunctionError the message sent to the error target once a function of rule fails
+type FunctionError struct {
+	Rule     string    `json:"rule"`
+	Function string    `json:"function"`
+	Step     int       `json:"step"` // the index of function in rule, starting from 0
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+	Payload  []byte    `json:"payload"` // the input of function
+}
+
+// routedError the failure of function whose policy is route, it is sent to the error target by the source
+type routedError struct {
+	FunctionError
+	target *config.ClientRef
+}
+
+func (e *routedError) Error() string {
+	return e.FunctionError.Error
+}
+
+// callFunctions calls the functions of rule in order, the result of a function is the input of the next one,
+// an empty result means the message is filtered out. The failure of function is handled by its policy
+func (r *Ruler) callFunctions(functionClient *http.Client, data []byte) ([]byte, error) {
+	payload := data
+	for i, fn := range r.Functions {
+		out, err := r.guard.call(functionClient, fn, data)
+		if err == errBreakerOpen {
+			return r.fallback(i, fn, payload, data)
+		}
+		if err != nil {
+			ruleFunctionErrors.WithLabelValues(r.Name).Inc()
+			switch fn.OnError {
+			case config.OnErrorSkip:
+				continue
+			case config.OnErrorRoute:
+				return nil, &routedError{
+					FunctionError: FunctionError{
+						Rule:     r.Name,
+						Function: fn.Name,
+						Step:     i,
+						Error:    err.Error(),
+						Time:     time.Now().UTC(),
+						Payload:  data,
+					},
+					target: fn.ErrorTarget,
+				}
+			default:
+				return nil, errors.Errorf("failed to call function (%s): %s", fn.Name, err.Error())
+			}
+		}
+		if len(out) == 0 {
+			ruleFiltered.WithLabelValues(r.Name).Inc()
+			return nil, nil
+		}
+		data = out
+	}
+	return data, nil
+}
+
+// fallback handles the message while the circuit breaker of rule is open, the original payload is passed
+// to the targets, or the message is dropped, or it is sent to the error target of breaker with the input of function
+func (r *Ruler) fallback(step int, fn config.FunctionInfo, payload, data []byte) ([]byte, error) {
+	breaker := r.FunctionLimits.Breaker
+	switch breaker.Fallback {
+	case config.FallbackPass:
+		return payload, nil
+	case config.FallbackRoute:
+		return nil, &routedError{
+			FunctionError: FunctionError{
+				Rule:     r.Name,
+				Function: fn.Name,
+				Step:     step,
+				Error:    errBreakerOpen.Error(),
+				Time:     time.Now().UTC(),
+				Payload:  data,
+			},
+			target: breaker.ErrorTarget,
+		}
+	default:
+		ruleFiltered.WithLabelValues(r.Name).Inc()
+		return nil, nil
+	}
+}
+
+// callFunction calls the function, and stops waiting for the result once the timeout of function is exceeded,
+// the call is not canceled but its result is dropped. The release is invoked once the call returns, even if
+// it has been abandoned by the timeout
+func callFunction(functionClient *http.Client, fn config.FunctionInfo, data []byte, release func()) ([]byte, error) {
+	if fn.Timeout <= 0 {
+		defer release()
+		return functionClient.Call(fn.Name, data)
+	}
+	type result struct {
+		data []byte
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		defer release()
+		out, err := functionClient.Call(fn.Name, data)
+		ch <- result{data: out, err: err}
+	}()
+	timer := time.NewTimer(fn.Timeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		return res.data, res.err
+	case <-timer.C:
+		return nil, errors.Errorf("no result in %s", fn.Timeout)
+	}
+}
+
+// sendFunctionError sends the failure of function to its error target, the callback is invoked once it is delivered
+func sendFunctionError(rs *routes, rule *Ruler, re *routedError, params map[string]string, callback func(error), logger *log.Logger) error {
+	data, err := json.Marshal(re.FunctionError)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	out := generatePackage(config.KinkHTTP, data, nil, params, rule.Name, rule.Source, re.target)
+	out.Callback = callback
+	err = sendToTarget(rs.clients[re.target.Client], rule.Name, out)
+	if err != nil {
+		logger.Error("failed to send function error", log.Any("rule", rule.Name), log.Any("function", re.Function), log.Error(err))
+		return errors.Trace(err)
+	}
+	logger.Debug("send function error", log.Any("rule", rule.Name), log.Any("function", re.Function), log.Any("client", re.target.Client))
+	return nil
+}
+
+// checkRuleFunctions checks the policies of functions in rule, and that the envelope is only set to the last function
+func checkRuleFunctions(rule config.RuleInfo, clientInfo map[string]*ClientDetail) error {
+	for i, fn := range rule.Functions {
+		if fn.Envelope && i != len(rule.Functions)-1 {
+			return errors.Errorf("envelope of function (%s) in rule (%s) is only supported by the last function", fn.Name, rule.Name)
+		}
+		if fn.Timeout < 0 {
+			return errors.Errorf("timeout of function (%s) in rule (%s) must not be negative", fn.Name, rule.Name)
+		}
+		switch fn.OnError {
+		case "", config.OnErrorAbort, config.OnErrorSkip:
+			if fn.ErrorTarget != nil {
+				return errors.Errorf("error target of function (%s) in rule (%s) is only supported by the policy (%s)", fn.Name, rule.Name, config.OnErrorRoute)
+			}
+		case config.OnErrorRoute:
+			if fn.ErrorTarget == nil {
+				return errors.Errorf("error target of function (%s) in rule (%s) is required by the policy (%s)", fn.Name, rule.Name, config.OnErrorRoute)
+			}
+			detail, ok := clientInfo[fn.ErrorTarget.Client]
+			if !ok {
+				return errors.Errorf("client (%s) not found in rule (%s)", fn.ErrorTarget.Client, rule.Name)
+			}
+			if kind := detail.Info.Kind; kind == config.KindTimer {
+				return errors.Errorf("client (%s) of kind (%s) can only be the source in rule (%s)", fn.ErrorTarget.Client, kind, rule.Name)
+			}
+		default:
+			return errors.Errorf("policy (%s) of function (%s) in rule (%s) is not supported", fn.OnError, fn.Name, rule.Name)
+		}
+	}
+	return errors.Trace(checkFunctionLimits(rule, clientInfo))
+}
+
+// checkFunctionLimits checks the limits of function calls in rule
+func checkFunctionLimits(rule config.RuleInfo, clientInfo map[string]*ClientDetail) error {
+	limits := rule.FunctionLimits
+	if limits == nil {
+		return nil
+	}
+	if limits.Timeout < 0 || limits.MaxInFlight < 0 {
+		return errors.Errorf("timeout and maxInFlight of function limits in rule (%s) must not be negative", rule.Name)
+	}
+	breaker := limits.Breaker
+	if breaker == nil {
+		return nil
+	}
+	if breaker.Failures <= 0 || breaker.OpenTimeout <= 0 {
+		return errors.Errorf("failures and openTimeout of breaker in rule (%s) must be positive", rule.Name)
+	}
+	switch breaker.Fallback {
+	case config.FallbackPass, config.FallbackDrop:
+		if breaker.ErrorTarget != nil {
+			return errors.Errorf("error target of breaker in rule (%s) is only supported by the fallback (%s)", rule.Name, config.FallbackRoute)
+		}
+	case config.FallbackRoute:
+		if breaker.ErrorTarget == nil {
+			return errors.Errorf("error target of breaker in rule (%s) is required by the fallback (%s)", rule.Name, config.FallbackRoute)
+		}
+		detail, ok := clientInfo[breaker.ErrorTarget.Client]
+		if !ok {
+			return errors.Errorf("client (%s) not found in rule (%s)", breaker.ErrorTarget.Client, rule.Name)
+		}
+		if kind := detail.Info.Kind; kind == config.KindTimer {
+			return errors.Errorf("client (%s) of kind (%s) can only be the source in rule (%s)", breaker.ErrorTarget.Client, kind, rule.Name)
+		}
+	default:
+		return errors.Errorf("fallback (%s) of breaker in rule (%s) is not supported", breaker.Fallback, rule.Name)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package rule
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestFunctionPipeline(t *testing.T) {
+	e := newTestEnv(t)
+	e.startBroker(5 * time.Second)
+	port := e.port("SOURCE_PORT")
+	e.router.Post("/upper", func(c *routing.Context) error {
+		c.SetBody(bytes.ToUpper(c.Request.Body()))
+		return nil
+	})
+	e.router.Post("/suffix", func(c *routing.Context) error {
+		c.SetBody(append(c.Request.Body(), "-s"...))
+		return nil
+	})
+	e.router.Post("/slow", func(c *routing.Context) error {
+		time.Sleep(time.Second)
+		c.SetBody(c.Request.Body())
+		return nil
+	})
+	e.router.Post("/fail", func(c *routing.Context) error {
+		return errors.New("func error")
+	})
+	e.serveHTTP(nil)
+
+	rules, cfg := e.startRules(`
+clients:
+  - name: mock-broker
+    kind: mqtt
+    address: '$BROKER'
+  - name: http-source
+    kind: http-server
+    port: $SOURCE_PORT
+rules:
+  - name: rule-chain
+    source:
+      client: mock-broker
+      topic: chain/in
+    target:
+      client: mock-broker
+      topic: chain/out
+    functions:
+      - name: upper
+      - name: suffix
+  - name: rule-skip
+    source:
+      client: mock-broker
+      topic: skip/in
+    target:
+      client: mock-broker
+      topic: skip/out
+    functions:
+      - name: fail
+        onError: skip
+      - name: suffix
+  - name: rule-route
+    source:
+      client: mock-broker
+      topic: route/in
+    target:
+      client: mock-broker
+      topic: route/out
+    functions:
+      - name: upper
+      - name: slow
+        timeout: 100ms
+        onError: route
+        errorTarget:
+          client: mock-broker
+          topic: errors/{rule}
+      - name: suffix
+  - name: rule-abort
+    source:
+      client: mock-broker
+      topic: abort/in
+    target:
+      client: mock-broker
+      topic: abort/out
+    functions:
+      - name: fail
+  - name: rule-server
+    source:
+      client: http-source
+    target:
+      client: mock-broker
+      topic: server/out
+    functions:
+      - name: fail
+        onError: route
+        errorTarget:
+          client: mock-broker
+          topic: errors/{rule}
+`)
+	cli := e.connect("pipeline", mqtt.Subscription{Topic: "+/out", QOS: 0}, mqtt.Subscription{Topic: "errors/#", QOS: 0})
+
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		out     string
+		result  string
+	}{
+		// the result of a function is the input of the next one
+		{name: "chain", topic: "chain/in", payload: "a", out: "chain/out", result: "A-s"},
+		// the input of the function skipped is passed to the next one
+		{name: "skip", topic: "skip/in", payload: "a", out: "skip/out", result: "a-s"},
+	}
+	for _, tt := range tests {
+		assert.NoError(t, cli.pub(newPublishPacket(0, 0, tt.topic, tt.payload)), tt.name)
+		msg := cli.receive().Message
+		assert.Equal(t, tt.out, msg.Topic, tt.name)
+		assert.Equal(t, tt.result, string(msg.Payload), tt.name)
+	}
+
+	// the message is dropped if the function fails without policy
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "abort/in", "a")))
+	// the function timed out is routed to the error target with its input
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "route/in", "a")))
+	msg := cli.receive().Message
+	assert.Equal(t, "errors/rule-route", msg.Topic)
+	var fe FunctionError
+	assert.NoError(t, json.Unmarshal(msg.Payload, &fe))
+	assert.Equal(t, "rule-route", fe.Rule)
+	assert.Equal(t, "slow", fe.Function)
+	assert.Equal(t, 1, fe.Step)
+	assert.Equal(t, "no result in 100ms", fe.Error)
+	assert.Equal(t, "A", string(fe.Payload))
+
+	// the caller of http-server is responded with the failure routed
+	resp, err := httpRequest(nil, "POST", fmt.Sprintf("http://127.0.0.1:%d/rules/rule-server", port), nil, "b")
+	assert.NoError(t, err)
+	assert.Equal(t, 500, resp.StatusCode())
+	msg = cli.receive().Message
+	assert.Equal(t, "errors/rule-server", msg.Topic)
+	assert.NoError(t, json.Unmarshal(msg.Payload, &fe))
+	assert.Equal(t, "fail", fe.Function)
+	assert.Equal(t, 0, fe.Step)
+	assert.Equal(t, "b", string(fe.Payload))
+
+	cli.assertNoMessage(500 * time.Millisecond)
+
+	// only one of function and functions can be set, and the policy of function must be valid
+	assertConfigErrors(t, rules, cfg, []configError{
+		{
+			change: func(cfg *config.Config) { cfg.Rules[0].Function = &config.FunctionInfo{Name: "upper"} },
+			err:    "only one of function and functions can be set in rule (rule-chain)",
+		},
+		{
+			change: func(cfg *config.Config) {
+				cfg.Rules[0].Function = nil
+				cfg.Rules[0].Functions[0].Envelope = true
+			},
+			err: "envelope of function (upper) in rule (rule-chain) is only supported by the last function",
+		},
+		{
+			change: func(cfg *config.Config) {
+				cfg.Rules[0].Functions[0].Envelope = false
+				cfg.Rules[0].Functions[0].OnError = config.OnErrorRoute
+			},
+			err: "error target of function (upper) in rule (rule-chain) is required by the policy (route)",
+		},
+		{
+			change: func(cfg *config.Config) { cfg.Rules[0].Functions[0].OnError = "retry" },
+			err:    "policy (retry) of function (upper) in rule (rule-chain) is not supported",
+		},
+	})
+}
@@ -13,6 +13,13 @@ import (
 
 type HandlerFunc func(ctx *routing.Context) (interface{}, error)
 
+// Response the response written as it is, instead of being marshaled to json
+type Response struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
 func Wrapper(handler HandlerFunc) func(ctx *routing.Context) error {
 	return func(ctx *routing.Context) error {
 		defer func() {
@@ -30,6 +37,13 @@ func Wrapper(handler HandlerFunc) func(ctx *routing.Context) error {
 			log.L().Error("failed to handler request", log.Code(err), log.Error(err))
 			return nil
 		}
+		if r, ok := res.(*Response); ok {
+			log.L().Debug("process success", log.Any("status", r.StatusCode), log.Any("contentType", r.ContentType))
+			ctx.SetStatusCode(r.StatusCode)
+			ctx.SetContentType(r.ContentType)
+			ctx.SetBody(r.Body)
+			return nil
+		}
 		log.L().Debug("process success", log.Any("response", toJSON(res)))
 		http.Respond(ctx, 200, toJSON(res))
 		return nil
@@ -40,3 +54,16 @@ func toJSON(obj interface{}) []byte {
 	data, _ := json.Marshal(obj)
 	return data
 }
+
+// serve serves the requests until the server is shut down, with mutual tls if client auth is enabled, in which
+// case the client certificates are verified against ca, or with tls if the server is secure
+func serve(server *http.Server, address string, clientAuth, secure bool, cert, key string) error {
+	switch {
+	case clientAuth:
+		return server.ListenAndServeMTLS(address, cert, key)
+	case secure:
+		return server.ListenAndServeTLS(address, cert, key)
+	default:
+		return server.ListenAndServe(address)
+	}
+}
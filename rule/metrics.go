@@ -0,0 +1,131 @@
+package rule
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/baetyl/baetyl-rule/v2/client"
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+const metricsNamespace = "baetyl_rule"
+
+var (
+	ruleReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "received_total",
+		Help:      "The number of messages received by rules.",
+	}, []string{"rule"})
+	ruleFiltered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "filtered_total",
+		Help:      "The number of messages filtered out by the where or the function of rules.",
+	}, []string{"rule"})
+	ruleFunctionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "function_errors_total",
+		Help:      "The number of messages failed to be processed by the function of rules.",
+	}, []string{"rule"})
+	ruleSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sent_total",
+		Help:      "The number of messages delivered to the targets of rules.",
+	}, []string{"rule", "target"})
+	ruleDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dropped_total",
+		Help:      "The number of messages failed to be delivered to the targets of rules.",
+	}, []string{"rule", "target"})
+	functionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "function_duration_seconds",
+		Help:      "The latency of function calls.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"function"})
+	functionInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "function_in_flight",
+		Help:      "The number of function calls of rules in flight.",
+	}, []string{"rule"})
+	functionRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "function_rejected_total",
+		Help:      "The number of function calls rejected by the limits of rules, the reason is busy or open.",
+	}, []string{"rule", "reason"})
+	functionBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "function_breaker_state",
+		Help:      "The state of the circuit breaker of rules, 0 for closed, 1 for open and 2 for half-open.",
+	}, []string{"rule"})
+	deliveryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "delivery_duration_seconds",
+		Help:      "The latency from sending a message to target client until the delivery is finished, including retries.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"client", "result"})
+	queueLengthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "client", "queue_length"),
+		"The number of messages waiting in the queue of target client.",
+		[]string{"client"}, nil,
+	)
+	inFlightDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "client", "in_flight"),
+		"The number of messages being sent by the workers of target client, including the ones waiting for retry.",
+		[]string{"client"}, nil,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ruleReceived, ruleFiltered, ruleFunctionErrors, ruleSent, ruleDropped, functionDuration,
+		functionInFlight, functionRejected, functionBreakerState, deliveryDuration)
+}
+
+// sendToTarget sends the message of rule to target client, the outcome and latency of the delivery are recorded.
+// The targets are independent, a failed target does not stop sending to the others
+func sendToTarget(cli client.Client, rule string, msg *config.TargetMsg) error {
+	observeDelivery(rule, msg)
+	err := cli.SendOrDrop(msg)
+	if err != nil {
+		ruleDropped.WithLabelValues(rule, msg.TargetInfo.Client).Inc()
+	}
+	return err
+}
+
+// observeDelivery wraps the callback of message to record the outcome of target before the callback, e.g. sending the dead letter, is invoked
+func observeDelivery(rule string, msg *config.TargetMsg) {
+	start := time.Now()
+	callback := msg.Callback
+	msg.Callback = func(err error) {
+		result := "success"
+		if err != nil {
+			result = "failure"
+			ruleDropped.WithLabelValues(rule, msg.TargetInfo.Client).Inc()
+		} else {
+			ruleSent.WithLabelValues(rule, msg.TargetInfo.Client).Inc()
+		}
+		deliveryDuration.WithLabelValues(msg.TargetInfo.Client, result).Observe(time.Since(start).Seconds())
+		if callback != nil {
+			callback(err)
+		}
+	}
+}
+
+// queueCollector collects the queue length and the messages in flight of the target clients in client set
+type queueCollector struct {
+	set *ClientSet
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueLengthDesc
+	ch <- inFlightDesc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, cli := range c.set.loadRoutes().clients {
+		if q, ok := cli.(client.Queued); ok {
+			ch <- prometheus.MustNewConstMetric(queueLengthDesc, prometheus.GaugeValue, float64(q.QueueLen()), name)
+			ch <- prometheus.MustNewConstMetric(inFlightDesc, prometheus.GaugeValue, float64(q.InFlight()), name)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package rule
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+
+	"github.com/baetyl/baetyl-rule/v2/client"
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+// Reply the response of http target published to the reply target
+type Reply struct {
+	Status        int               `json:"status"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Body          json.RawMessage   `json:"body,omitempty"` // the json body is embedded, others are quoted as string
+	CorrelationID string            `json:"correlationId,omitempty"`
+}
+
+// setReply sets the callback of message sent to http target, which publishes the response of target by the
+// reply message once the response is received, the original callback is passed to the reply, so that
+// a message is regarded as handled once its reply is delivered
+func setReply(rule string, ref *config.ReplyRef, msg, reply *config.TargetMsg, payload []byte, cli client.Client, logger *log.Logger) {
+	if cli == nil {
+		return
+	}
+	// the reply is published with the correlation data of source message, but not the response topic
+	delete(reply.Meta, config.MetaResponseTopic)
+	reply.Meta[config.MetaContentType] = "application/json"
+	if topic, ok := msg.Meta[config.MetaResponseTopic].(string); ok && topic != "" {
+		reply.Topic = topic
+	} else if ref.TopicField != "" {
+		if topic, ok := config.JSONField(payload, ref.TopicField).(string); ok && topic != "" {
+			reply.Topic = topic
+		}
+	}
+	var correlationID string
+	if ref.CorrelationField != "" {
+		if v := config.JSONField(payload, ref.CorrelationField); v != nil {
+			correlationID = fmt.Sprint(v)
+		}
+	} else if data, ok := msg.Meta[config.MetaCorrelationData].([]byte); ok {
+		correlationID = string(data)
+	}
+
+	msg.Response = &config.TargetResponse{}
+	callback := msg.Callback
+	msg.Callback = func(err error) {
+		msg.Callback = callback
+		res := msg.Response
+		if res.StatusCode == 0 {
+			// no response is received, e.g. the target is unreachable
+			msg.Complete(err)
+			return
+		}
+		if reply.Topic == "" {
+			logger.Error("no topic to publish the reply", log.Any("rule", rule), log.Any("client", ref.Client))
+			msg.Complete(err)
+			return
+		}
+		r := Reply{
+			Status:        res.StatusCode,
+			Headers:       res.Header,
+			CorrelationID: correlationID,
+		}
+		if len(res.Body) != 0 {
+			r.Body = res.Body
+			if !json.Valid(res.Body) {
+				r.Body, _ = json.Marshal(string(res.Body))
+			}
+		}
+		reply.Data, _ = json.Marshal(r)
+		reply.Callback = func(rerr error) {
+			if rerr != nil {
+				err = rerr
+			}
+			msg.Complete(err)
+		}
+		if serr := sendToTarget(cli, rule, reply); serr != nil {
+			logger.Error("failed to send reply", log.Any("rule", rule), log.Any("client", ref.Client), log.Error(serr))
+			msg.Complete(errors.Trace(serr))
+			return
+		}
+		logger.Debug("send reply", log.Any("rule", rule), log.Any("client", ref.Client), log.Any("topic", reply.Topic))
+	}
+}
+
+// checkRuleReplies checks that the replies of rule are set to http targets, and refer to mqtt clients
+func checkRuleReplies(rule config.RuleInfo, clientInfo map[string]*ClientDetail) error {
+	for _, target := range allTargets(rule) {
+		if target.Reply == nil {
+			continue
+		}
+		if kind := clientInfo[target.Client].Info.Kind; kind != config.KinkHTTP {
+			return errors.Errorf("reply of target (%s) in rule (%s) is only supported by http target, but it is (%s)", target.Client, rule.Name, kind)
+		}
+		detail, ok := clientInfo[target.Reply.Client]
+		if !ok {
+			return errors.Errorf("client (%s) not found in rule (%s)", target.Reply.Client, rule.Name)
+		}
+		if kind := detail.Info.Kind; kind != config.KindMqtt && kind != config.KindMqtt5 {
+			return errors.Errorf("reply client (%s) in rule (%s) must be mqtt, but it is (%s)", target.Reply.Client, rule.Name, kind)
+		}
+	}
+	return nil
+}
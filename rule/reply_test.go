@@ -0,0 +1,161 @@
+package rule
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/client"
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+// mockReplyClient completes the messages sent at once
+type mockReplyClient struct {
+	client.Client
+	sent []*config.TargetMsg
+}
+
+func (c *mockReplyClient) SendOrDrop(msg *config.TargetMsg) error {
+	c.sent = append(c.sent, msg)
+	msg.Complete(nil)
+	return nil
+}
+
+func TestSetReply(t *testing.T) {
+	cli := &mockReplyClient{}
+	ref := &config.ReplyRef{ClientRef: config.ClientRef{Client: "broker", MQTTRef: config.MQTTRef{Topic: "reply/fixed"}}, TopicField: "reply"}
+	meta := map[string]any{
+		config.MetaResponseTopic:   "reply/mqtt5",
+		config.MetaCorrelationData: []byte("c5"),
+		config.MetaContentType:     "text/plain",
+	}
+	msg := &config.TargetMsg{TargetInfo: config.ClientRef{Client: "http"}, Meta: meta}
+	reply := &config.TargetMsg{TargetInfo: ref.ClientRef, Topic: "reply/fixed", Meta: map[string]any{}}
+	for k, v := range meta {
+		reply.Meta[k] = v
+	}
+	var result []error
+	msg.Callback = func(err error) {
+		result = append(result, err)
+	}
+
+	// the response topic of mqtt 5 is preferred, and the correlation data is passed through
+	setReply("rule1", ref, msg, reply, []byte(`{"reply":"reply/field"}`), cli, log.L())
+	assert.Equal(t, "reply/mqtt5", reply.Topic)
+	*msg.Response = config.TargetResponse{StatusCode: 200, Body: []byte("ok")}
+	msg.Complete(nil)
+	assert.Equal(t, []error{nil}, result)
+	assert.Len(t, cli.sent, 1)
+	assert.Equal(t, map[string]any{
+		config.MetaCorrelationData: []byte("c5"),
+		config.MetaContentType:     "application/json",
+	}, reply.Meta)
+	var r Reply
+	assert.NoError(t, json.Unmarshal(reply.Data, &r))
+	assert.Equal(t, Reply{Status: 200, Body: json.RawMessage(`"ok"`), CorrelationID: "c5"}, r)
+
+	// nothing is replied without response
+	msg = &config.TargetMsg{Meta: map[string]any{}, Callback: msg.Callback}
+	reply = &config.TargetMsg{Meta: map[string]any{}}
+	setReply("rule1", ref, msg, reply, []byte(`{"reply":"reply/field"}`), cli, log.L())
+	assert.Equal(t, "reply/field", reply.Topic)
+	errUnreachable := errors.New("target is unreachable")
+	msg.Complete(errUnreachable)
+	assert.Equal(t, []error{nil, errUnreachable}, result)
+	assert.Len(t, cli.sent, 1)
+}
+
+func TestRuleReply(t *testing.T) {
+	e := newTestEnv(t)
+	e.startBroker(5 * time.Second)
+	e.router.Post("/devices/<id>", func(c *routing.Context) error {
+		c.Response.Header.Set("X-Device", c.Param("id"))
+		c.SetStatusCode(201)
+		c.SetContentType("application/json")
+		c.SetBodyString(`{"created":true}`)
+		return nil
+	})
+	e.router.Post("/missing", func(c *routing.Context) error {
+		c.SetStatusCode(404)
+		c.SetContentType("text/plain")
+		c.SetBodyString("not found")
+		return nil
+	})
+	e.serveHTTP(nil)
+
+	rules, cfg := e.startRules(`
+clients:
+  - name: mock-broker
+    kind: mqtt
+    address: '$BROKER'
+  - name: mock-http
+    kind: http
+    address: '$HTTP'
+rules:
+  - name: rule-fixed
+    source:
+      client: mock-broker
+      topic: req/+/fixed
+    target:
+      client: mock-http
+      path: /devices/{1}
+      reply:
+        client: mock-broker
+        topic: reply/{1}
+        correlationField: id
+  - name: rule-field
+    source:
+      client: mock-broker
+      topic: req/field
+    target:
+      client: mock-http
+      path: /missing
+      reply:
+        client: mock-broker
+        topicField: reply.topic
+`)
+	cli := e.connect("reply", mqtt.Subscription{Topic: "reply/#", QOS: 0})
+
+	assertReply := func(topic string) Reply {
+		var r Reply
+		pkt := cli.receive()
+		assert.Equal(t, topic, pkt.Message.Topic)
+		assert.NoError(t, json.Unmarshal(pkt.Message.Payload, &r))
+		return r
+	}
+
+	// the response is published to the fixed topic with the correlation id taken from source payload
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "req/d1/fixed", `{"id":"c1"}`)))
+	r := assertReply("reply/d1")
+	assert.Equal(t, 201, r.Status)
+	assert.Equal(t, "d1", r.Headers["X-Device"])
+	assert.JSONEq(t, `{"created":true}`, string(r.Body))
+	assert.Equal(t, "c1", r.CorrelationID)
+
+	// the failed response is published as well, to the topic taken from source payload
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "req/field", `{"reply":{"topic":"reply/field"}}`)))
+	r = assertReply("reply/field")
+	assert.Equal(t, 404, r.Status)
+	assert.Equal(t, `"not found"`, string(r.Body))
+	assert.Empty(t, r.CorrelationID)
+
+	// the reply is only supported by http target, and the reply client must be mqtt
+	assertConfigErrors(t, rules, cfg, []configError{
+		{
+			change: func(cfg *config.Config) { cfg.Rules[1].Target.Reply.Client = "mock-http" },
+			err:    "reply client (mock-http) in rule (rule-field) must be mqtt, but it is (http)",
+		},
+		{
+			change: func(cfg *config.Config) {
+				cfg.Rules[1].Target = &config.ClientRef{Client: "mock-broker", MQTTRef: config.MQTTRef{Topic: "out"}, Reply: &config.ReplyRef{ClientRef: config.ClientRef{Client: "mock-broker"}}}
+			},
+			err: "reply of target (mock-broker) in rule (rule-field) is only supported by http target, but it is (mqtt)",
+		},
+	})
+}
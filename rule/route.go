@@ -0,0 +1,163 @@
+package rule
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+// rulePathPrefix the path of the rules which do not declare their own route, followed by the rule name
+const rulePathPrefix = "/rules/"
+
+// pathParam the parameter of route path, e.g. {id} of /devices/{id}/events
+var pathParam = regexp.MustCompile(`^\{([A-Za-z_]\w*)\}$`)
+
+// httpRoute the method and path pattern declared by the source of http-server rule
+type httpRoute struct {
+	method   string
+	pattern  string
+	segments []string // the parameter name is kept with braces
+	static   int      // the count of static segments, the route with more static segments is preferred
+	params   map[string]bool
+}
+
+func newHTTPRoute(method, pattern string) (*httpRoute, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, errors.Errorf("path (%s) must start with '/'", pattern)
+	}
+	r := &httpRoute{
+		method:   strings.ToUpper(method),
+		pattern:  pattern,
+		segments: strings.Split(pattern[1:], "/"),
+		params:   map[string]bool{},
+	}
+	for _, s := range r.segments {
+		if !strings.ContainsAny(s, "{}") {
+			r.static++
+			continue
+		}
+		m := pathParam.FindStringSubmatch(s)
+		if m == nil {
+			return nil, errors.Errorf("segment (%s) of path (%s) is invalid, the parameter must be a whole segment like {id}", s, pattern)
+		}
+		switch m[1] {
+		case "topic", "client", "rule":
+			return nil, errors.Errorf("parameter (%s) of path (%s) is reserved", s, pattern)
+		}
+		if r.params[m[1]] {
+			return nil, errors.Errorf("parameter (%s) of path (%s) is duplicated", s, pattern)
+		}
+		r.params[m[1]] = true
+	}
+	return r, nil
+}
+
+// checkTemplate checks that the named placeholders of template are the parameters of path
+func (r *httpRoute) checkTemplate(tpl string) error {
+	for _, m := range paramPlaceholder.FindAllStringSubmatch(tpl, -1) {
+		switch m[1] {
+		case "topic", "client", "rule":
+			continue
+		}
+		if !r.params[m[1]] {
+			return errors.Errorf("placeholder (%s) of (%s) is not a parameter of source path (%s)", m[0], tpl, r.pattern)
+		}
+	}
+	return nil
+}
+
+// match returns the parameters of path if the request matches the route
+func (r *httpRoute) match(method, path string) (map[string]string, bool) {
+	if method != r.method || !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	segments := strings.Split(path[1:], "/")
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, s := range r.segments {
+		if m := pathParam.FindStringSubmatch(s); m != nil {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[m[1]] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// key returns the route whose parameters are replaced by the same name, the routes with the same key conflict
+func (r *httpRoute) key() string {
+	segments := make([]string, len(r.segments))
+	for i, s := range r.segments {
+		if pathParam.MatchString(s) {
+			s = "{}"
+		}
+		segments[i] = s
+	}
+	return r.method + " /" + strings.Join(segments, "/")
+}
+
+// serverRoutes the rules of an http server
+type serverRoutes struct {
+	info   config.ClientInfo
+	rulers map[string]*Ruler // key: rule name
+}
+
+// add adds the rule to http server, the route of rule must not conflict with the others
+func (s *serverRoutes) add(r *Ruler) error {
+	if r.route != nil {
+		if strings.HasPrefix(r.route.pattern, rulePathPrefix) {
+			return errors.Errorf("path (%s) of rule (%s) is reserved by the rules without path", r.route.pattern, r.Name)
+		}
+		for _, v := range s.rulers {
+			if v.route != nil && v.route.key() == r.route.key() {
+				return errors.Errorf("route (%s %s) of rule (%s) conflicts with rule (%s)", r.route.method, r.route.pattern, r.Name, v.Name)
+			}
+		}
+	}
+	s.rulers[r.Name] = r
+	return nil
+}
+
+// match returns the rule of request and the parameters of path, the rules which do not declare their own route
+// are triggered by POST /rules/{ruleName}. If several routes match, the one with more static segments is chosen
+func (s *serverRoutes) match(method, path string) (*Ruler, map[string]string) {
+	var res *Ruler
+	var params map[string]string
+	for _, v := range s.sortedRulers() {
+		if v.route == nil {
+			continue
+		}
+		if p, ok := v.route.match(method, path); ok && (res == nil || v.route.static > res.route.static) {
+			res, params = v, p
+		}
+	}
+	if res != nil || method != "POST" || !strings.HasPrefix(path, rulePathPrefix) {
+		return res, params
+	}
+	if v, ok := s.rulers[path[len(rulePathPrefix):]]; ok && v.route == nil {
+		return v, nil
+	}
+	return nil, nil
+}
+
+func (s *serverRoutes) sortedRulers() []*Ruler {
+	res := make([]*Ruler, 0, len(s.rulers))
+	for _, v := range s.rulers {
+		res = append(res, v)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
@@ -0,0 +1,133 @@
+package rule
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestHttpSourceRoutes(t *testing.T) {
+	e := newTestEnv(t)
+	lan := e.port("LAN_PORT")
+	dmz := e.port("DMZ_PORT")
+	paths := make(chan string, 10)
+	e.serveHTTP(func(ctx *fasthttp.RequestCtx) {
+		paths <- string(ctx.Method()) + " " + string(ctx.Path())
+	})
+
+	rules, cfg := e.startRules(`
+clients:
+  - name: mock-http
+    kind: http
+    address: '$HTTP'
+  - name: lan
+    kind: http-server
+    port: $LAN_PORT
+  - name: dmz
+    kind: http-server
+    port: $DMZ_PORT
+    auth:
+      tokens:
+        - identity: app1
+          token: token1
+rules:
+  - name: rule-events
+    source:
+      client: lan
+      method: POST
+      path: /devices/{id}/events
+    target:
+      client: mock-http
+      path: /api/{id}/{rule}
+  - name: rule-status
+    source:
+      client: lan
+      method: PUT
+      path: /devices/status/events
+    target:
+      client: mock-http
+      path: /api/status
+  - name: rule-default
+    source:
+      client: lan
+    target:
+      client: mock-http
+      path: /api/default
+  - name: rule-dmz
+    source:
+      client: dmz
+      path: /devices/{id}/events
+    target:
+      client: mock-http
+      path: /api/{id}/{client}
+`)
+	time.Sleep(500 * time.Millisecond)
+
+	token := map[string]string{"Authorization": "Bearer token1"}
+	tests := []struct {
+		name   string
+		port   int
+		method string
+		path   string
+		header map[string]string
+		code   int
+		// the request received by the target, nothing is received if it is empty
+		target string
+	}{
+		// the path params are used in the target path, the route with more static segments is preferred
+		{name: "params", port: lan, method: "POST", path: "/devices/d1/events", code: 200, target: "POST /api/d1/rule-events"},
+		{name: "static", port: lan, method: "PUT", path: "/devices/status/events", code: 200, target: "POST /api/status"},
+		{name: "method", port: lan, method: "POST", path: "/devices/status/events", code: 200, target: "POST /api/status/rule-events"},
+		// the rules without path are still triggered by /rules/{ruleName}, but the rules with path are not
+		{name: "rule without path", port: lan, method: "POST", path: "/rules/rule-default", code: 200, target: "POST /api/default"},
+		{name: "rule with path", port: lan, method: "POST", path: "/rules/rule-events", code: 400},
+		{name: "method not matched", port: lan, method: "GET", path: "/devices/d1/events", code: 404},
+		{name: "path not matched", port: lan, method: "POST", path: "/devices/d1", code: 404},
+		// each server only serves its own rules with its own config
+		{name: "unauthorized", port: dmz, method: "POST", path: "/devices/d1/events", code: 401},
+		{name: "authorized", port: dmz, method: "POST", path: "/devices/d2/events", header: token, code: 200, target: "POST /api/d2/dmz"},
+		{name: "rule of other server", port: dmz, method: "POST", path: "/rules/rule-default", header: token, code: 400},
+	}
+	for _, tt := range tests {
+		resp, err := httpRequest(nil, tt.method, fmt.Sprintf("http://127.0.0.1:%d%s", tt.port, tt.path), tt.header, `{"temp":1}`)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.code, resp.StatusCode(), tt.name)
+		if tt.target != "" {
+			assert.Equal(t, tt.target, receiveString(t, paths), tt.name)
+		}
+	}
+
+	// the routes of a server must not conflict, and the placeholders must be the params of path
+	assertConfigErrors(t, rules, cfg, []configError{
+		{
+			change: func(cfg *config.Config) {
+				cfg.Rules[1].Source = &config.ClientRef{Client: "lan", HTTPRef: config.HTTPRef{Method: "post", Path: "/devices/{name}/events"}}
+			},
+			err: "route (POST /devices/{name}/events) of rule (rule-status) conflicts with rule (rule-events)",
+		},
+		{
+			change: func(cfg *config.Config) {
+				cfg.Rules[1].Source = &config.ClientRef{Client: "lan", HTTPRef: config.HTTPRef{Method: "PUT", Path: "/rules/status"}}
+			},
+			err: "path (/rules/status) of rule (rule-status) is reserved by the rules without path",
+		},
+		{
+			change: func(cfg *config.Config) {
+				cfg.Rules[1].Source = &config.ClientRef{Client: "lan", HTTPRef: config.HTTPRef{Method: "PUT", Path: "/devices/{id}-status"}}
+			},
+			err: "invalid source in rule (rule-status): segment ({id}-status) of path (/devices/{id}-status) is invalid, the parameter must be a whole segment like {id}",
+		},
+		{
+			change: func(cfg *config.Config) {
+				cfg.Rules[1].Target = &config.ClientRef{Client: "mock-http", HTTPRef: config.HTTPRef{Path: "/api/{id}"}}
+				cfg.Rules[1].Source = &config.ClientRef{Client: "lan", HTTPRef: config.HTTPRef{Method: "PUT", Path: "/devices/{name}"}}
+			},
+			err: "invalid target (mock-http) in rule (rule-status): placeholder ({id}) of (/api/{id}) is not a parameter of source path (/devices/{name})",
+		},
+	})
+}
@@ -1,125 +1,741 @@
 package rule
 
 import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+
 	"github.com/baetyl/baetyl-go/v2/context"
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/http"
 	"github.com/baetyl/baetyl-go/v2/log"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
 
+	"github.com/baetyl/baetyl-rule/v2/client"
 	"github.com/baetyl/baetyl-rule/v2/config"
 )
 
 type ClientSet struct {
-	clients map[string]*SingleClient //	key: client name
-	server  *HTTPServer
+	ctx            context.Context
+	functionClient *http.Client
+	plan           *plan
+	clients        map[string]*SingleClient //	key: client name
+	servers        map[string]*HTTPServer   // key: server name
+	admin          *AdminServer
+	routes         atomic.Value // *routes
+	mu             sync.Mutex
+	disabled       map[string]bool // key: rule name
+	disabledMu     sync.RWMutex
+	logger         *log.Logger
+}
+
+// RuleStatus the rule and whether it is enabled
+type RuleStatus struct {
+	config.RuleInfo
+	Enabled bool `json:"enabled"`
+}
+
+// ClientStatus the client and the topics subscribed by rules
+type ClientStatus struct {
+	Name          string          `json:"name"`
+	Kind          config.Kind     `json:"kind"`
+	Subscriptions []mqtt.QOSTopic `json:"subscriptions,omitempty"`
 }
 
 type ClientDetail struct {
 	Name         string
 	Subscription []mqtt.QOSTopic
+	Sources      []config.ClientRef // source refs of the rules subscribing to the client
 	Info         config.ClientInfo
 }
 
-func NewRulers(ctx context.Context, cfg config.Config, functionClient *http.Client) (*ClientSet, error) {
+// Ruler the rule with its compiled sql and routes
+type Ruler struct {
+	config.RuleInfo
+	sql          *SQL
+	route        *httpRoute // the route declared by the rule of http server
+	routes       []*conditionalRoute
+	defaultRoute *conditionalRoute
+	guard        *functionGuard
+}
+
+func newRuler(info config.RuleInfo) (*Ruler, error) {
+	r := &Ruler{RuleInfo: info, guard: newFunctionGuard(info.Name, info.FunctionLimits)}
+	if info.Select != "" || info.Where != "" {
+		sql, err := NewSQL(info.Select, info.Where)
+		if err != nil {
+			return nil, errors.Errorf("invalid sql in rule (%s): %s", info.Name, err.Error())
+		}
+		r.sql = sql
+	}
+	var err error
+	r.routes, r.defaultRoute, err = newConditionalRoutes(info)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var filter string
+	if info.Source != nil {
+		filter = info.Source.Topic
+	}
+	for _, ref := range ruleRefs(info) {
+		for _, tpl := range refTemplates(ref) {
+			if err := checkTopicTemplate(tpl, filter); err != nil {
+				return nil, errors.Errorf("invalid target (%s) in rule (%s): %s", ref.Client, info.Name, err.Error())
+			}
+		}
+	}
+	return r, nil
+}
+
+// newServerRuler creates the rule of http server, whose source may declare the method and path pattern
+func newServerRuler(info config.RuleInfo) (*Ruler, error) {
+	r, err := newRuler(info)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if info.Source.Path == "" {
+		return r, nil
+	}
+	method := info.Source.Method
+	if method == "" {
+		method = "POST"
+	}
+	r.route, err = newHTTPRoute(method, info.Source.Path)
+	if err != nil {
+		return nil, errors.Errorf("invalid source in rule (%s): %s", info.Name, err.Error())
+	}
+	for _, ref := range ruleRefs(info) {
+		for _, tpl := range refTemplates(ref) {
+			if err = r.route.checkTemplate(tpl); err != nil {
+				return nil, errors.Errorf("invalid target (%s) in rule (%s): %s", ref.Client, info.Name, err.Error())
+			}
+		}
+	}
+	return r, nil
+}
+
+// ruleRefs returns the targets of rule and routes, the replies of targets and dead letter of rule
+func ruleRefs(info config.RuleInfo) []config.ClientRef {
+	refs := allTargets(info)
+	for _, target := range refs {
+		if target.Reply != nil {
+			refs = append(refs[:len(refs):len(refs)], target.Reply.ClientRef)
+		}
+	}
+	if info.DeadLetter != nil {
+		refs = append(refs[:len(refs):len(refs)], *info.DeadLetter)
+	}
+	for _, fn := range info.AllFunctions() {
+		if fn.ErrorTarget != nil {
+			refs = append(refs[:len(refs):len(refs)], *fn.ErrorTarget)
+		}
+	}
+	if limits := info.FunctionLimits; limits != nil && limits.Breaker != nil && limits.Breaker.ErrorTarget != nil {
+		refs = append(refs[:len(refs):len(refs)], *limits.Breaker.ErrorTarget)
+	}
+	return refs
+}
+
+// refTemplates returns the templates of target which may contain placeholders
+func refTemplates(ref config.ClientRef) []string {
+	return append([]string{ref.Topic, ref.Path}, propertiesTemplates(ref.Properties)...)
+}
+
+// process filters and transforms the payload by the sql and the function of rule in order,
+// an empty result means the message is filtered out
+func (r *Ruler) process(functionClient *http.Client, topic string, meta map[string]any, payload []byte) ([]byte, error) {
+	ruleReceived.WithLabelValues(r.Name).Inc()
+	data := payload
 	var err error
-	clientInfo := make(map[string]*ClientDetail) // key: client name, value: client config
+	if r.sql != nil {
+		data, err = r.sql.Process(topic, meta, data)
+		if err != nil {
+			return nil, errors.Errorf("failed to process sql: %s", err.Error())
+		}
+		if len(data) == 0 {
+			ruleFiltered.WithLabelValues(r.Name).Inc()
+			return nil, nil
+		}
+	}
+	return r.callFunctions(functionClient, data)
+}
+
+// plan the clients and rules parsed from config
+type plan struct {
+	details map[string]*ClientDetail // key: client name
+	sources map[string]*sourceRoutes // key: source client name
+	servers map[string]*serverRoutes // key: http server name
+	admin   *config.AdminConfig
+}
+
+// routes the rules and clients used to route messages, which is replaced as a whole when rules are reloaded
+type routes struct {
+	clients map[string]client.Client // key: client name
+	sources map[string]*sourceRoutes // key: source client name
+	servers map[string]*serverRoutes // key: http server name
+}
+
+// sourceRoutes the rules subscribing to a source client
+type sourceRoutes struct {
+	rulers  map[string]*Ruler // key: rule name
+	subTree *mqtt.Trie
+}
+
+func NewRulers(ctx context.Context, cfg config.Config, functionClient *http.Client) (*ClientSet, error) {
+	p, err := newPlan(cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	clientSet := &ClientSet{
-		clients: make(map[string]*SingleClient),
+		ctx:            ctx,
+		functionClient: functionClient,
+		plan:           &plan{details: map[string]*ClientDetail{}},
+		clients:        make(map[string]*SingleClient),
+		servers:        make(map[string]*HTTPServer),
+		disabled:       make(map[string]bool),
+		logger:         log.With(log.Any("rule", "clients")),
 	}
+	clientSet.routes.Store(&routes{})
+	clientSet.mu.Lock()
+	err = clientSet.apply(p)
+	clientSet.mu.Unlock()
+	if err != nil {
+		clientSet.Close()
+		return nil, errors.Trace(err)
+	}
+	return clientSet, nil
+}
+
+// Reload applies the new config, only the clients added, removed or changed are started or stopped,
+// the routes of rules are replaced at once and the untouched clients keep running
+func (l *ClientSet) Reload(cfg config.Config) error {
+	p, err := newPlan(cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return errors.Trace(l.apply(p))
+}
+
+func newPlan(cfg config.Config) (*plan, error) {
+	p := &plan{
+		details: map[string]*ClientDetail{},
+		sources: map[string]*sourceRoutes{},
+		servers: map[string]*serverRoutes{},
+		admin:   cfg.Admin,
+	}
+	queues := map[string]string{} // key: path of persistent queue, value: client name
 	for _, v := range cfg.Clients {
 		if v.Kind == config.KindHTTPServer {
-			// http server can only exist one
-			if clientSet.server != nil {
-				return nil, errors.New("Duplicate http source config")
-			}
-			clientSet.server, err = NewHTTPServer(v, functionClient)
-			if err != nil {
-				return nil, errors.Trace(err)
+			p.servers[v.Name] = &serverRoutes{
+				info:   v,
+				rulers: make(map[string]*Ruler), // key: rule name
 			}
 			continue
 		}
-		clientInfo[v.Name] = &ClientDetail{
+		// the file of persistent queue is locked by the client opening it
+		var delivery client.DeliveryConfig
+		if err := v.Parse(&delivery); err != nil {
+			return nil, errors.Errorf("invalid config of client (%s): %s", v.Name, err.Error())
+		}
+		if queue := delivery.Queue.Path; queue != "" {
+			if name, ok := queues[filepath.Clean(queue)]; ok {
+				return nil, errors.Errorf("queue path (%s) of client (%s) is already used by client (%s)", queue, v.Name, name)
+			}
+			queues[filepath.Clean(queue)] = v.Name
+		}
+		p.details[v.Name] = &ClientDetail{
 			Name: v.Name,
 			Info: v,
 		}
-		clientSet.clients[v.Name] = &SingleClient{
-			name:    v.Name,
+		p.sources[v.Name] = &sourceRoutes{
+			rulers:  make(map[string]*Ruler), // key: rule name
 			subTree: mqtt.NewTrie(),
-			rulers:  make(map[string]config.RuleInfo), // key: rule name
-			logger:  log.With(log.Any("client", v.Name)),
 		}
 	}
 
-	for _, rule := range cfg.Rules {
-		if rule.Target == nil {
+	for _, info := range cfg.Rules {
+		// the rule is copied, since the config may be changed by the caller while the rule is in use
+		rule := info.Clone()
+		// the target is merged into targets, only targets are used afterwards
+		rule.Targets = rule.AllTargets()
+		rule.Target = nil
+		routes := make([]config.Route, len(rule.Routes))
+		for i, route := range rule.Routes {
+			route.Targets = route.AllTargets()
+			route.Target = nil
+			routes[i] = route
+		}
+		rule.Routes = routes
+		// the function is merged into functions like the target
+		if rule.Function != nil && len(rule.Functions) != 0 {
+			return nil, errors.Errorf("only one of function and functions can be set in rule (%s)", rule.Name)
+		}
+		rule.Functions = rule.AllFunctions()
+		rule.Function = nil
+		// the rule whose function directs the clients by envelopes may have no targets
+		if len(allTargets(rule)) == 0 && !envelopeEnabled(rule) {
 			continue
 		}
+		err := checkRuleFunctions(rule, p.details)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 		// Set http source rule info
-		if clientSet.server != nil && rule.Source.Client == clientSet.server.name {
-			clientSet.server.rulers[rule.Name] = rule
-			_, ok := clientInfo[rule.Target.Client]
-			if !ok {
-				return nil, errors.Trace(errors.Errorf("client (%s) not found in rule (%s)", rule.Target.Client, rule.Name))
+		if server, ok := p.servers[rule.Source.Client]; ok {
+			err := checkRuleClients(rule, p.details)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			err = checkRuleResponse(rule, p.details)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			err = checkRuleAllow(rule, server.info)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			for _, target := range allTargets(rule) {
+				if target.Reply != nil {
+					return nil, errors.Errorf("reply of target (%s) in rule (%s) is not supported by http-server source", target.Client, rule.Name)
+				}
+			}
+			ruler, err := newServerRuler(rule)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			err = server.add(ruler)
+			if err != nil {
+				return nil, errors.Trace(err)
 			}
 			continue
 		}
-		_, ok := clientInfo[rule.Source.Client]
+		detail, ok := p.details[rule.Source.Client]
 		if !ok {
 			return nil, errors.Trace(errors.Errorf("client (%s) not found in rule (%s)", rule.Source.Client, rule.Name))
 		}
-		if rule.Source.QOS > rule.Target.QOS {
-			rule.Source.QOS = rule.Target.QOS
+		err = checkRuleClients(rule, p.details)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if rule.Response != "" {
+			return nil, errors.Errorf("response of rule (%s) is only supported by http-server source", rule.Name)
 		}
-		clientInfo[rule.Source.Client].Subscription = append(clientInfo[rule.Source.Client].Subscription, mqtt.QOSTopic{
-			Topic: rule.Source.Topic,
-			QOS:   uint32(rule.Source.QOS),
+		err = checkRuleReplies(rule, p.details)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(rule.Allow) != 0 {
+			return nil, errors.Errorf("allow of rule (%s) is only supported by http-server source", rule.Name)
+		}
+		source := *rule.Source
+		rule.Source = &source
+		if detail.Info.Kind == config.KinkHTTP && detail.Info.Value["poll"] == nil {
+			return nil, errors.Errorf("client (%s) must be configured with poll to be the source of rule (%s)", detail.Name, rule.Name)
+		}
+		if source.Topic == "" && (detail.Info.Kind == config.KindTimer || detail.Info.Kind == config.KinkHTTP) {
+			// the rule receives all messages of timer or http poll if no topic is set
+			source.Topic = "#"
+		}
+		// the source is subscribed with the highest qos of targets if they are all mqtt,
+		// the other targets are confirmed by the dispatcher, which requires the qos of source
+		qos, capped := 0, !envelopeEnabled(rule)
+		for _, target := range allTargets(rule) {
+			if d, ok := p.details[target.Client]; !ok || (d.Info.Kind != config.KindMqtt && d.Info.Kind != config.KindMqtt5) {
+				capped = false
+			}
+			if target.QOS > qos {
+				qos = target.QOS
+			}
+		}
+		if capped && source.QOS > qos {
+			source.QOS = qos
+		}
+		detail.Subscription = append(detail.Subscription, mqtt.QOSTopic{
+			Topic: source.Topic,
+			QOS:   uint32(source.QOS),
 		})
+		detail.Sources = append(detail.Sources, source)
 
-		_, ok = clientInfo[rule.Target.Client]
-		if !ok {
-			return nil, errors.Trace(errors.Errorf("client (%s) not found in rule (%s)", rule.Target.Client, rule.Name))
+		ruler, err := newRuler(rule)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		p.sources[rule.Source.Client].rulers[rule.Name] = ruler
+		p.sources[rule.Source.Client].subTree.Add(rule.Source.Topic, rule.Name)
+	}
+	return p, nil
+}
+
+// rulers returns all rules of plan
+func (p *plan) rulers() []*Ruler {
+	var res []*Ruler
+	for _, v := range p.sources {
+		for _, r := range v.rulers {
+			res = append(res, r)
+		}
+	}
+	for _, v := range p.servers {
+		for _, r := range v.rulers {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+func (p *plan) ruler(name string) *Ruler {
+	for _, r := range p.rulers() {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// apply starts the clients and routes of plan, the clients which are removed or whose connection settings
+// are changed are closed before the new ones are started, since they may share resources like the file of
+// persistent queue. The subscriptions of the other clients are changed on the live clients if supported.
+// If any client fails to start, the clients of the previous plan are restored
+func (l *ClientSet) apply(p *plan) error {
+	// the rule whose function limits are unchanged keeps the state of its breaker and in-flight calls
+	prev := map[string]*Ruler{}
+	for _, r := range l.plan.rulers() {
+		prev[r.Name] = r
+	}
+	for _, r := range p.rulers() {
+		if v, ok := prev[r.Name]; ok && reflect.DeepEqual(v.FunctionLimits, r.FunctionLimits) {
+			r.guard = v.guard
+		}
+	}
+	var stale, fresh, changed []string
+	for name, detail := range l.plan.details {
+		v, ok := p.details[name]
+		cli, running := l.clients[name]
+		switch {
+		case !ok || !running || v.Name != detail.Name || !reflect.DeepEqual(v.Info, detail.Info):
+			stale = append(stale, name)
+		case !sameRefs(v.Sources, detail.Sources):
+			// the client without subscriptions is started without observer
+			if _, ok := cli.client.(client.Subscriber); ok && len(detail.Subscription) != 0 {
+				changed = append(changed, name)
+			} else {
+				stale = append(stale, name)
+			}
+		}
+	}
+	for name := range p.details {
+		if _, ok := l.plan.details[name]; !ok {
+			fresh = append(fresh, name)
+		}
+	}
+	for _, name := range stale {
+		if _, ok := p.details[name]; ok {
+			fresh = append(fresh, name)
+		}
+	}
+	if len(stale) != 0 || len(fresh) != 0 || len(changed) != 0 {
+		l.logger.Info("clients changed", log.Any("stopped", stale), log.Any("started", fresh), log.Any("resubscribed", changed))
+	}
+	l.closeClients(stale)
+	err := l.openClients(p, fresh)
+	if err != nil {
+		l.closeClients(fresh)
+		if rerr := l.openClients(l.plan, stale); rerr != nil {
+			l.logger.Error("failed to restore clients", log.Any("clients", stale), log.Error(rerr))
+		}
+		return errors.Trace(err)
+	}
+	// the subscriptions are changed after the routes are replaced, so that the messages of new topics are routed
+	var failed []string
+	for _, name := range changed {
+		if err = l.resubscribe(name, l.plan.details[name], p.details[name]); err != nil {
+			l.logger.Warn("failed to change subscriptions of client, restart it", log.Any("client", name), log.Error(err))
+			failed = append(failed, name)
 		}
-		singleClient, _ := clientSet.clients[rule.Source.Client]
-		singleClient.rulers[rule.Name] = rule
-		singleClient.subTree.Add(rule.Source.Topic, rule.Name)
 	}
+	l.closeClients(failed)
+	if err = l.openClients(p, failed); err != nil {
+		return errors.Trace(err)
+	}
+	l.plan = p
+	// the status of removed rules is dropped
+	l.disabledMu.Lock()
+	for name := range l.disabled {
+		if p.ruler(name) == nil {
+			delete(l.disabled, name)
+		}
+	}
+	l.disabledMu.Unlock()
+	if err = l.applyAdmin(p); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(l.applyServers(p))
+}
+
+// resubscribe unsubscribes the topics removed from the live client, then subscribes the added ones
+// and the ones whose qos is changed
+func (l *ClientSet) resubscribe(name string, prev, detail *ClientDetail) error {
+	sub := l.clients[name].client.(client.Subscriber)
+	prevTopics, topics := subscriptionSet(prev.Subscription), subscriptionSet(detail.Subscription)
+	var removed []string
+	for topic := range prevTopics {
+		if _, ok := topics[topic]; !ok {
+			removed = append(removed, topic)
+		}
+	}
+	var added []mqtt.QOSTopic
+	for topic, qos := range topics {
+		if q, ok := prevTopics[topic]; !ok || q != qos {
+			added = append(added, mqtt.QOSTopic{Topic: topic, QOS: qos})
+		}
+	}
+	sort.Strings(removed)
+	sort.Slice(added, func(i, j int) bool { return added[i].Topic < added[j].Topic })
+	if len(removed) != 0 {
+		if err := sub.Unsubscribe(removed); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(added) != 0 {
+		return errors.Trace(sub.Subscribe(added))
+	}
+	return nil
+}
 
-	// New all clients
-	for _, v := range clientInfo {
-		cli, err := NewClient(ctx, v)
+// subscriptionSet returns the qos of topics, the highest qos is taken if a topic is subscribed by several rules
+func subscriptionSet(subs []mqtt.QOSTopic) map[string]uint32 {
+	res := make(map[string]uint32, len(subs))
+	for _, s := range subs {
+		if qos, ok := res[s.Topic]; !ok || s.QOS > qos {
+			res[s.Topic] = s.QOS
+		}
+	}
+	return res
+}
+
+// sameRefs checks whether the refs are the same regardless of order
+func sameRefs(a, b []config.ClientRef) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	used := make([]bool, len(b))
+	for _, ref := range a {
+		found := false
+		for i := range b {
+			if !used[i] && reflect.DeepEqual(ref, b[i]) {
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// openClients creates the clients of plan, then replaces the routes and starts the clients
+func (l *ClientSet) openClients(p *plan, names []string) error {
+	for _, name := range names {
+		cfg := new(SourceClientConfig)
+		if err := p.details[name].Info.Parse(cfg); err != nil {
+			return errors.Trace(err)
+		}
+		cli, err := NewClient(l.ctx, p.details[name])
 		if err != nil {
-			return nil, errors.Trace(err)
+			return errors.Trace(err)
+		}
+		l.clients[name] = &SingleClient{
+			name:   name,
+			client: cli,
+			cfg:    cfg.Source,
+			set:    l,
+			logger: log.With(log.Any("client", name)),
 		}
-		singleClient, _ := clientSet.clients[v.Name]
-		singleClient.client = cli
 	}
-	// Start all clients
-	for _, v := range clientInfo {
-		singleClient, _ := clientSet.clients[v.Name]
-		err = singleClient.Start(clientSet.clients, functionClient)
+	rs := &routes{
+		clients: make(map[string]client.Client),
+		sources: p.sources,
+		servers: p.servers,
+	}
+	for name := range p.details {
+		rs.clients[name] = l.clients[name].client
+	}
+	l.routes.Store(rs)
+	for _, name := range names {
+		err := l.clients[name].Start(p.sources[name], l.functionClient)
 		if err != nil {
-			return nil, errors.Trace(err)
+			return errors.Trace(err)
 		}
 	}
-	// Start http server
-	if clientSet.server != nil {
-		for _, rule := range clientSet.server.rulers {
-			clientSet.server.client[rule.Target.Client] = clientSet.clients[rule.Target.Client].client
+	return nil
+}
+
+func (l *ClientSet) closeClients(names []string) {
+	for _, name := range names {
+		if v, ok := l.clients[name]; ok {
+			if err := v.Close(); err != nil {
+				l.logger.Error("failed to close client", log.Any("client", name), log.Error(err))
+			}
+			delete(l.clients, name)
 		}
-		clientSet.server.Start()
 	}
+}
 
-	return clientSet, nil
+// applyServers restarts the http servers whose config is changed, the server is stopped if it has no rule
+func (l *ClientSet) applyServers(p *plan) error {
+	for name, server := range l.servers {
+		if v, ok := p.servers[name]; !ok || len(v.rulers) == 0 || !reflect.DeepEqual(server.info, v.info) {
+			server.Close()
+			delete(l.servers, name)
+		}
+	}
+	for name, v := range p.servers {
+		if _, ok := l.servers[name]; ok || len(v.rulers) == 0 {
+			continue
+		}
+		server, err := NewHTTPServer(v.info, l)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		l.servers[name] = server
+		server.Start()
+	}
+	return nil
+}
+
+// applyAdmin restarts the admin server if its config is changed
+func (l *ClientSet) applyAdmin(p *plan) error {
+	if l.admin != nil && (p.admin == nil || !reflect.DeepEqual(l.admin.cfg, *p.admin)) {
+		l.admin.Close()
+		l.admin = nil
+	}
+	if l.admin != nil || p.admin == nil {
+		return nil
+	}
+	admin, err := NewAdminServer(*p.admin, l)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	l.admin = admin
+	l.admin.Start()
+	return nil
+}
+
+// Rules returns the rules in order of name
+func (l *ClientSet) Rules() []RuleStatus {
+	l.mu.Lock()
+	p := l.plan
+	l.mu.Unlock()
+	res := []RuleStatus{}
+	for _, r := range p.rulers() {
+		res = append(res, RuleStatus{RuleInfo: r.RuleInfo, Enabled: l.ruleEnabled(r.Name)})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Clients returns the clients in order of name
+func (l *ClientSet) Clients() []ClientStatus {
+	l.mu.Lock()
+	p := l.plan
+	l.mu.Unlock()
+	res := []ClientStatus{}
+	for _, v := range p.details {
+		res = append(res, ClientStatus{Name: v.Name, Kind: v.Info.Kind, Subscriptions: v.Subscription})
+	}
+	for _, v := range p.servers {
+		res = append(res, ClientStatus{Name: v.info.Name, Kind: v.info.Kind})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// SetRuleEnabled enables or disables the rule, the messages of a disabled rule are dropped,
+// the status is kept until the rule is removed
+func (l *ClientSet) SetRuleEnabled(name string, enabled bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.plan.ruler(name) == nil {
+		return errors.Errorf("rule (%s) not found", name)
+	}
+	l.disabledMu.Lock()
+	defer l.disabledMu.Unlock()
+	if enabled {
+		delete(l.disabled, name)
+	} else {
+		l.disabled[name] = true
+	}
+	return nil
+}
+
+func (l *ClientSet) ruleEnabled(name string) bool {
+	l.disabledMu.RLock()
+	defer l.disabledMu.RUnlock()
+	return !l.disabled[name]
+}
+
+func (l *ClientSet) loadRoutes() *routes {
+	return l.routes.Load().(*routes)
+}
+
+// checkRuleClients checks that the targets of rule and routes, and dead letter refer to existing clients
+func checkRuleClients(rule config.RuleInfo, clientInfo map[string]*ClientDetail) error {
+	refs := allTargets(rule)
+	if rule.DeadLetter != nil {
+		refs = append(refs[:len(refs):len(refs)], *rule.DeadLetter)
+	}
+	for _, ref := range refs {
+		detail, ok := clientInfo[ref.Client]
+		if !ok {
+			return errors.Errorf("client (%s) not found in rule (%s)", ref.Client, rule.Name)
+		}
+		if kind := detail.Info.Kind; kind == config.KindTimer {
+			return errors.Errorf("client (%s) of kind (%s) can only be the source in rule (%s)", ref.Client, kind, rule.Name)
+		}
+	}
+	return nil
+}
+
+func checkRuleResponse(rule config.RuleInfo, clientInfo map[string]*ClientDetail) error {
+	switch rule.Response {
+	case "", config.ResponseFunction:
+		return nil
+	case config.ResponseTarget:
+		if envelopeEnabled(rule) {
+			return errors.Errorf("response (%s) of rule (%s) is not supported by the envelope of function", rule.Response, rule.Name)
+		}
+		if len(rule.Targets) == 0 {
+			return errors.Errorf("rule (%s) must have a target to respond with its response", rule.Name)
+		}
+		if kind := clientInfo[rule.Targets[0].Client].Info.Kind; kind != config.KinkHTTP {
+			return errors.Errorf("the first target of rule (%s) must be http to respond with its response, but it is (%s)", rule.Name, kind)
+		}
+		return nil
+	default:
+		return errors.Errorf("response (%s) of rule (%s) is not supported", rule.Response, rule.Name)
+	}
 }
 
 func (l *ClientSet) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	for _, v := range l.clients {
 		if v.client != nil {
-			v.client.Close()
+			v.Close()
 		}
 	}
-	if l.server != nil {
-		l.server.Close()
+	for _, v := range l.servers {
+		v.Close()
+	}
+	if l.admin != nil {
+		l.admin.Close()
 	}
 }
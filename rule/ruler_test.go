@@ -926,3 +926,410 @@ rules:
 
 	fmt.Println("--> all clients init successfully <--")
 }
+
+// testEnv the mock broker, the mock http server and the rules started by a test, which are closed once the test ends.
+// The variables like $BROKER, $HTTP and $DIR in the configs of rules are expanded by the env
+type testEnv struct {
+	t      *testing.T
+	dir    string
+	vars   map[string]string
+	router *routing.Router
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	return &testEnv{
+		t:      t,
+		dir:    t.TempDir(),
+		vars:   map[string]string{},
+		router: routing.New(),
+	}
+}
+
+// port allocates a free port as the variable of configs
+func (e *testEnv) port(name string) int {
+	port, err := getFreePort()
+	assert.NoError(e.t, err)
+	e.vars[name] = strconv.Itoa(port)
+	return port
+}
+
+// startBroker starts the mock broker, whose address is $BROKER, the messages not acknowledged are resent by the interval
+func (e *testEnv) startBroker(resendInterval time.Duration) {
+	port := e.port("BROKER_PORT")
+	e.vars["BROKER"] = fmt.Sprintf("tcp://127.0.0.1:%d", port)
+	var cfg mockBrokerConfig
+	cfg.Listeners = []listener.Listener{{Address: fmt.Sprintf("tcp://0.0.0.0:%d", port)}}
+	assert.NoError(e.t, utils.UnmarshalYAML([]byte(fmt.Sprintf(`
+session:
+  persistence:
+    store:
+      source: %s
+  resendInterval: %s
+`, path.Join(e.dir, "broker.db"), resendInterval)), &cfg.Session))
+	broker, err := newBroker(cfg)
+	assert.NoError(e.t, err)
+	e.t.Cleanup(broker.close)
+}
+
+// serveHTTP starts the mock http server, whose address is $HTTP, the routes of env are served if the handler is nil
+func (e *testEnv) serveHTTP(handler fasthttp.RequestHandler) {
+	port := e.port("HTTP_PORT")
+	e.vars["HTTP"] = fmt.Sprintf("http://127.0.0.1:%d", port)
+	if handler == nil {
+		handler = e.router.HandleRequest
+	}
+	server := &fasthttp.Server{Handler: handler}
+	go server.ListenAndServe(fmt.Sprintf(":%d", port))
+	e.t.Cleanup(func() { server.Shutdown() })
+}
+
+// functionClient returns the client calling the functions served by the mock http server
+func (e *testEnv) functionClient() *http.Client {
+	ops := http.NewClientOptions()
+	ops.Address = e.vars["HTTP"]
+	return http.NewClient(ops)
+}
+
+// config expands the variables in config of rules, and parses it
+func (e *testEnv) config(conf string) config.Config {
+	var cfg config.Config
+	assert.NoError(e.t, utils.UnmarshalYAML([]byte(os.Expand(conf, func(name string) string {
+		v, ok := e.vars[name]
+		assert.True(e.t, ok, "variable (%s) is not defined", name)
+		return v
+	})), &cfg))
+	return cfg
+}
+
+// startRules starts the rules of config, the functions are called on the mock http server if it is started.
+// The config returned is parsed again, so it can be changed without touching the rules running
+func (e *testEnv) startRules(conf string) (*ClientSet, config.Config) {
+	var functionClient *http.Client
+	if _, ok := e.vars["HTTP"]; ok {
+		functionClient = e.functionClient()
+	}
+	ctx := context.NewContext("")
+	ctx.LoadOrStore(context.KeyAppName, "test")
+	rules, err := NewRulers(ctx, e.config(conf), functionClient)
+	if !assert.NoError(e.t, err) {
+		e.t.FailNow()
+	}
+	e.t.Cleanup(rules.Close)
+	return rules, e.config(conf)
+}
+
+// connect connects a client to the mock broker with the subscriptions, and waits for the clients of rules to subscribe
+func (e *testEnv) connect(id string, subs ...mqtt.Subscription) *mqttClient {
+	ops := mqtt.NewClientOptions()
+	ops.Address = e.vars["BROKER"]
+	ops.ClientID = id
+	ops.Subscriptions = subs
+	cli := newMqttClient(e.t, ops)
+	assert.NoError(e.t, cli.start())
+	e.t.Cleanup(func() { cli.close() })
+	time.Sleep(time.Second)
+	return cli
+}
+
+// receive returns the next message published to the client
+func (c *mqttClient) receive() *packet.Publish {
+	select {
+	case pkt := <-c.s2c:
+		return pkt.(*packet.Publish)
+	case <-time.After(5 * time.Second):
+		assert.FailNow(c.t, "receive mqtt message timeout")
+		return nil
+	}
+}
+
+// assertNoMessage checks that no more message is published to the client in the duration
+func (c *mqttClient) assertNoMessage(d time.Duration) {
+	select {
+	case pkt := <-c.s2c:
+		assert.Fail(c.t, "receive unexpected message", pkt.(*packet.Publish).Message.Topic)
+	case <-time.After(d):
+	}
+}
+
+// receiveString returns the next value sent to the channel, e.g. the requests received by the mock http server
+func receiveString(t *testing.T, ch <-chan string) string {
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		assert.FailNow(t, "receive timeout")
+		return ""
+	}
+}
+
+// httpRequest sends the request by the client, or by the default client if it is nil
+func httpRequest(cli *fasthttp.Client, method, uri string, header map[string]string, body string) (*fasthttp.Response, error) {
+	if cli == nil {
+		cli = &fasthttp.Client{}
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	req.SetBodyString(body)
+	resp := &fasthttp.Response{}
+	return resp, cli.DoTimeout(req, resp, 5*time.Second)
+}
+
+// configError the change making the config invalid, and the error of reload
+type configError struct {
+	change func(cfg *config.Config)
+	err    string
+}
+
+// assertConfigErrors checks that the config is rejected by the reload after each change, the changes are applied in order
+func assertConfigErrors(t *testing.T, rules *ClientSet, cfg config.Config, tests []configError) {
+	for _, tt := range tests {
+		tt.change(&cfg)
+		assert.EqualError(t, rules.Reload(cfg), tt.err)
+	}
+}
+
+func TestRuleTargets(t *testing.T) {
+	e := newTestEnv(t)
+	e.startBroker(5 * time.Second)
+
+	requests := make(chan string, 10)
+	e.router.Post("/good", func(c *routing.Context) error {
+		requests <- string(c.Request.Body())
+		return nil
+	})
+	e.router.Post("/bad", func(c *routing.Context) error {
+		c.SetStatusCode(400)
+		return nil
+	})
+	e.serveHTTP(nil)
+
+	_, cfg := e.startRules(`
+clients:
+  - name: mock-broker
+    kind: mqtt
+    address: '$BROKER'
+  - name: mock-http
+    kind: http
+    address: '$HTTP'
+rules:
+  - name: rule-fanout
+    source:
+      client: mock-broker
+      topic: fan/in
+      qos: 1
+    target:
+      client: mock-broker
+      topic: fan/a
+    targets:
+      - client: mock-http
+        path: /bad
+      - client: mock-broker
+        topic: fan/b
+        qos: 1
+      - client: mock-http
+        path: /good
+`)
+	cli := e.connect("fan-out", mqtt.Subscription{Topic: "fan/a", QOS: 1}, mqtt.Subscription{Topic: "fan/b", QOS: 1})
+
+	// the failed target does not affect the others, and each target uses its own qos
+	assert.NoError(t, cli.pub(newPublishPacket(1, 1, "fan/in", `{"temp":1}`)))
+	received := map[string]mqtt.QOS{}
+	for i := 0; i < 2; i++ {
+		pub := cli.receive()
+		assert.Equal(t, `{"temp":1}`, string(pub.Message.Payload))
+		received[pub.Message.Topic] = pub.Message.QOS
+	}
+	assert.Equal(t, map[string]mqtt.QOS{"fan/a": 0, "fan/b": 1}, received)
+	assert.Equal(t, `{"temp":1}`, receiveString(t, requests))
+
+	// the client of targets must exist
+	cfg.Rules[0].Targets = append(cfg.Rules[0].Targets, config.ClientRef{Client: "unknown"})
+	_, err := NewRulers(nil, cfg, nil)
+	assert.EqualError(t, err, "client (unknown) not found in rule (rule-fanout)")
+}
+
+func TestRuleReload(t *testing.T) {
+	e := newTestEnv(t)
+	e.startBroker(5 * time.Second)
+
+	requests := make(chan string, 10)
+	e.router.Post("/reload", func(c *routing.Context) error {
+		requests <- string(c.Request.Body())
+		return nil
+	})
+	e.serveHTTP(nil)
+
+	conf1 := `
+clients:
+  - name: mock-broker
+    kind: mqtt
+    address: '$BROKER'
+rules:
+  - name: rule1
+    source:
+      client: mock-broker
+      topic: reload/in1
+    target:
+      client: mock-broker
+      topic: reload/out1
+`
+	conf2 := `
+clients:
+  - name: mock-broker
+    kind: mqtt
+    address: '$BROKER'
+  - name: mock-http
+    kind: http
+    address: '$HTTP'
+rules:
+  - name: rule1
+    source:
+      client: mock-broker
+      topic: reload/in1
+    target:
+      client: mock-broker
+      topic: reload/out2
+`
+	conf3 := conf2 + `
+  - name: rule2
+    source:
+      client: mock-broker
+      topic: reload/in2
+    target:
+      client: mock-http
+      path: /reload
+`
+	rules, cfg1 := e.startRules(conf1)
+	cli := e.connect("reload", mqtt.Subscription{Topic: "reload/+", QOS: 0})
+
+	assertForward := func(in, out, payload string) {
+		assert.NoError(t, cli.pub(newPublishPacket(0, 0, in, payload)))
+		pub := cli.receive()
+		// the messages published by the client itself are skipped
+		for strings.HasPrefix(pub.Message.Topic, "reload/in") {
+			pub = cli.receive()
+		}
+		assert.Equal(t, out, pub.Message.Topic)
+		assert.Equal(t, payload, string(pub.Message.Payload))
+	}
+	assertForward("reload/in1", "reload/out1", "1")
+
+	// the target of rule is changed, the source client keeps running
+	broker1 := rules.clients["mock-broker"]
+	assert.NoError(t, rules.Reload(e.config(conf2)))
+	assert.Same(t, broker1, rules.clients["mock-broker"])
+	assert.Contains(t, rules.clients, "mock-http")
+	assertForward("reload/in1", "reload/out2", "2")
+
+	// the topic is subscribed on the running source client
+	cfg3 := e.config(conf3)
+	assert.NoError(t, rules.Reload(cfg3))
+	assert.Same(t, broker1, rules.clients["mock-broker"])
+	time.Sleep(time.Second)
+	assertForward("reload/in1", "reload/out2", "3")
+	assert.NoError(t, cli.pub(newPublishPacket(0, 0, "reload/in2", "4")))
+	assert.Equal(t, "4", receiveString(t, requests))
+
+	// the order of rules does not matter
+	reordered := e.config(conf3)
+	reordered.Rules[0], reordered.Rules[1] = reordered.Rules[1], reordered.Rules[0]
+	assert.NoError(t, rules.Reload(reordered))
+	assert.Same(t, broker1, rules.clients["mock-broker"])
+
+	// the invalid config is not applied
+	cfg3.Rules = append(cfg3.Rules, config.RuleInfo{
+		Name:   "rule3",
+		Source: &config.ClientRef{Client: "unknown"},
+		Target: &config.ClientRef{Client: "mock-broker"},
+	})
+	assert.EqualError(t, rules.Reload(cfg3), "client (unknown) not found in rule (rule3)")
+	assert.Len(t, rules.clients, 2)
+
+	// the removed client is closed, the mqtt client can not unsubscribe the topic, it is restarted
+	assert.NoError(t, rules.Reload(cfg1))
+	assert.NotContains(t, rules.clients, "mock-http")
+	assert.NotSame(t, broker1, rules.clients["mock-broker"])
+	time.Sleep(time.Second)
+	assertForward("reload/in1", "reload/out1", "5")
+}
+
+func TestTimerSource(t *testing.T) {
+	e := newTestEnv(t)
+	bodies := make(chan string, 10)
+	e.serveHTTP(func(ctx *fasthttp.RequestCtx) {
+		bodies <- string(ctx.Path()) + " " + string(ctx.Request.Body())
+	})
+	rules, cfg := e.startRules(`
+clients:
+  - name: mock-http
+    kind: http
+    address: '$HTTP'
+  - name: heartbeat
+    kind: timer
+    interval: 100ms
+    payload: '{"node":"n1","seq":{count}}'
+rules:
+  - name: rule-heartbeat
+    source:
+      client: heartbeat
+    target:
+      client: mock-http
+      path: /heartbeat/{client}
+    select: node, seq * 10 AS value
+`)
+
+	// the ticks are processed by the rule in order
+	for i := 1; i <= 2; i++ {
+		assert.Equal(t, fmt.Sprintf(`/heartbeat/heartbeat {"node":"n1","value":%d}`, i*10), receiveString(t, bodies))
+	}
+
+	// the timer can only be the source
+	cfg.Rules[0].Target = &config.ClientRef{Client: "heartbeat"}
+	assert.EqualError(t, rules.Reload(cfg), "client (heartbeat) of kind (timer) can only be the source in rule (rule-heartbeat)")
+}
+
+func TestHttpPollSource(t *testing.T) {
+	e := newTestEnv(t)
+	reports := make(chan string, 10)
+	e.router.Get("/api/weather", func(c *routing.Context) error {
+		c.SetBodyString(`{"temp":21,"humidity":40}`)
+		return nil
+	})
+	e.router.Post("/api/report", func(c *routing.Context) error {
+		reports <- string(c.Request.Body())
+		return nil
+	})
+	e.serveHTTP(nil)
+	rules, cfg := e.startRules(`
+clients:
+  - name: weather
+    kind: http
+    address: '$HTTP'
+    poll:
+      path: /api/weather
+      interval: 100ms
+      onChange: true
+rules:
+  - name: rule-weather
+    source:
+      client: weather
+    target:
+      client: weather
+      path: /api/report
+    select: temp
+`)
+
+	// the body polled is processed by the rule, the same body is emitted only once
+	assert.Equal(t, `{"temp":21}`, receiveString(t, reports))
+	time.Sleep(500 * time.Millisecond)
+	assert.Len(t, reports, 0)
+
+	// the http client is the source only if poll is configured
+	delete(cfg.Clients[0].Value, "poll")
+	assert.EqualError(t, rules.Reload(cfg), "client (weather) must be configured with poll to be the source of rule (rule-weather)")
+}
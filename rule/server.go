@@ -1,7 +1,11 @@
 package rule
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	gohttp "net/http"
+	"strings"
 	"time"
 
 	"github.com/baetyl/baetyl-go/v2/errors"
@@ -11,98 +15,201 @@ import (
 	routing "github.com/qiangxue/fasthttp-routing"
 	"github.com/valyala/fasthttp"
 
-	"github.com/baetyl/baetyl-rule/v2/client"
 	"github.com/baetyl/baetyl-rule/v2/config"
 )
 
 type ServerConfig struct {
 	Port int32 `yaml:"port" json:"port"`
-	utils.Certificate
+	// Timeout the max time to wait for the response of target, if the rule responds with it
+	Timeout time.Duration `yaml:"timeout" json:"timeout" default:"30s"`
+	// ClientAuth requires the callers to present a client certificate verified against ca,
+	// the common name of certificate is the identity of caller
+	ClientAuth bool `yaml:"clientAuth" json:"clientAuth"`
+	// Auth the bearer tokens and basic credentials accepted from callers
+	Auth              config.AuthConfig `yaml:"auth" json:"auth"`
+	utils.Certificate `yaml:",inline" json:",inline"`
 }
 
 type HTTPServer struct {
-	name        string
-	cfg         *ServerConfig
-	server      *http.Server
-	functionCli *http.Client
-	rulers      map[string]config.RuleInfo // key: rule name
-	client      map[string]client.Client   // key: client name
-	logger      *log.Logger
+	name   string
+	info   config.ClientInfo
+	cfg    *ServerConfig
+	server *http.Server
+	set    *ClientSet
+	logger *log.Logger
 }
 
-func NewHTTPServer(info config.ClientInfo, functionCli *http.Client) (*HTTPServer, error) {
+// NewHTTPServer creates the http server, whose requests are routed to the rules by the current routes of client set
+func NewHTTPServer(info config.ClientInfo, set *ClientSet) (*HTTPServer, error) {
 	cfg := new(ServerConfig)
 	err := info.Parse(cfg)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 	svc := &HTTPServer{
-		name:        info.Name,
-		cfg:         cfg,
-		functionCli: functionCli,
-		rulers:      map[string]config.RuleInfo{},
-		client:      map[string]client.Client{},
-		logger:      log.With(log.Any("http server", info.Name)),
+		name:   info.Name,
+		info:   info,
+		cfg:    cfg,
+		set:    set,
+		logger: log.With(log.Any("http server", info.Name)),
+	}
+	if cfg.ClientAuth {
+		if cfg.CA == "" || cfg.Cert == "" || cfg.Key == "" {
+			return nil, errors.Errorf("ca, cert and key of http server (%s) are required by client auth", info.Name)
+		}
+		cfg.ClientAuthType = tls.RequireAndVerifyClientCert
 	}
 	svc.server = http.NewServer(http.ServerConfig{
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 30 * time.Second,
+		Certificate:  cfg.Certificate,
 	}, svc.initRouter())
 	return svc, nil
 }
 
 func (h *HTTPServer) initRouter() fasthttp.RequestHandler {
 	router := routing.New()
-	router.Post("/rules/<ruleName>", Wrapper(h.HandleHTTPRule))
+	// the routes of rules are matched per request, since they are replaced when rules are reloaded
+	router.NotFound(Wrapper(h.HandleHTTPRule))
 	return router.HandleRequest
 }
 
 func (h *HTTPServer) HandleHTTPRule(ctx *routing.Context) (interface{}, error) {
-	var err error
-	ruleName := ctx.Param("ruleName")
-	ruleInfo, ok := h.rulers[ruleName]
-	if !ok {
-		err = errors.New("rule name not found")
-		http.RespondMsg(ctx, 400, "RequestParamInvalid", err.Error())
+	// the caller is authenticated before the routes are matched, which does not reveal the rules
+	identity, err := authenticate(&h.cfg.Auth, ctx.RequestCtx)
+	if err != nil {
+		ctx.Response.Header.Set(fasthttp.HeaderWWWAuthenticate, `Bearer, Basic realm="baetyl-rule"`)
+		http.RespondMsg(ctx, fasthttp.StatusUnauthorized, "Unauthorized", err.Error())
 		return nil, errors.Trace(err)
 	}
-	data := ctx.Request.Body()
-	if ruleInfo.Function != nil {
-		data, err = h.functionCli.Call(ruleInfo.Function.Name, ctx.Request.Body())
-		if err != nil {
-			http.RespondMsg(ctx, 500, "Failed to call function", err.Error())
+	rs := h.set.loadRoutes()
+	var ruleInfo *Ruler
+	var params map[string]string
+	if server, ok := rs.servers[h.name]; ok {
+		ruleInfo, params = server.match(string(ctx.Method()), string(ctx.Path()))
+	}
+	if ruleInfo == nil {
+		if ctx.IsPost() && strings.HasPrefix(string(ctx.Path()), rulePathPrefix) {
+			err = errors.New("rule name not found")
+			http.RespondMsg(ctx, 400, "RequestParamInvalid", err.Error())
 			return nil, errors.Trace(err)
 		}
+		err = errors.Errorf("no rule matches (%s %s)", ctx.Method(), ctx.Path())
+		http.RespondMsg(ctx, fasthttp.StatusNotFound, "RouteNotFound", err.Error())
+		return nil, errors.Trace(err)
+	}
+	ruleName := ruleInfo.Name
+	if !allowed(ruleInfo.Allow, identity) {
+		err = errors.Errorf("caller (%s) is not allowed to trigger rule (%s)", identity, ruleName)
+		http.RespondMsg(ctx, fasthttp.StatusForbidden, "Forbidden", err.Error())
+		return nil, errors.Trace(err)
+	}
+	if !h.set.ruleEnabled(ruleName) {
+		err = errors.New("rule is disabled")
+		http.RespondMsg(ctx, 403, "RuleDisabled", err.Error())
+		return nil, errors.Trace(err)
+	}
+	data, err := ruleInfo.process(h.set.functionClient, "", nil, ctx.Request.Body())
+	if re, ok := err.(*routedError); ok {
+		// the caller is still responded with the failure
+		if serr := sendFunctionError(rs, ruleInfo, re, params, nil, h.logger); serr != nil {
+			h.logger.Error("failed to route function error", log.Any("rule", ruleName), log.Error(serr))
+		}
+	}
+	if err != nil {
+		http.RespondMsg(ctx, 500, "Failed to process message", err.Error())
+		return nil, errors.Trace(err)
+	}
+	if len(data) == 0 {
+		if ruleInfo.Response != "" {
+			// the message is filtered out
+			return &Response{StatusCode: fasthttp.StatusNoContent}, nil
+		}
+		return map[string]bool{
+			"success": true,
+		}, nil
+	}
+	var failed []string
+	var reply *config.TargetMsg
+	done := make(chan struct{})
+	deliveries, err := ruleInfo.deliveries("", nil, data, rs.clients)
+	if err != nil {
+		http.RespondMsg(ctx, 500, "Failed to route message", err.Error())
+		return nil, errors.Trace(err)
 	}
-	if ruleInfo.Target != nil && len(data) != 0 {
-		out := generatePackage(config.KinkHTTP, data, ruleInfo.Source, ruleInfo.Target)
-		err = h.client[ruleInfo.Target.Client].SendOrDrop(out)
+	for i := range deliveries {
+		target := &deliveries[i].target
+		out := generatePackage(config.KinkHTTP, data, nil, params, ruleInfo.Name, ruleInfo.Source, target)
+		deliveries[i].apply(out)
+		if i == 0 && ruleInfo.Response == config.ResponseTarget {
+			reply = out
+			out.Response = &config.TargetResponse{}
+			out.Callback = func(error) {
+				close(done)
+			}
+		}
+		if ruleInfo.DeadLetter != nil {
+			setDeadLetter(ruleInfo.RuleInfo, out, rs.clients[ruleInfo.DeadLetter.Client], h.logger)
+		}
+		err = sendToTarget(rs.clients[target.Client], ruleInfo.Name, out)
 		if err != nil {
-			http.RespondMsg(ctx, 500, "Failed to send to target", err.Error())
-			return nil, errors.Trace(err)
+			h.logger.Error("failed to send pkt to target in source", log.Any("target", target.Client), log.Error(err))
+			failed = append(failed, fmt.Sprintf("%s: %s", target.Client, err.Error()))
+			continue
 		}
 		h.logger.Debug("send pkt to target in source", log.Any("pkt", out))
 	}
+	if len(failed) != 0 {
+		err = errors.Errorf("failed to send to targets (%s)", strings.Join(failed, "; "))
+		http.RespondMsg(ctx, 500, "Failed to send to target", err.Error())
+		return nil, errors.Trace(err)
+	}
+	switch ruleInfo.Response {
+	case config.ResponseFunction:
+		return &Response{StatusCode: fasthttp.StatusOK, ContentType: contentType(data), Body: data}, nil
+	case config.ResponseTarget:
+		return h.targetResponse(ctx, reply, done)
+	}
 	return map[string]bool{
 		"success": true,
 	}, nil
 }
 
-func (h *HTTPServer) Start() {
-	if len(h.rulers) == 0 {
-		return
+// targetResponse waits for the delivery of message and returns the response of target
+func (h *HTTPServer) targetResponse(ctx *routing.Context, msg *config.TargetMsg, done chan struct{}) (interface{}, error) {
+	timer := time.NewTimer(h.cfg.Timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		err := errors.Errorf("wait for the response of target (%s) timeout", msg.TargetInfo.Client)
+		http.RespondMsg(ctx, fasthttp.StatusGatewayTimeout, "TargetTimeout", err.Error())
+		return nil, errors.Trace(err)
 	}
+	res := msg.Response
+	if res.StatusCode == 0 {
+		err := errors.Errorf("no response of target (%s)", msg.TargetInfo.Client)
+		http.RespondMsg(ctx, fasthttp.StatusBadGateway, "Failed to send to target", err.Error())
+		return nil, errors.Trace(err)
+	}
+	return &Response{StatusCode: res.StatusCode, ContentType: res.ContentType, Body: res.Body}, nil
+}
+
+// contentType returns the content type of function result
+func contentType(data []byte) string {
+	if json.Valid(data) {
+		return "application/json"
+	}
+	return gohttp.DetectContentType(data)
+}
+
+func (h *HTTPServer) Start() {
 	go func() {
 		address := fmt.Sprintf(":%d", h.cfg.Port)
 		h.logger.Info("server is running", log.Any("address", address))
-		if h.cfg.Cert != "" && h.cfg.Key != "" && h.cfg.CA != "" {
-			if err := h.server.ListenAndServeTLS(address, h.cfg.Cert, h.cfg.Key); err != nil {
-				h.logger.Error("https server shutdown", log.Error(err))
-			}
-		} else {
-			if err := h.server.ListenAndServe(address); err != nil {
-				h.logger.Error("http server shutdown", log.Error(err))
-			}
+		secure := h.cfg.Cert != "" && h.cfg.Key != "" && h.cfg.CA != ""
+		if err := serve(h.server, address, h.cfg.ClientAuth, secure, h.cfg.Cert, h.cfg.Key); err != nil {
+			h.logger.Error("http server shutdown", log.Error(err))
 		}
 	}()
 }
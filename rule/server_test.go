@@ -0,0 +1,110 @@
+package rule
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestHttpSourceResponse(t *testing.T) {
+	e := newTestEnv(t)
+	port := e.port("SOURCE_PORT")
+	e.router.Post("/api", func(c *routing.Context) error {
+		if string(c.Request.Body()) == `{"temp":-1}` {
+			c.SetStatusCode(404)
+			c.SetContentType("text/plain")
+			c.SetBodyString("device not found")
+			return nil
+		}
+		c.SetStatusCode(201)
+		c.SetContentType("application/json")
+		c.SetBodyString(`{"id":1}`)
+		return nil
+	})
+	e.router.Post("/ignored", func(c *routing.Context) error {
+		return nil
+	})
+	e.serveHTTP(nil)
+
+	rules, cfg := e.startRules(`
+clients:
+  - name: mock-http
+    kind: http
+    address: '$HTTP'
+  - name: http-source
+    kind: http-server
+    port: $SOURCE_PORT
+rules:
+  - name: rule-target
+    source:
+      client: http-source
+    target:
+      client: mock-http
+      path: /api
+    response: target
+  - name: rule-function
+    source:
+      client: http-source
+    target:
+      client: mock-http
+      path: /ignored
+    select: temp * 2 AS double
+    where: temp > 0
+    response: function
+`)
+	time.Sleep(500 * time.Millisecond)
+
+	tests := []struct {
+		name        string
+		rule        string
+		body        string
+		code        int
+		contentType string
+		response    string
+		// the response is generated as json, whose fields may be in any order
+		json bool
+	}{
+		// the response of target is passed through, including the failure
+		{name: "target", rule: "rule-target", body: `{"temp":1}`, code: 201, contentType: "application/json", response: `{"id":1}`},
+		{name: "target failure", rule: "rule-target", body: `{"temp":-1}`, code: 404, contentType: "text/plain", response: "device not found"},
+		// the result of process is responded, and nothing is responded if it is filtered out
+		{name: "function", rule: "rule-function", body: `{"temp":2}`, code: 200, contentType: "application/json", response: `{"double":4}`, json: true},
+		{name: "filtered", rule: "rule-function", body: `{"temp":-2}`, code: 204},
+	}
+	for _, tt := range tests {
+		resp, err := httpRequest(nil, "POST", fmt.Sprintf("http://127.0.0.1:%d/rules/%s", port, tt.rule), nil, tt.body)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.code, resp.StatusCode(), tt.name)
+		if tt.response == "" {
+			assert.Empty(t, resp.Body(), tt.name)
+			continue
+		}
+		assert.Equal(t, tt.contentType, string(resp.Header.ContentType()), tt.name)
+		if tt.json {
+			assert.JSONEq(t, tt.response, string(resp.Body()), tt.name)
+		} else {
+			assert.Equal(t, tt.response, string(resp.Body()), tt.name)
+		}
+	}
+
+	// the response is only supported by http-server, and the first target must be http to respond with its response
+	assertConfigErrors(t, rules, cfg, []configError{
+		{
+			change: func(cfg *config.Config) { cfg.Rules[0].Response = "unknown" },
+			err:    "response (unknown) of rule (rule-target) is not supported",
+		},
+		{
+			change: func(cfg *config.Config) {
+				cfg.Rules[0].Response = config.ResponseTarget
+				cfg.Rules[0].Target = &config.ClientRef{Client: "mock-http"}
+				cfg.Rules[0].Source = &config.ClientRef{Client: "mock-http"}
+			},
+			err: "response of rule (rule-target) is only supported by http-server source",
+		},
+	})
+}
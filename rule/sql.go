@@ -0,0 +1,185 @@
+package rule
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+var (
+	sqlAlias = regexp.MustCompile(`(?is)^(.+)\s+as\s+([A-Za-z_][A-Za-z0-9_]*)$`)
+	sqlPath  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+)
+
+// SQL filters and projects json payloads in process. The fields of a json object payload can be used
+// in expressions directly, and the variables topic, meta and payload refer to the topic, the meta of
+// mqtt packet and the whole payload, which take precedence over the fields with the same names
+type SQL struct {
+	all    bool // select *
+	fields []sqlField
+	where  *vm.Program
+}
+
+type sqlField struct {
+	name    string
+	program *vm.Program
+}
+
+// NewSQL compiles the select and where of rule, select is a comma separated list of
+// expressions, each expression is named by its alias (expr AS name) or its last field
+func NewSQL(selects, where string) (*SQL, error) {
+	s := new(SQL)
+	var err error
+	if strings.TrimSpace(where) != "" {
+		s.where, err = expr.Compile(where, expr.AsBool())
+		if err != nil {
+			return nil, errors.Errorf("failed to compile where (%s): %s", where, err.Error())
+		}
+	}
+	if strings.TrimSpace(selects) == "" {
+		return s, nil
+	}
+	for _, item := range splitSelect(selects) {
+		item = strings.TrimSpace(item)
+		if item == "*" {
+			s.all = true
+			continue
+		}
+		code, name := item, ""
+		if m := sqlAlias.FindStringSubmatch(item); m != nil {
+			code, name = strings.TrimSpace(m[1]), m[2]
+		} else if sqlPath.MatchString(item) {
+			name = item[strings.LastIndex(item, ".")+1:]
+		} else {
+			return nil, errors.Errorf("alias is required for select field (%s)", item)
+		}
+		program, err := expr.Compile(code)
+		if err != nil {
+			return nil, errors.Errorf("failed to compile select field (%s): %s", item, err.Error())
+		}
+		s.fields = append(s.fields, sqlField{name: name, program: program})
+	}
+	return s, nil
+}
+
+// Process evaluates the where and select with the json payload, it returns nil if the message is
+// filtered out by where, and returns the payload as it is if no field is selected
+func (s *SQL) Process(topic string, meta map[string]any, payload []byte) ([]byte, error) {
+	var value any
+	err := json.Unmarshal(payload, &value)
+	if err != nil {
+		return nil, errors.Errorf("payload is not json: %s", err.Error())
+	}
+	obj, _ := value.(map[string]any)
+	env := sqlEnv(topic, meta, value)
+
+	if s.where != nil {
+		ok, err := expr.Run(s.where, env)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if !ok.(bool) {
+			return nil, nil
+		}
+	}
+	if !s.all && len(s.fields) == 0 {
+		return payload, nil
+	}
+	out := map[string]any{}
+	if s.all {
+		for k, v := range obj {
+			out[k] = v
+		}
+	}
+	for _, f := range s.fields {
+		out[f.name], err = expr.Run(f.program, env)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	data, err := json.Marshal(out)
+	return data, errors.Trace(err)
+}
+
+// sqlEnv returns the variables of expressions, which are the fields of json object payload,
+// and the topic, meta and payload of message
+func sqlEnv(topic string, meta map[string]any, value any) map[string]any {
+	obj, _ := value.(map[string]any)
+	env := make(map[string]any, len(obj)+3)
+	for k, v := range obj {
+		env[k] = v
+	}
+	env["topic"] = topic
+	env["meta"] = sqlMeta(meta)
+	env["payload"] = value
+	return env
+}
+
+// sqlMeta converts the integers of meta like packet id and qos to int, so that they can be compared with numbers,
+// and the user properties to the map of their values, the last value is taken if the key repeats
+func sqlMeta(meta map[string]any) map[string]any {
+	res := make(map[string]any, len(meta))
+	for k, v := range meta {
+		if k == config.MetaUserProperties {
+			users := map[string]string{}
+			for _, u := range config.UserProperties(meta) {
+				users[u.Key] = u.Value
+			}
+			res[k] = users
+			continue
+		}
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			res[k] = int(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			res[k] = int(rv.Uint())
+		default:
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// splitSelect splits the select by the commas which are not in brackets or quotes
+func splitSelect(selects string) []string {
+	var items []string
+	var depth int
+	var quote rune
+	var escaped bool
+	start := 0
+	for i, c := range selects {
+		if quote != 0 {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == quote:
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, selects[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(items, selects[start:])
+}
@@ -0,0 +1,70 @@
+package rule
+
+import (
+	"testing"
+
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestSQL(t *testing.T) {
+	meta := map[string]any{"ID": mqtt.ID(3), "QoS": mqtt.QOS(1), "Retain": false}
+	payload := []byte(`{"temp":85,"ts":1600000000,"topic":"inner","device":{"id":"d1"}}`)
+
+	s, err := NewSQL("temp, ts, device.id, temp * 1.8 + 32 AS fahrenheit, topic AS topic, meta.QoS as qos", "temp > 80")
+	assert.NoError(t, err)
+	data, err := s.Process("broker/topic1", meta, payload)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"temp":85,"ts":1600000000,"id":"d1","fahrenheit":185,"topic":"broker/topic1","qos":1}`, string(data))
+
+	// filtered out by where
+	data, err = s.Process("broker/topic1", meta, []byte(`{"temp":20,"ts":1600000000}`))
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+
+	// the payload is returned as it is without select
+	s, err = NewSQL("", `topic startsWith "broker/" && meta.QoS == 1 && payload.topic == "inner"`)
+	assert.NoError(t, err)
+	data, err = s.Process("broker/topic1", meta, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, payload, data)
+
+	// select all fields with new ones, the commas in brackets and quotes are not separators
+	s, err = NewSQL(`*, join(["a", "b"], ",") AS joined, "x, y" AS text`, "")
+	assert.NoError(t, err)
+	data, err = s.Process("broker/topic1", nil, []byte(`{"temp":85}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"temp":85,"joined":"a,b","text":"x, y"}`, string(data))
+
+	_, err = s.Process("broker/topic1", nil, []byte(`not json`))
+	assert.Error(t, err)
+
+	// the user properties are referred by their keys, the last value is taken if the key repeats
+	s, err = NewSQL("", `meta.UserProperties.site == "s2" && meta.QoS == 1`)
+	assert.NoError(t, err)
+	meta = map[string]any{"QoS": mqtt.QOS(1), config.MetaUserProperties: []config.UserProperty{{Key: "site", Value: "s1"}, {Key: "site", Value: "s2"}}}
+	data, err = s.Process("broker/topic1", meta, []byte(`{"temp":85}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"temp":85}`, string(data))
+
+	_, err = NewSQL("temp + 1", "")
+	assert.EqualError(t, err, "alias is required for select field (temp + 1)")
+	_, err = NewSQL("", "temp >")
+	assert.Error(t, err)
+}
+
+func TestRulerProcess(t *testing.T) {
+	_, err := newRuler(config.RuleInfo{Name: "rule1", Select: "temp +"})
+	assert.Error(t, err)
+
+	r, err := newRuler(config.RuleInfo{Name: "rule1", Select: "temp", Where: "temp > 80"})
+	assert.NoError(t, err)
+	data, err := r.process(nil, "broker/topic1", nil, []byte(`{"temp":85,"ts":1}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"temp":85}`, string(data))
+	data, err = r.process(nil, "broker/topic1", nil, []byte(`{"temp":20,"ts":1}`))
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+}
@@ -0,0 +1,150 @@
+package rule
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+)
+
+// topicPlaceholder the placeholders in the topic or path of target, which are replaced by the values of source message
+//   - {1}, {2}, ... the levels matched by the '+' wildcards of source topic in order
+//   - {#} the levels matched by the '#' wildcard of source topic
+//   - {topic} the actual topic of source message
+//   - {client} the name of source client
+//   - {rule} the name of rule
+//   - {name} the parameter of path declared by the rule of http-server
+var topicPlaceholder = regexp.MustCompile(`\{(\d+|#|topic|client|rule)\}`)
+
+// paramPlaceholder the placeholders replaced by the parameters of path
+var paramPlaceholder = regexp.MustCompile(`\{([A-Za-z_]\w*)\}`)
+
+// topicVars the values of source message used to generate the topic of target
+type topicVars struct {
+	rule      string
+	client    string
+	topic     string
+	wildcards []string // the levels matched by '+'
+	remainder string   // the levels matched by '#'
+	multi     bool     // whether the source topic has '#'
+	params    map[string]string
+}
+
+func newTopicVars(rule, client, filter, topic string, params map[string]string) *topicVars {
+	v := &topicVars{rule: rule, client: client, topic: topic, params: params}
+	levels := strings.Split(topic, "/")
+	for i, f := range filterLevels(filter) {
+		switch f {
+		case "+":
+			if i < len(levels) {
+				v.wildcards = append(v.wildcards, levels[i])
+			}
+		case "#":
+			v.multi = true
+			if i < len(levels) {
+				v.remainder = strings.Join(levels[i:], "/")
+			}
+			return v
+		}
+	}
+	return v
+}
+
+// render replaces the placeholders of template, and the '+' and '#' levels of template
+// are replaced by the levels matched by the wildcards of source topic in order as well
+func (v *topicVars) render(tpl string) string {
+	if tpl == "" {
+		return tpl
+	}
+	if v.remainder == "" {
+		// the '#' matches the parent level, e.g. 'a/#' matches 'a'
+		tpl = strings.ReplaceAll(tpl, "/{#}", "")
+	}
+	tpl = topicPlaceholder.ReplaceAllStringFunc(tpl, func(s string) string {
+		switch name := s[1 : len(s)-1]; name {
+		case "#":
+			return v.remainder
+		case "topic":
+			return v.topic
+		case "client":
+			return v.client
+		case "rule":
+			return v.rule
+		default:
+			index, _ := strconv.Atoi(name)
+			if index < 1 || index > len(v.wildcards) {
+				return s
+			}
+			return v.wildcards[index-1]
+		}
+	})
+	if len(v.params) != 0 {
+		tpl = paramPlaceholder.ReplaceAllStringFunc(tpl, func(s string) string {
+			if p, ok := v.params[s[1:len(s)-1]]; ok {
+				return p
+			}
+			return s
+		})
+	}
+	if !strings.ContainsAny(tpl, "+#") {
+		return tpl
+	}
+	var levels []string
+	next := 0
+	for _, l := range strings.Split(tpl, "/") {
+		switch {
+		case l == "+" && next < len(v.wildcards):
+			l = v.wildcards[next]
+			next++
+		case l == "#" && v.multi:
+			if v.remainder == "" {
+				continue
+			}
+			l = v.remainder
+		}
+		levels = append(levels, l)
+	}
+	return strings.Join(levels, "/")
+}
+
+// checkTopicTemplate checks that the wildcards referenced by the placeholders of template exist in source topic
+func checkTopicTemplate(tpl, filter string) error {
+	var wildcards int
+	var multi bool
+	for _, f := range filterLevels(filter) {
+		switch f {
+		case "+":
+			wildcards++
+		case "#":
+			multi = true
+		}
+	}
+	for _, m := range topicPlaceholder.FindAllStringSubmatch(tpl, -1) {
+		switch m[1] {
+		case "#":
+			if !multi {
+				return errors.Errorf("placeholder (%s) of (%s) references '#' which is not in source topic (%s)", m[0], tpl, filter)
+			}
+		case "topic", "client", "rule":
+		default:
+			index, _ := strconv.Atoi(m[1])
+			if index < 1 || index > wildcards {
+				return errors.Errorf("placeholder (%s) of (%s) references '+' which is not in source topic (%s)", m[0], tpl, filter)
+			}
+		}
+	}
+	return nil
+}
+
+// filterLevels returns the levels of topic filter, the prefix of shared subscription is removed
+func filterLevels(filter string) []string {
+	if filter == "" {
+		return nil
+	}
+	levels := strings.Split(filter, "/")
+	if levels[0] == "$share" && len(levels) > 2 {
+		return levels[2:]
+	}
+	return levels
+}
@@ -0,0 +1,52 @@
+package rule
+
+import (
+	"testing"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+func TestTopicTemplate(t *testing.T) {
+	vars := newTopicVars("rule1", "broker", "site/+/line/+/sensor/#", "site/s1/line/l2/sensor/temp/1", nil)
+	assert.Equal(t, "cloud/s1/l2/telemetry", vars.render("cloud/{1}/{2}/telemetry"))
+	assert.Equal(t, "cloud/s1/l2/temp/1", vars.render("cloud/{1}/{2}/{#}"))
+	assert.Equal(t, "cloud/broker/rule1/site/s1/line/l2/sensor/temp/1", vars.render("cloud/{client}/{rule}/{topic}"))
+	assert.Equal(t, "/api/s1?line=l2", vars.render("/api/{1}?line={2}"))
+	// the wildcards of target are replaced in order
+	assert.Equal(t, "cloud/s1/l2/temp/1", vars.render("cloud/+/+/#"))
+	assert.Equal(t, "cloud/s1/l2/+", vars.render("cloud/+/+/+"))
+	// the undefined placeholders are kept
+	assert.Equal(t, "cloud/{3}/{name}", vars.render("cloud/{3}/{name}"))
+
+	// '#' matches the parent level
+	vars = newTopicVars("rule1", "broker", "site/+/#", "site/s1", nil)
+	assert.Equal(t, "cloud/s1", vars.render("cloud/{1}/{#}"))
+	assert.Equal(t, "cloud/s1", vars.render("cloud/+/#"))
+
+	// the prefix of shared subscription is not a level of topic
+	vars = newTopicVars("rule1", "broker", "$share/group/site/+", "site/s1", nil)
+	assert.Equal(t, "cloud/s1", vars.render("cloud/{1}"))
+
+	assert.NoError(t, checkTopicTemplate("cloud/{1}/{2}/{#}/{client}/{rule}/{topic}", "site/+/line/+/sensor/#"))
+	assert.NoError(t, checkTopicTemplate("cloud/{name}", ""))
+	assert.EqualError(t, checkTopicTemplate("cloud/{3}", "site/+/line/+"), "placeholder ({3}) of (cloud/{3}) references '+' which is not in source topic (site/+/line/+)")
+	assert.EqualError(t, checkTopicTemplate("cloud/{#}", "site/+"), "placeholder ({#}) of (cloud/{#}) references '#' which is not in source topic (site/+)")
+
+	_, err := newRuler(config.RuleInfo{
+		Name:    "rule1",
+		Source:  &config.ClientRef{Client: "broker", MQTTRef: config.MQTTRef{Topic: "site/+"}},
+		Targets: []config.ClientRef{{Client: "broker", MQTTRef: config.MQTTRef{Topic: "cloud/{1}/{2}"}}},
+	})
+	assert.EqualError(t, err, "invalid target (broker) in rule (rule1): placeholder ({2}) of (cloud/{1}/{2}) references '+' which is not in source topic (site/+)")
+
+	// the topic of kafka target is rendered like the mqtt one, which is written to kafka
+	pkt := packet.NewPublish()
+	pkt.Message = packet.Message{Topic: "site/s1/temp", Payload: []byte("hello")}
+	source := &config.ClientRef{Client: "broker", MQTTRef: config.MQTTRef{Topic: "site/+/#"}}
+	target := &config.ClientRef{Client: "kafka", MQTTRef: config.MQTTRef{Topic: "site-{1}-{rule}"}}
+	msg := generatePackage(config.KindMqtt, pkt, nil, nil, "rule1", source, target)
+	assert.Equal(t, "site-s1-rule1", msg.Topic)
+}
@@ -0,0 +1,91 @@
+package rule
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/baetyl/baetyl-go/v2/errors"
+
+	"github.com/baetyl/baetyl-rule/v2/config"
+)
+
+// SourceClientConfig the config of client to process the messages as source
+type SourceClientConfig struct {
+	Source SourceConfig `yaml:"source" json:"source"`
+}
+
+// SourceConfig the workers processing the messages of source client, the messages with the same order key are
+// processed in order by the same worker, and the ones with different keys are processed concurrently
+type SourceConfig struct {
+	// Workers the number of workers, the messages are processed one by one in the source client if it is not greater than 1
+	Workers int `yaml:"workers" json:"workers" default:"1"`
+	// OrderKey the key of ordering, which is "topic", or the field of json payload prefixed with "payload.",
+	// e.g. "payload.device.id", the messages without the field are ordered by topic
+	OrderKey string `yaml:"orderKey" json:"orderKey" default:"topic"`
+	// QueueSize the number of messages waiting for each worker, the source client is blocked once the queue is full
+	QueueSize int `yaml:"queueSize" json:"queueSize" default:"64"`
+}
+
+// workerPool processes the messages of source client by workers, the jobs with the same key are processed in order
+type workerPool struct {
+	field  string // the field of json payload as order key, the topic is used if it is empty
+	queues []chan func()
+	quit   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newWorkerPool(cfg SourceConfig) (*workerPool, error) {
+	if cfg.QueueSize < 0 {
+		return nil, errors.Errorf("queue size (%d) of source workers must not be negative", cfg.QueueSize)
+	}
+	p := &workerPool{
+		queues: make([]chan func(), cfg.Workers),
+		quit:   make(chan struct{}),
+	}
+	field, ok := config.ParseOrderKey(cfg.OrderKey)
+	if !ok {
+		return nil, errors.Errorf("order key (%s) of source workers must be topic or the field of payload like payload.id", cfg.OrderKey)
+	}
+	p.field = field
+	for i := range p.queues {
+		p.queues[i] = make(chan func(), cfg.QueueSize)
+		p.wg.Add(1)
+		go p.working(p.queues[i])
+	}
+	return p, nil
+}
+
+func (p *workerPool) working(queue chan func()) {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case job := <-queue:
+			job()
+		}
+	}
+}
+
+// orderKey returns the order key of message
+func (p *workerPool) orderKey(pkt *packet.Publish) string {
+	return config.OrderKey(pkt.Message.Topic, pkt.Message.Payload, p.field)
+}
+
+// submit queues the job to the worker of key, it blocks while the queue of worker is full,
+// the job is dropped if the pool is closed
+func (p *workerPool) submit(key string, job func()) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	select {
+	case p.queues[h.Sum32()%uint32(len(p.queues))] <- job:
+	case <-p.quit:
+	}
+}
+
+// close stops the workers once their current jobs are finished, the jobs queued are dropped
+func (p *workerPool) close() {
+	close(p.quit)
+	p.wg.Wait()
+}
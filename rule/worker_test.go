@@ -0,0 +1,113 @@
+package rule
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	routing "github.com/qiangxue/fasthttp-routing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceWorkers(t *testing.T) {
+	e := newTestEnv(t)
+	e.startBroker(5 * time.Second)
+
+	// the function is slow for the message marked as slow
+	e.router.Post("/slow", func(c *routing.Context) error {
+		var msg map[string]any
+		assert.NoError(t, json.Unmarshal(c.Request.Body(), &msg))
+		if msg["slow"] == true {
+			time.Sleep(500 * time.Millisecond)
+		}
+		c.SetBody(c.Request.Body())
+		return nil
+	})
+	e.serveHTTP(nil)
+
+	rules, cfg := e.startRules(`
+clients:
+  - name: topic-broker
+    kind: mqtt
+    address: '$BROKER'
+    source:
+      workers: 4
+  - name: payload-broker
+    kind: mqtt
+    address: '$BROKER'
+    source:
+      workers: 4
+      orderKey: payload.id
+rules:
+  - name: rule-topic
+    source:
+      client: topic-broker
+      topic: topic/+
+    target:
+      client: topic-broker
+      topic: out/topic
+    function:
+      name: slow
+  - name: rule-payload
+    source:
+      client: payload-broker
+      topic: payload/+
+    target:
+      client: payload-broker
+      topic: out/payload
+    function:
+      name: slow
+`)
+	cli := e.connect("workers", mqtt.Subscription{Topic: "out/#", QOS: 0})
+
+	type message struct {
+		topic, payload string
+	}
+	tests := []struct {
+		name     string
+		messages []message
+		// the field n of the messages processed, in order
+		processed []string
+	}{
+		// the messages of other topics are not blocked by the slow one, and the ones of the same topic keep the order
+		{
+			name: "topic",
+			messages: []message{
+				{"topic/a", `{"n":1,"slow":true}`},
+				{"topic/a", `{"n":2}`},
+				{"topic/b", `{"n":3}`},
+			},
+			processed: []string{"3", "1", "2"},
+		},
+		// the messages are ordered by the field of payload, even if their topics are different
+		{
+			name: "payload",
+			messages: []message{
+				{"payload/a", `{"id":"d1","n":4,"slow":true}`},
+				{"payload/b", `{"id":"d1","n":5}`},
+				{"payload/c", `{"id":"d2","n":6}`},
+			},
+			processed: []string{"6", "4", "5"},
+		},
+	}
+	for _, tt := range tests {
+		for _, m := range tt.messages {
+			assert.NoError(t, cli.pub(newPublishPacket(0, 0, m.topic, m.payload)), tt.name)
+		}
+		var processed []string
+		for range tt.processed {
+			var msg map[string]any
+			assert.NoError(t, json.Unmarshal(cli.receive().Message.Payload, &msg), tt.name)
+			processed = append(processed, fmt.Sprint(msg["n"]))
+		}
+		assert.Equal(t, tt.processed, processed, tt.name)
+	}
+
+	cfg.Clients[1].Value = map[string]interface{}{
+		"address": e.vars["BROKER"],
+		"source":  map[string]interface{}{"workers": 2, "orderKey": "id"},
+	}
+	assert.EqualError(t, rules.Reload(cfg), "order key (id) of source workers must be topic or the field of payload like payload.id")
+}